@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Alert is a notification raised by one of the background detectors.
+type Alert struct {
+	Location string    `json:"location"`
+	Kind     string    `json:"kind"`
+	AsOf     time.Time `json:"asOf"`
+	Message  string    `json:"message"`
+}
+
+// AlertSink delivers alerts somewhere a human will see them.
+type AlertSink interface {
+	Send(a Alert) error
+}
+
+// logAlertSink writes alerts to the service log.
+type logAlertSink struct{}
+
+func (logAlertSink) Send(a Alert) error {
+	log.Warn().Str("location", a.Location).Str("kind", a.Kind).Time("asOf", a.AsOf).Msg(a.Message)
+	return nil
+}
+
+// webhookAlertSink posts alerts as JSON to a URL.
+type webhookAlertSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s webhookAlertSink) Send(a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	resp, err := s.Client.Post(s.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned %s", s.URL, resp.Status)
+	}
+	return nil
+}
+
+// multiAlertSink sends to every sink, returning the first error.
+type multiAlertSink []AlertSink
+
+func (m multiAlertSink) Send(a Alert) error {
+	var firstErr error
+	for _, s := range m {
+		if err := s.Send(a); err != nil {
+			log.Error().Err(err).Msg("alert sink")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// newAlertSink always logs alerts and also posts them to the configured webhook when there is one.
+func newAlertSink() AlertSink {
+	sinks := multiAlertSink{logAlertSink{}}
+	if url := config().Alerts.WebhookURL; url != "" {
+		sinks = append(sinks, webhookAlertSink{URL: url, Client: &http.Client{Timeout: 10 * time.Second}})
+	}
+	return sinks
+}
+
+// configuredAlertSink sends through newAlertSink at the time of each alert, so a config reload
+// changes where alerts go without restarting the detectors.
+type configuredAlertSink struct{}
+
+func (configuredAlertSink) Send(a Alert) error {
+	return newAlertSink().Send(a)
+}
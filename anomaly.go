@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	fiveMinSlotsPerDay = 24 * 60 / 5
+	baselineWeeks      = 8
+	anomalyThreshold   = 4.0   // standard deviations from the slot mean
+	anomalyMinWatts    = 300.0 // ignore deviations smaller than this
+	anomalyMinStdDev   = 50.0  // floor so flat slots don't flag every wiggle
+	anomalyMinSamples  = 3     // weeks of history a slot needs before it is trusted
+)
+
+// slotStats is a running mean/variance (Welford) of the load seen in one weekday time slot.
+type slotStats struct {
+	N    int
+	Mean float64
+	M2   float64
+}
+
+func (s *slotStats) add(x float64) {
+	s.N++
+	d := x - s.Mean
+	s.Mean += d / float64(s.N)
+	s.M2 += d * (x - s.Mean)
+}
+
+func (s slotStats) stdDev() float64 {
+	if s.N < 2 {
+		return 0
+	}
+	return math.Sqrt(s.M2 / float64(s.N-1))
+}
+
+// LoadBaseline is the typical LoadAvg for a location by weekday and five minute slot.
+type LoadBaseline struct {
+	Location string
+	BuiltAt  time.Time
+	slots    [7][fiveMinSlotsPerDay]slotStats
+}
+
+// LoadAnomaly is a five minute interval whose load deviated strongly from the baseline.
+type LoadAnomaly struct {
+	Location string  `json:"location"`
+	DateTime int64   `json:"dateTime"`
+	DT       string  `json:"dt"`
+	LoadAvg  float64 `json:"loadAvg"`
+	Expected float64 `json:"expected"`
+	StdDev   float64 `json:"stdDev"`
+	Score    float64 `json:"score"`
+}
+
+// baselineSlot is the weekday and five minute slot of the location's wall clock, so the
+// profile follows the household's routine across DST changes.
+func baselineSlot(location string, dt int64) (time.Weekday, int) {
+	t := localTime(location, dt)
+	return t.Weekday(), (t.Hour()*60 + t.Minute()) / 5
+}
+
+// buildLoadBaseline learns the per weekday/slot load profile from five minute stats.
+func buildLoadBaseline(location string, recs []StatsDisplayRecord) *LoadBaseline {
+	b := &LoadBaseline{Location: location, BuiltAt: time.Now()}
+	for _, r := range recs {
+		if r.NumLoadSamples == 0 {
+			continue
+		}
+		day, slot := baselineSlot(location, r.DateTime)
+		b.slots[day][slot].add(r.LoadAvg)
+	}
+	return b
+}
+
+// check scores a five minute record against the baseline.
+func (b *LoadBaseline) check(r StatsDisplayRecord) (LoadAnomaly, bool) {
+	a := LoadAnomaly{Location: r.Location, DateTime: r.DateTime, LoadAvg: r.LoadAvg}
+	if r.NumLoadSamples == 0 {
+		return a, false
+	}
+	day, slot := baselineSlot(b.Location, r.DateTime)
+	s := b.slots[day][slot]
+	if s.N < anomalyMinSamples {
+		return a, false
+	}
+	a.Expected = s.Mean
+	a.StdDev = math.Max(s.stdDev(), anomalyMinStdDev)
+	a.Score = (r.LoadAvg - a.Expected) / a.StdDev
+	a.DT = localTime(b.Location, r.DateTime).Format("2006-01-02 15:04")
+	return a, math.Abs(a.Score) >= anomalyThreshold && math.Abs(r.LoadAvg-a.Expected) >= anomalyMinWatts
+}
+
+const createLoadAnomaliesTable = `create table if not exists load_anomalies (
+	location varchar(16) not null,
+	datetime bigint not null,
+	load_avg double not null,
+	expected double not null,
+	stddev double not null,
+	score double not null,
+	primary key (location, datetime)
+)`
+
+// saveLoadAnomaly stores a new anomaly, recording the change in data_versions.
+func saveLoadAnomaly(a LoadAnomaly) error {
+	r, err := db.Exec("insert ignore into load_anomalies (location, datetime, load_avg, expected, stddev, score) values (?, ?, ?, ?, ?, ?)",
+		a.Location, a.DateTime, a.LoadAvg, a.Expected, a.StdDev, a.Score)
+	if err != nil {
+		log.Error().Err(err).Msgf("saveLoadAnomaly(%+v)", a)
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil || n > 0 {
+		return touchDataVersion(a.Location)
+	}
+	return nil
+}
+
+func getLoadAnomalies(location string, beginDate int64, endDate int64) ([]LoadAnomaly, error) {
+	log.Debug().Msgf("getLoadAnomalies(%s, %d, %d)", location, beginDate, endDate)
+	dbConnect()
+	rows, err := db.Query("select location, datetime, load_avg, expected, stddev, score from load_anomalies "+
+		"where location = ? and datetime >= ? and datetime <= ? order by datetime", location, beginDate, endDate)
+	if err != nil {
+		log.Error().Err(err).Msgf("getLoadAnomalies(): %+v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	recs := make([]LoadAnomaly, 0)
+	for rows.Next() {
+		var a LoadAnomaly
+		if err := rows.Scan(&a.Location, &a.DateTime, &a.LoadAvg, &a.Expected, &a.StdDev, &a.Score); err != nil {
+			log.Error().Err(err).Msgf("getLoadAnomalies(): %+v", err)
+			return recs, err
+		}
+		a.DT = localTime(a.Location, a.DateTime).Format("2006-01-02 15:04")
+		recs = append(recs, a)
+	}
+	return recs, rows.Err()
+}
+
+// chartAnnotation is a Highcharts annotation label at a point of the first series.
+type chartAnnotation struct {
+	Point struct {
+		X     int64   `json:"x"`
+		Y     float64 `json:"y"`
+		XAxis int     `json:"xAxis"`
+		YAxis int     `json:"yAxis"`
+	} `json:"point"`
+	Text string `json:"text"`
+}
+
+// anomalyAnnotations labels anomalies on the consumption series.
+func anomalyAnnotations(in []LoadAnomaly) []chartAnnotation {
+	labels := make([]chartAnnotation, 0, len(in))
+	for _, a := range in {
+		var l chartAnnotation
+		l.Point.X, l.Point.Y = a.DateTime*1000, a.LoadAvg
+		l.Text = fmt.Sprintf("%.0fw (expected %.0fw)", a.LoadAvg, a.Expected)
+		labels = append(labels, l)
+	}
+	return labels
+}
+
+// anomalyDetector periodically compares new five minute stats with each location's baseline.
+type anomalyDetector struct {
+	sink        AlertSink
+	mu          sync.Mutex
+	baselines   map[string]*LoadBaseline
+	lastChecked map[string]int64
+	lastAlerted map[string]int64
+}
+
+func newAnomalyDetector(sink AlertSink) *anomalyDetector {
+	return &anomalyDetector{
+		sink:        sink,
+		baselines:   make(map[string]*LoadBaseline),
+		lastChecked: make(map[string]int64),
+		lastAlerted: make(map[string]int64),
+	}
+}
+
+func (d *anomalyDetector) baseline(location string, now time.Time) (*LoadBaseline, error) {
+	if b, ok := d.baselines[location]; ok && now.Sub(b.BuiltAt) < 24*time.Hour {
+		return b, nil
+	}
+	recs, err := getFiveMinStats(location, now.AddDate(0, 0, -7*baselineWeeks).Unix(), now.AddDate(0, 0, -1).Unix())
+	if err != nil {
+		return nil, err
+	}
+	b := buildLoadBaseline(location, recs)
+	d.baselines[location] = b
+	log.Info().Msgf("built load baseline for %s from %d intervals", location, len(recs))
+	return b, nil
+}
+
+// checkLocation scores the intervals closed since the last check, storing and alerting on
+// anomalies. The interval still collecting samples waits for the next check.
+func (d *anomalyDetector) checkLocation(location string, now time.Time) ([]LoadAnomaly, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b, err := d.baseline(location, now)
+	if err != nil {
+		return nil, err
+	}
+	since, ok := d.lastChecked[location]
+	if !ok {
+		since = now.Add(-time.Hour).Unix()
+	}
+	recs, err := getFiveMinStats(location, since+1, lastClosedFiveMin(now))
+	if err != nil {
+		return nil, err
+	}
+	found := make([]LoadAnomaly, 0)
+	for _, r := range recs {
+		d.lastChecked[location] = r.DateTime
+		a, anomalous := b.check(r)
+		if !anomalous {
+			continue
+		}
+		found = append(found, a)
+		if err := saveLoadAnomaly(a); err != nil {
+			return found, err
+		}
+		// one alert per episode rather than one per interval
+		if a.DateTime-d.lastAlerted[location] > 3600 {
+			_ = d.sink.Send(Alert{
+				Location: location,
+				Kind:     "load-anomaly",
+				AsOf:     time.Unix(a.DateTime, 0),
+				Message:  fmt.Sprintf("%s load %.0fw at %s, expected %.0fw ± %.0fw", location, a.LoadAvg, a.DT, a.Expected, a.StdDev),
+			})
+		}
+		d.lastAlerted[location] = a.DateTime
+	}
+	return found, nil
+}
+
+func (d *anomalyDetector) run(interval time.Duration) {
+	dbConnect()
+	if _, err := db.Exec(createLoadAnomaliesTable); err != nil {
+		log.Error().Err(err).Msg("creating load_anomalies")
+		return
+	}
+	for {
+		for _, location := range registry.ids() {
+			found, err := d.checkLocation(location, time.Now())
+			if err != nil {
+				log.Error().Err(err).Msgf("anomalyDetector checkLocation(%s)", location)
+			}
+			log.Debug().Msgf("anomalyDetector: %s %d anomalies", location, len(found))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// startAnomalyDetector runs the detector in the background when ANOMALY_DETECTION is set.
+func startAnomalyDetector(sink AlertSink) {
+	if !config().AnomalyDetection {
+		log.Info().Msg("load anomaly detection disabled")
+		return
+	}
+	log.Info().Msg("starting load anomaly detection")
+	go newAnomalyDetector(sink).run(5 * time.Minute)
+}
+
+func anomalyAPIHandler(w http.ResponseWriter, r *http.Request) {
+	loc, ok := requestLocation(w, r)
+	if !ok {
+		return
+	}
+	location := loc.ID
+	days, err := daysParam(r, "days", config().GraphDays)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now().In(loc.TZ())
+	beginDate := now.AddDate(0, 0, -1*days).Unix()
+	endDate := now.Unix()
+	anomalies, err := getLoadAnomalies(location, beginDate, endDate)
+	if err != nil {
+		s := fmt.Sprintf("%+v", err)
+		http.Error(w, s, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, anomalies)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadBaselineCheck(t *testing.T) {
+	testInit()
+	slot := time.Date(2026, 3, 2, 3, 0, 0, 0, time.Local) // a Monday, 3am
+	var history []StatsDisplayRecord
+	for week := 1; week <= 4; week++ {
+		dt := slot.AddDate(0, 0, -7*week).Unix()
+		history = append(history, StatsDisplayRecord{Location: "VT", DateTime: dt, LoadAvg: 400 + float64(week*10), NumLoadSamples: 100})
+	}
+	b := buildLoadBaseline("VT", history)
+
+	normal := StatsDisplayRecord{Location: "VT", DateTime: slot.Unix(), LoadAvg: 430, NumLoadSamples: 100}
+	if a, anomalous := b.check(normal); anomalous {
+		t.Errorf("normal load flagged: %+v", a)
+	}
+
+	stuckPump := StatsDisplayRecord{Location: "VT", DateTime: slot.Unix(), LoadAvg: 1600, NumLoadSamples: 100}
+	a, anomalous := b.check(stuckPump)
+	if !anomalous {
+		t.Fatalf("high load not flagged: %+v", a)
+	}
+	if a.Expected != 425 || a.Score <= anomalyThreshold {
+		t.Errorf("unexpected anomaly: %+v", a)
+	}
+
+	otherSlot := StatsDisplayRecord{Location: "VT", DateTime: slot.Add(time.Hour).Unix(), LoadAvg: 1600, NumLoadSamples: 100}
+	if _, anomalous := b.check(otherSlot); anomalous {
+		t.Error("slot without history flagged")
+	}
+}
+
+func TestAnomalyAnnotations(t *testing.T) {
+	got := anomalyAnnotations([]LoadAnomaly{{DateTime: 10, LoadAvg: 1600, Expected: 425}})
+	if len(got) != 1 || got[0].Point.X != 10000 || got[0].Point.Y != 1600 || got[0].Text != "1600w (expected 425w)" {
+		t.Errorf("unexpected annotations: %+v", got)
+	}
+}
+
+func TestBaselineSlotFollowsWallClockAcrossDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no tzdata")
+	}
+	registry.set([]LocationInfo{{ID: "VT", TimeLocation: ny}})
+	defer registry.set(nil)
+
+	before := time.Date(2026, 3, 1, 7, 0, 0, 0, ny) // EST
+	after := time.Date(2026, 3, 8, 7, 0, 0, 0, ny)  // EDT
+	day1, slot1 := baselineSlot("VT", before.Unix())
+	day2, slot2 := baselineSlot("VT", after.Unix())
+	if day1 != time.Sunday || day2 != time.Sunday || slot1 != 84 || slot2 != 84 {
+		t.Errorf("got %s/%d and %s/%d, want Sunday/84 for both", day1, slot1, day2, slot2)
+	}
+}
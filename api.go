@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// intParam returns the named query parameter as an int, or def if it's missing. Values that
+// aren't integers from min to max are an error for a 400.
+func intParam(r *http.Request, name string, def int, min int, max int) (int, error) {
+	vals, ok := r.URL.Query()[name]
+	if !ok || len(vals) == 0 || vals[0] == "" {
+		return def, nil
+	}
+	if len(vals) > 1 {
+		return 0, fmt.Errorf("%s: give it once", name)
+	}
+	v, err := strconv.Atoi(vals[0])
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("%s: must be a whole number from %d to %d, got %q", name, min, max, vals[0])
+	}
+	return v, nil
+}
+
+// writeJSON encodes v as the JSON response body.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Err(err).Msg("writeJSON()")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+//go:generate go run fetchassets.go
+
+// assetFiles are the scripts, styles and images the pages use, including the Highcharts build
+// vendored under assets/vendor, so the dashboard works without reaching a CDN and the build
+// doesn't need the network.
+//
+//go:embed assets
+var assetFiles embed.FS
+
+// assetFS is the assets directory, which is served at /assets/.
+var assetFS, _ = fs.Sub(assetFiles, "assets")
+
+// assetHashes are short content hashes of the assets by path.
+var assetHashes = hashAssets(assetFS)
+
+func hashAssets(fsys fs.FS) map[string]string {
+	hashes := make(map[string]string)
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(b)
+		hashes[path] = hex.EncodeToString(sum[:6])
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("hashing assets")
+	}
+	return hashes
+}
+
+// asset is the URL of an asset with its hash, so a browser can cache it for good and still
+// fetches a new build of it. An asset that isn't built in has no hash.
+func asset(path string) string {
+	h, ok := assetHashes[path]
+	if !ok {
+		return "/assets/" + path
+	}
+	return "/assets/" + path + "?v=" + h
+}
+
+// assetCall is a template's call of asset with a literal path.
+var assetCall = regexp.MustCompile(`{{-?\s*asset\s+"([^"]+)"\s*-?}}`)
+
+// checkAssets returns an error naming the assets the templates use that aren't built in.
+func checkAssets() error {
+	names, err := fs.Glob(templateFiles, "*.html")
+	if err != nil {
+		return err
+	}
+	missing := make(map[string]bool)
+	for _, name := range names {
+		b, err := fs.ReadFile(templateFiles, name)
+		if err != nil {
+			return err
+		}
+		for _, m := range assetCall.FindAllSubmatch(b, -1) {
+			if _, ok := assetHashes[string(m[1])]; !ok {
+				missing[string(m[1])] = true
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	paths := make([]string, 0, len(missing))
+	for p := range missing {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return fmt.Errorf("assets missing from the build: %s; run go generate and commit assets/vendor", strings.Join(paths, ", "))
+}
+
+// assetHandler serves the built in assets. Requests with the current hash can be cached for
+// a year.
+func assetHandler() http.Handler {
+	files := http.StripPrefix("/assets/", http.FileServer(http.FS(assetFS)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := r.URL.Query().Get("v")
+		if v != "" && v == assetHashes[strings.TrimPrefix(r.URL.Path, "/assets/")] {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		}
+		files.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAsset(t *testing.T) {
+	url := asset("paho-mqtt.js")
+	if !strings.HasPrefix(url, "/assets/paho-mqtt.js?v=") || len(url) != len("/assets/paho-mqtt.js?v=")+12 {
+		t.Fatalf("asset = %q", url)
+	}
+	h := assetHandler()
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+	if w := get(url); w.Code != 200 || w.Header().Get("Cache-Control") != "public, max-age=31536000, immutable" || w.Body.Len() == 0 {
+		t.Errorf("current asset got %d %v", w.Code, w.Header())
+	}
+	if w := get("/assets/paho-mqtt.js?v=0123456789ab"); w.Code != 200 || w.Header().Get("Cache-Control") != "" {
+		t.Errorf("stale hash got %d %v", w.Code, w.Header())
+	}
+	if w := get("/assets/missing.js"); w.Code != 404 {
+		t.Errorf("missing asset got %d", w.Code)
+	}
+	if got := asset("missing.js"); got != "/assets/missing.js" {
+		t.Errorf("missing asset = %q", got)
+	}
+}
+
+// The Highcharts build and everything else the templates use is checked in and built in.
+func TestAssetsBuiltIn(t *testing.T) {
+	if _, ok := assetHashes["vendor/highcharts/highstock.js"]; !ok {
+		t.Error("vendor/highcharts/highstock.js isn't built in")
+	}
+	if err := checkAssets(); err != nil {
+		t.Error(err)
+	}
+}
+
+// The rendered pages load nothing from other hosts, so they work offline.
+func TestPagesSelfContained(t *testing.T) {
+	external := regexp.MustCompile(`(src="|<link[^>]*href="|url\()(https?:)?//`)
+	for name, data := range samplePages("VT") {
+		var b bytes.Buffer
+		if err := parseTemplate(name).Execute(&b, data); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if m := external.Find(b.Bytes()); m != nil {
+			t.Errorf("%s loads %s from another host", name, m)
+		}
+	}
+}
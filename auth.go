@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AuthConfig is who can sign in and which locations they can see. With no mode the service
+// is open to anyone, as it always was.
+type AuthConfig struct {
+	Mode          string         `yaml:"mode"`           // how people sign in to the pages: "", basic, session or oidc
+	SessionSecret string         `yaml:"session_secret"` // signs session cookies; if empty sessions end on restart
+	SessionHours  int            `yaml:"session_hours"`
+	Users         []UserConfig   `yaml:"users"`
+	APIKeys       []APIKeyConfig `yaml:"api_keys"` // for scripts calling the JSON API in any mode
+	OIDC          OIDCConfig     `yaml:"oidc"`
+}
+
+// UserConfig is a user and the locations they can see.
+type UserConfig struct {
+	Name         string   `yaml:"name"`          // the user_claim of OIDC users, usually their email
+	PasswordHash string   `yaml:"password_hash"` // bcrypt, from the passwd command; empty for OIDC only users
+	Locations    []string `yaml:"locations"`     // location ids, or * for all of them
+}
+
+// APIKeyConfig is a key for the JSON API, which acts as one of the users.
+type APIKeyConfig struct {
+	Key  string `yaml:"key"`
+	User string `yaml:"user"`
+}
+
+var authModes = map[string]bool{"": true, "basic": true, "session": true, "oidc": true}
+
+// minAPIKeyLength keeps keys long enough not to be guessed.
+const minAPIKeyLength = 16
+
+// validate returns a description of everything wrong with a, uppercasing the location ids.
+func (a *AuthConfig) validate() []string {
+	var problems []string
+	if !authModes[a.Mode] {
+		problems = append(problems, fmt.Sprintf("auth.mode: must be empty, basic, session or oidc, got %q", a.Mode))
+	}
+	if a.SessionHours < 0 {
+		problems = append(problems, fmt.Sprintf("auth.session_hours: must not be negative, got %d", a.SessionHours))
+	}
+	users := make(map[string]bool)
+	for i, u := range a.Users {
+		if u.Name == "" {
+			problems = append(problems, fmt.Sprintf("auth.users[%d]: name must be set", i))
+		}
+		if users[u.Name] {
+			problems = append(problems, fmt.Sprintf("auth.users[%d]: duplicate name %s", i, u.Name))
+		}
+		users[u.Name] = true
+		if u.PasswordHash != "" {
+			if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+				problems = append(problems, fmt.Sprintf("auth.users[%d]: password_hash is not a bcrypt hash", i))
+			}
+		}
+		for j, l := range u.Locations {
+			a.Users[i].Locations[j] = strings.ToUpper(l)
+		}
+	}
+	for i, k := range a.APIKeys {
+		if len(k.Key) < minAPIKeyLength {
+			problems = append(problems, fmt.Sprintf("auth.api_keys[%d]: key must be at least %d characters", i, minAPIKeyLength))
+		}
+		if !users[k.User] {
+			problems = append(problems, fmt.Sprintf("auth.api_keys[%d]: unknown user %q", i, k.User))
+		}
+	}
+	if a.Mode == "oidc" {
+		problems = append(problems, a.OIDC.validate()...)
+	}
+	return problems
+}
+
+// user is a signed in user. A nil user is everyone when auth is off, and sees everything.
+type user struct {
+	Name      string
+	all       bool
+	locations map[string]bool
+}
+
+func (u *user) canSee(location string) bool {
+	return u == nil || u.all || u.locations[location]
+}
+
+// authState is the sign in config in the form requests check it against.
+type authState struct {
+	mode     string
+	users    map[string]*user
+	hashes   map[string][]byte
+	keys     map[[sha256.Size]byte]*user
+	secret   []byte
+	lifetime time.Duration
+	oidc     *oidcProvider
+}
+
+var currentAuth atomic.Pointer[authState]
+
+// fallbackSecret signs sessions when no secret is configured, so they last until a restart.
+var fallbackSecret = randomBytes(32)
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// applyAuth makes c the sign in config, or turns sign in off if it has no mode.
+func applyAuth(c AuthConfig) {
+	if c.Mode == "" {
+		currentAuth.Store(nil)
+		return
+	}
+	a := &authState{
+		mode:     c.Mode,
+		users:    make(map[string]*user),
+		hashes:   make(map[string][]byte),
+		keys:     make(map[[sha256.Size]byte]*user),
+		secret:   []byte(c.SessionSecret),
+		lifetime: time.Duration(c.SessionHours) * time.Hour,
+	}
+	if len(a.secret) == 0 {
+		a.secret = fallbackSecret
+	}
+	if a.lifetime == 0 {
+		a.lifetime = 7 * 24 * time.Hour
+	}
+	for _, uc := range c.Users {
+		u := &user{Name: uc.Name, locations: make(map[string]bool)}
+		for _, l := range uc.Locations {
+			if l == "*" {
+				u.all = true
+			}
+			u.locations[l] = true
+		}
+		a.users[u.Name] = u
+		if uc.PasswordHash != "" {
+			a.hashes[u.Name] = []byte(uc.PasswordHash)
+		}
+	}
+	for _, k := range c.APIKeys {
+		a.keys[sha256.Sum256([]byte(k.Key))] = a.users[k.User]
+	}
+	if c.Mode == "oidc" {
+		a.oidc = newOIDCProvider(c.OIDC)
+	}
+	currentAuth.Store(a)
+}
+
+// password returns the user if the password is theirs.
+func (a *authState) password(name string, password string) *user {
+	hash, ok := a.hashes[name]
+	if !ok || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return nil
+	}
+	return a.users[name]
+}
+
+// apiKey returns the user the request's API key acts as, from an Authorization: Bearer or an
+// X-API-Key header.
+func (a *authState) apiKey(r *http.Request) *user {
+	key := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if key == "" {
+		return nil
+	}
+	// the map lookup is by hash, so it doesn't leak how much of a key matches
+	return a.keys[sha256.Sum256([]byte(key))]
+}
+
+// sign is the base64 HMAC of value.
+func (a *authState) sign(value string) string {
+	m := hmac.New(sha256.New, a.secret)
+	m.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// signed is value with its signature, for a cookie.
+func (a *authState) signed(value string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(value)) + "." + a.sign(value)
+}
+
+// verify returns the value of a signed cookie, or false if it was tampered with.
+func (a *authState) verify(cookie string) (string, bool) {
+	enc, sig, ok := strings.Cut(cookie, ".")
+	if !ok {
+		return "", false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil || subtle.ConstantTimeCompare([]byte(sig), []byte(a.sign(string(b)))) != 1 {
+		return "", false
+	}
+	return string(b), true
+}
+
+const sessionCookie = "energy_session"
+
+// startSession signs u in with a session cookie.
+func (a *authState) startSession(w http.ResponseWriter, r *http.Request, u *user, now time.Time) {
+	expires := now.Add(a.lifetime)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    a.signed(u.Name + "|" + strconv.FormatInt(expires.Unix(), 10)),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// session returns the user signed in by the request's session cookie. Users taken out of the
+// config are signed out.
+func (a *authState) session(r *http.Request, now time.Time) *user {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	v, ok := a.verify(c.Value)
+	if !ok {
+		return nil
+	}
+	i := strings.LastIndex(v, "|")
+	if i < 0 {
+		return nil
+	}
+	name, expires := v[:i], v[i+1:]
+	if exp, err := strconv.ParseInt(expires, 10, 64); err != nil || now.Unix() >= exp {
+		return nil
+	}
+	return a.users[name]
+}
+
+// secureRequest says whether r came over TLS, directly or through a proxy like Cloud Run's.
+func secureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// identify returns the user r is from: an API key works everywhere, and pages also take the
+// credentials of the sign in mode.
+func (a *authState) identify(r *http.Request) *user {
+	if u := a.apiKey(r); u != nil {
+		return u
+	}
+	if a.mode == "basic" {
+		if name, password, ok := r.BasicAuth(); ok {
+			return a.password(name, password)
+		}
+		return nil
+	}
+	return a.session(r, time.Now())
+}
+
+type userKey struct{}
+
+// requestUser is the user the request is from, nil if auth is off.
+func requestUser(r *http.Request) *user {
+	u, _ := r.Context().Value(userKey{}).(*user)
+	return u
+}
+
+// publicPath is a path anyone can get: the sign in pages and the scripts and styles.
+func publicPath(path string) bool {
+	return path == "/login" || path == "/logout" || path == oidcCallbackPath || strings.HasPrefix(path, "/assets/")
+}
+
+// authenticate lets through requests from signed in users, with the user in the request's
+// context. Others get a 401 from the API, or are asked to sign in.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := currentAuth.Load()
+		if a == nil || publicPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u := a.identify(r)
+		if u == nil {
+			a.challenge(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, u)))
+	})
+}
+
+// challenge tells the client to sign in.
+func (a *authState) challenge(w http.ResponseWriter, r *http.Request) {
+	if a.mode == "basic" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="energy", charset="UTF-8"`)
+		http.Error(w, "sign in required", http.StatusUnauthorized)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="energy"`)
+		http.Error(w, "sign in required", http.StatusUnauthorized)
+		return
+	}
+	http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+}
+
+// localRedirect is next if it's a path on this site, so sign in can't redirect elsewhere.
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+var loginTmpl *template.Template
+
+// LoginPage is the session sign in form.
+type LoginPage struct {
+	Next  string
+	Error string
+}
+
+// loginHandler shows the sign in form and checks it, or starts OIDC sign in.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	a := currentAuth.Load()
+	if a == nil || a.mode == "basic" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	next := localRedirect(r.FormValue("next"))
+	if a.mode == "oidc" {
+		a.startOIDC(w, r, next)
+		return
+	}
+	page := LoginPage{Next: next}
+	if r.Method == http.MethodPost {
+		if u := a.password(r.PostFormValue("user"), r.PostFormValue("password")); u != nil {
+			a.startSession(w, r, u, time.Now())
+			log.Info().Msgf("%s signed in", u.Name)
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		log.Warn().Msgf("failed sign in for %q", r.PostFormValue("user"))
+		page.Error = "The user or password is wrong."
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	if err := loginTmpl.Execute(w, page); err != nil {
+		msg := http.StatusText(http.StatusInternalServerError)
+		log.Error().Err(err).Msg(msg)
+	}
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1, HttpOnly: true, Secure: secureRequest(r), SameSite: http.SameSiteLaxMode})
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// visibleLocations are the registered locations the request's user can see.
+func visibleLocations(r *http.Request) []LocationInfo {
+	u := requestUser(r)
+	locs := make([]LocationInfo, 0)
+	for _, l := range registry.list() {
+		if u.canSee(l.ID) {
+			locs = append(locs, l)
+		}
+	}
+	return locs
+}
+
+// hashPassword is the bcrypt hash for a user's password_hash.
+func hashPassword(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(h), err
+}
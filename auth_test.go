@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAPIKey = "0123456789abcdef-vt"
+
+// testAuth turns on sign in with alice, who sees everything, and bob, who sees VT through
+// his password or an API key.
+func testAuth(t *testing.T, mode string) {
+	t.Helper()
+	alice, err := hashPassword("alice's password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := hashPassword("bob's password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := AuthConfig{
+		Mode: mode,
+		Users: []UserConfig{
+			{Name: "alice", PasswordHash: alice, Locations: []string{"*"}},
+			{Name: "bob", PasswordHash: bob, Locations: []string{"vt"}},
+		},
+		APIKeys: []APIKeyConfig{{Key: testAPIKey, User: "bob"}},
+	}
+	if problems := c.validate(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	applyAuth(c)
+	registry.set([]LocationInfo{{ID: "NH", Name: "New Hampshire"}, {ID: "VT", Name: "Vermont"}})
+	t.Cleanup(func() {
+		applyAuth(AuthConfig{})
+		registry.set(nil)
+	})
+}
+
+// locationServer is the service with a page and an API that serve the request's location.
+func locationServer() http.Handler {
+	mux := http.NewServeMux()
+	location := func(w http.ResponseWriter, r *http.Request) {
+		if loc, ok := requestLocation(w, r); ok {
+			io.WriteString(w, loc.ID)
+		}
+	}
+	mux.HandleFunc("/energy", location)
+	mux.HandleFunc("/api/chart", location)
+	mux.HandleFunc("/api/locations", locationsAPIHandler)
+	mux.HandleFunc("/api/cache", cacheAPIHandler)
+	mux.HandleFunc("/login", loginHandler)
+	mux.Handle("/assets/", assetHandler())
+	return authenticate(mux)
+}
+
+func serveRequest(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAuthConfigValidate(t *testing.T) {
+	c := AuthConfig{
+		Mode:    "ldap",
+		Users:   []UserConfig{{Name: "alice", PasswordHash: "hunter2"}, {Name: "alice"}},
+		APIKeys: []APIKeyConfig{{Key: "short", User: "carol"}},
+	}
+	got := strings.Join(c.validate(), "\n")
+	for _, want := range []string{"auth.mode", "not a bcrypt hash", "duplicate name alice", "at least 16", `unknown user "carol"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in\n%s", want, got)
+		}
+	}
+	c = AuthConfig{Mode: "oidc", OIDC: OIDCConfig{Issuer: "accounts.example.com", RedirectURL: "https://energy.example.com/callback"}}
+	got = strings.Join(c.validate(), "\n")
+	for _, want := range []string{"auth.oidc.issuer", "must end in /auth/callback", "auth.oidc.client_id"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in\n%s", want, got)
+		}
+	}
+}
+
+func TestAuthOff(t *testing.T) {
+	registry.set([]LocationInfo{{ID: "VT"}})
+	defer registry.set(nil)
+	if w := serveRequest(locationServer(), httptest.NewRequest("GET", "/energy?location=VT", nil)); w.Code != 200 || w.Body.String() != "VT" {
+		t.Errorf("got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestAPIKeyAndACL(t *testing.T) {
+	testAuth(t, "session")
+	h := locationServer()
+	get := func(url string, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", url, nil)
+		if key != "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+		return serveRequest(h, r)
+	}
+
+	if w := get("/api/chart?location=VT", ""); w.Code != 401 || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("no key got %d %v", w.Code, w.Header())
+	}
+	if w := get("/api/chart?location=VT", "not-the-key-at-all"); w.Code != 401 {
+		t.Errorf("wrong key got %d", w.Code)
+	}
+	if w := get("/api/chart?location=VT", testAPIKey); w.Code != 200 || w.Body.String() != "VT" {
+		t.Errorf("key got %d %q", w.Code, w.Body.String())
+	}
+	// a location bob can't see looks the same as one that doesn't exist
+	hidden, unknown := get("/api/chart?location=NH", testAPIKey), get("/api/chart?location=XX", testAPIKey)
+	if hidden.Code != 404 || hidden.Body.String() != strings.Replace(unknown.Body.String(), "XX", "NH", 1) {
+		t.Errorf("another location got %d %q", hidden.Code, hidden.Body.String())
+	}
+	// the default location is NH, which bob can't see
+	if w := get("/api/chart", testAPIKey); w.Code != 200 || w.Body.String() != "VT" {
+		t.Errorf("default location got %d %q", w.Code, w.Body.String())
+	}
+	if w := get("/api/locations", testAPIKey); !strings.Contains(w.Body.String(), `"VT"`) || strings.Contains(w.Body.String(), `"NH"`) {
+		t.Errorf("locations got %s", w.Body.String())
+	}
+
+	r := httptest.NewRequest("GET", "/api/chart?location=VT", nil)
+	r.Header.Set("X-API-Key", testAPIKey)
+	if w := serveRequest(h, r); w.Code != 200 {
+		t.Errorf("X-API-Key got %d", w.Code)
+	}
+	if w := get("/energy?location=VT&x=1", ""); w.Code != 302 || w.Header().Get("Location") != "/login?next="+url.QueryEscape("/energy?location=VT&x=1") {
+		t.Errorf("page got %d %v", w.Code, w.Header())
+	}
+	if w := get("/assets/paho-mqtt.js", ""); w.Code != 200 {
+		t.Errorf("asset got %d", w.Code)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	testAuth(t, "basic")
+	h := locationServer()
+	for _, c := range []struct {
+		user, password string
+		location       string
+		want           int
+	}{
+		{"", "", "VT", 401},
+		{"alice", "wrong", "VT", 401},
+		{"alice", "alice's password", "NH", 200},
+		{"bob", "bob's password", "VT", 200},
+		{"bob", "bob's password", "NH", 404},
+		{"carol", "bob's password", "VT", 401},
+	} {
+		r := httptest.NewRequest("GET", "/energy?location="+c.location, nil)
+		if c.user != "" {
+			r.SetBasicAuth(c.user, c.password)
+		}
+		w := serveRequest(h, r)
+		if w.Code != c.want {
+			t.Errorf("%s/%s for %s got %d, want %d", c.user, c.password, c.location, w.Code, c.want)
+		}
+		if w.Code == 401 && !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+			t.Errorf("401 without a basic challenge: %v", w.Header())
+		}
+	}
+}
+
+func TestCacheStatsACL(t *testing.T) {
+	testAuth(t, "basic")
+	h := locationServer()
+	r := httptest.NewRequest("GET", "/api/cache", nil)
+	r.Header.Set("X-API-Key", testAPIKey)
+	if w := serveRequest(h, r); w.Code != 403 {
+		t.Errorf("bob got %d", w.Code)
+	}
+	r = httptest.NewRequest("GET", "/api/cache", nil)
+	r.SetBasicAuth("alice", "alice's password")
+	if w := serveRequest(h, r); w.Code != 200 || !strings.Contains(w.Body.String(), `"hits"`) {
+		t.Errorf("alice got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestSessionLogin(t *testing.T) {
+	loginTmpl = parseTemplate("login.html")
+	testAuth(t, "session")
+	h := locationServer()
+	login := func(user, password, next string) *httptest.ResponseRecorder {
+		form := url.Values{"user": {user}, "password": {password}, "next": {next}}
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serveRequest(h, r)
+	}
+
+	if w := login("bob", "wrong", "/energy"); w.Code != 401 || !strings.Contains(w.Body.String(), "wrong") || len(w.Result().Cookies()) != 0 {
+		t.Errorf("wrong password got %d %v", w.Code, w.Header())
+	}
+	if w := login("bob", "bob's password", "//evil.example.com/"); w.Header().Get("Location") != "/" {
+		t.Errorf("offsite next redirected to %q", w.Header().Get("Location"))
+	}
+	w := login("bob", "bob's password", "/energy?location=VT")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/energy?location=VT" {
+		t.Fatalf("sign in got %d %v", w.Code, w.Header())
+	}
+	cookie := w.Result().Cookies()[0]
+	if cookie.Name != sessionCookie || !cookie.HttpOnly {
+		t.Fatalf("cookie %+v", cookie)
+	}
+
+	r := httptest.NewRequest("GET", "/energy?location=VT", nil)
+	r.AddCookie(cookie)
+	if w := serveRequest(h, r); w.Code != 200 || w.Body.String() != "VT" {
+		t.Errorf("signed in got %d %q", w.Code, w.Body.String())
+	}
+	a := currentAuth.Load()
+	if u := a.session(r, time.Now().Add(8*24*time.Hour)); u != nil {
+		t.Error("session outlived its lifetime")
+	}
+
+	// a cookie for another user with bob's signature
+	forged := *cookie
+	v, _ := a.verify(cookie.Value)
+	_, sig, _ := strings.Cut(cookie.Value, ".")
+	forged.Value = base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(v, "bob", "alice", 1))) + "." + sig
+	r = httptest.NewRequest("GET", "/energy?location=NH", nil)
+	r.AddCookie(&forged)
+	if w := serveRequest(h, r); w.Code != 302 {
+		t.Errorf("forged cookie got %d", w.Code)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var baseloadTmpl *template.Template
+
+const (
+	baseloadNightStart = 0 // overnight window, local hours [start, end)
+	baseloadNightEnd   = 5
+	baseloadWindow     = 6 // five minute intervals the load must be sustained for (30 minutes)
+	hoursPerYear       = 24 * 365
+	defaultEnergyPrice = 0.15
+)
+
+// BaseloadRecord is the always-on load for one day.
+type BaseloadRecord struct {
+	Location     string  `json:"location"`
+	DateTime     int64   `json:"dateTime"`
+	DT           string  `json:"dt"`
+	Baseload     float64 `json:"baseload"`
+	BaseloadTime int64   `json:"baseloadTime"`
+	BaseloadDT   string  `json:"baseloadDT"`
+	LowLoad      float64 `json:"lowLoad"`
+	LowLoadDT    string  `json:"lowLoadDT"`
+	AnnualKWh    float64 `json:"annualKWh"`
+	AnnualCost   float64 `json:"annualCost"`
+}
+
+// BaseloadReport tracks the overnight minimum sustained load over time.
+type BaseloadReport struct {
+	Location          string           `json:"location"`
+	Days              int              `json:"days"`
+	Price             float64          `json:"price"`
+	Recent            float64          `json:"recent"`
+	Previous          float64          `json:"previous"`
+	Change            float64          `json:"change"`
+	AnnualKWh         float64          `json:"annualKWh"`
+	AnnualCost        float64          `json:"annualCost"`
+	Records           []BaseloadRecord `json:"records"`
+	Info              LocationInfo     `json:"-"`
+	BaseloadGraphData []chartPoint     `json:"-"`
+	LowLoadGraphData  []chartPoint     `json:"-"`
+}
+
+// energyPrice is the configured cost of a kWh.
+func energyPrice() float64 {
+	return config().EnergyPrice
+}
+
+// sustainedMinimum returns the lowest average load over window consecutive intervals and when that run started.
+func sustainedMinimum(in []StatsDisplayRecord, window int) (float64, int64, bool) {
+	min := math.Inf(1)
+	var minTime int64
+	for i := 0; i+window <= len(in); i++ {
+		var total float64
+		ok := true
+		for _, r := range in[i : i+window] {
+			if r.NumLoadSamples == 0 {
+				ok = false
+				break
+			}
+			total += r.LoadAvg
+		}
+		// intervals must be contiguous for the load to count as sustained
+		if !ok || in[i+window-1].DateTime-in[i].DateTime != int64(window-1)*300 {
+			continue
+		}
+		if avg := total / float64(window); avg < min {
+			min = avg
+			minTime = in[i].DateTime
+		}
+	}
+	return min, minTime, !math.IsInf(min, 1)
+}
+
+// dailyBaseload computes each day's overnight baseload from five minute stats, alongside the day's LowLoad.
+func dailyBaseload(dayStats []StatsDisplayRecord, fiveMin []StatsDisplayRecord, price float64) []BaseloadRecord {
+	nights := make(map[string][]StatsDisplayRecord)
+	for _, r := range fiveMin {
+		t := localTime(r.Location, r.DateTime)
+		if t.Hour() < baseloadNightStart || t.Hour() >= baseloadNightEnd {
+			continue
+		}
+		day := t.Format("2006-01-02")
+		nights[day] = append(nights[day], r)
+	}
+
+	recs := make([]BaseloadRecord, 0)
+	for _, d := range dayStats {
+		rec := BaseloadRecord{Location: d.Location, DateTime: d.DateTime, DT: d.DT, LowLoad: d.LowLoad, LowLoadDT: d.LowLoadDT}
+		baseload, at, ok := sustainedMinimum(nights[d.DT], baseloadWindow)
+		if !ok {
+			continue
+		}
+		rec.Baseload = baseload
+		rec.BaseloadTime = at
+		rec.BaseloadDT = localTime(d.Location, at).Format("15:04")
+		rec.AnnualKWh = baseload * hoursPerYear / 1000
+		rec.AnnualCost = rec.AnnualKWh * price
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].DateTime < recs[j].DateTime })
+	return recs
+}
+
+func averageBaseload(in []BaseloadRecord) float64 {
+	if len(in) == 0 {
+		return math.NaN()
+	}
+	var total float64
+	for _, r := range in {
+		total += r.Baseload
+	}
+	return total / float64(len(in))
+}
+
+func baseloadChartData(in []BaseloadRecord) (baseload []chartPoint, lowLoad []chartPoint) {
+	base, low := make([]chartPoint, 0, len(in)), make([]chartPoint, 0, len(in))
+	for _, v := range in {
+		dt := v.DateTime * 1000
+		base = append(base, chartPoint{X: dt, Y: v.Baseload})
+		low = append(low, chartPoint{X: dt, Y: v.LowLoad})
+	}
+	return base, low
+}
+
+// baseloadReport compares the last week's baseload with the week before it and annualizes it.
+func baseloadReport(loc LocationInfo, days int) (BaseloadReport, error) {
+	log.Debug().Msgf("baseloadReport(%s, %d)", loc.ID, days)
+	location := loc.ID
+	report := BaseloadReport{Location: location, Days: days, Price: loc.Price(), Info: loc}
+	dbConnect()
+	dayStats, err := getDayStats(location, 0, time.Now().Unix(), days)
+	if err != nil {
+		return report, err
+	}
+	now := time.Now().In(loc.TZ())
+	beginDate := dayStart(now.AddDate(0, 0, -1*days)).Unix()
+	endDate := now.Unix()
+	fiveMin, err := getFiveMinStats(location, beginDate, endDate)
+	if err != nil {
+		return report, err
+	}
+	report.Records = dailyBaseload(dayStats, fiveMin, report.Price)
+
+	split := len(report.Records) - 7
+	if split < 0 {
+		split = 0
+	}
+	start := split - 7
+	if start < 0 {
+		start = 0
+	}
+	recent := report.Records[split:]
+	previous := report.Records[start:split]
+	report.Recent = averageBaseload(recent)
+	report.Previous = averageBaseload(previous)
+	report.Change = report.Recent - report.Previous
+	report.AnnualKWh = report.Recent * hoursPerYear / 1000
+	report.AnnualCost = report.AnnualKWh * report.Price
+	report.BaseloadGraphData, report.LowLoadGraphData = baseloadChartData(report.Records)
+	return report, nil
+}
+
+func baseloadHandler(w http.ResponseWriter, r *http.Request) {
+	loc, ok := requestLocation(w, r)
+	if !ok {
+		return
+	}
+	days, err := daysParam(r, "days", config().GraphDays)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report, err := baseloadReport(loc, days)
+	if err != nil {
+		s := fmt.Sprintf("%+v", err)
+		http.Error(w, s, http.StatusInternalServerError)
+		return
+	}
+	if err := baseloadTmpl.Execute(w, report); err != nil {
+		msg := http.StatusText(http.StatusInternalServerError)
+		log.Error().Err(err).Msg(msg)
+	}
+}
+
+func baseloadAPIHandler(w http.ResponseWriter, r *http.Request) {
+	loc, ok := requestLocation(w, r)
+	if !ok {
+		return
+	}
+	days, err := daysParam(r, "days", config().GraphDays)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report, err := baseloadReport(loc, days)
+	if err != nil {
+		s := fmt.Sprintf("%+v", err)
+		http.Error(w, s, http.StatusInternalServerError)
+		return
+	}
+	// without enough days the averages are NaN, which JSON has no number for
+	writeJSON(w, struct {
+		Location   string           `json:"location"`
+		Days       int              `json:"days"`
+		Price      float64          `json:"price"`
+		Recent     interface{}      `json:"recent"`
+		Previous   interface{}      `json:"previous"`
+		Change     interface{}      `json:"change"`
+		AnnualKWh  interface{}      `json:"annualKWh"`
+		AnnualCost interface{}      `json:"annualCost"`
+		Records    []BaseloadRecord `json:"records"`
+	}{report.Location, report.Days, report.Price, nullFloat(report.Recent), nullFloat(report.Previous), nullFloat(report.Change),
+		nullFloat(report.AnnualKWh), nullFloat(report.AnnualCost), report.Records})
+}
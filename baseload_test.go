@@ -0,0 +1,40 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseBaseload(t *testing.T) {
+	testInit()
+	baseloadTmpl = parseTemplate("baseload.html")
+}
+
+func TestDailyBaseload(t *testing.T) {
+	testInit()
+	day := time.Date(2026, 1, 10, 0, 0, 0, 0, time.Local)
+	var fiveMin []StatsDisplayRecord
+	for i := 0; i < 24*12; i++ {
+		load := 300.0
+		if i == 30 {
+			load = 100 // a single dip shouldn't count as sustained
+		}
+		if i >= 36 && i < 42 {
+			load = 200
+		}
+		fiveMin = append(fiveMin, StatsDisplayRecord{DateTime: day.Add(time.Duration(i) * 5 * time.Minute).Unix(), LoadAvg: load, NumLoadSamples: 10})
+	}
+	dayStats := []StatsDisplayRecord{{Location: "VT", DateTime: day.Unix(), DT: day.Format("2006-01-02"), LowLoad: 90}}
+
+	recs := dailyBaseload(dayStats, fiveMin, 0.2)
+	if len(recs) != 1 {
+		t.Fatalf("got %d records, want 1", len(recs))
+	}
+	if recs[0].Baseload != 200 || recs[0].BaseloadDT != "03:00" {
+		t.Errorf("unexpected baseload: %+v", recs[0])
+	}
+	if recs[0].AnnualKWh != 1752 || math.Abs(recs[0].AnnualCost-350.4) > 1e-9 {
+		t.Errorf("unexpected annualized values: %+v", recs[0])
+	}
+}
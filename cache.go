@@ -0,0 +1,284 @@
+package main
+
+import (
+	"container/list"
+	"database/sql"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// rollupCacheSettle is how long after a chunk of rollups ends that it's taken as final, so
+// samples that arrive a little late still get rolled up into it before it's cached.
+const rollupCacheSettle = time.Hour
+
+// cacheKey is a chunk of a rollup table: a local day of five minute rollups or a local month
+// of daily ones. Chunk 0 holds the table's first bucket for the location.
+type cacheKey struct {
+	table    string
+	location string
+	chunk    int64
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	recs interface{} // []StatsDisplayRecord or []BatteryPctDisplayRecord, oldest first
+}
+
+// CacheStats are the rollup cache's size and counters, which count chunks.
+type CacheStats struct {
+	Size          int    `json:"size"` // the most chunks kept, 0 when the cache is off
+	Entries       int    `json:"entries"`
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Evictions     uint64 `json:"evictions"`
+	Invalidations uint64 `json:"invalidations"`
+	Version       uint64 `json:"version"` // bumped whenever rollups are rebuilt or the cache is emptied
+}
+
+// rollupCache keeps closed chunks of the rollup tables in memory, evicting the least recently
+// used past its size. Rollups are rebuilt through saveStats and savePercent, which invalidate
+// what they replace; rebuilds by another process need a SIGHUP, which empties it.
+type rollupCache struct {
+	mu       sync.Mutex
+	entries  map[cacheKey]*list.Element
+	lru      *list.List
+	first    map[cacheKey]int64
+	stats    CacheStats
+	modified time.Time // when Version last changed
+
+	firstBucket func(table string, location string) (sql.NullInt64, error)
+}
+
+var rollupsCache = newRollupCache(0)
+
+func newRollupCache(size int) *rollupCache {
+	c := &rollupCache{firstBucket: getFirstBucket}
+	c.reset(size)
+	return c
+}
+
+// reset empties the cache and sets its size, keeping the counters.
+func (c *rollupCache) reset(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries, c.lru, c.first = make(map[cacheKey]*list.Element), list.New(), make(map[cacheKey]int64)
+	c.stats.Size, c.stats.Entries = size, 0
+	c.stats.Version++
+	c.modified = time.Now()
+}
+
+func (c *rollupCache) enabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats.Size > 0
+}
+
+func (c *rollupCache) get(key cacheKey) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).recs, true
+}
+
+// put caches the chunk read at version, unless the rollups have been rebuilt since, when it
+// may be older than what's in the table now.
+func (c *rollupCache) put(key cacheKey, recs interface{}, version uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stats.Size <= 0 || c.stats.Version != version {
+		return
+	}
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*cacheEntry).recs = recs
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, recs: recs})
+	for c.lru.Len() > c.stats.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+	c.stats.Entries = c.lru.Len()
+}
+
+// invalidate drops the chunk holding the table's bucket at dt.
+func (c *rollupCache) invalidate(table string, location string, dt int64) {
+	chunk, _ := cacheChunk(table, location, dt)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Version++
+	c.modified = time.Now()
+	if e, ok := c.entries[cacheKey{table, location, chunk}]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, cacheKey{table, location, chunk})
+		c.stats.Invalidations++
+		c.stats.Entries = c.lru.Len()
+	}
+	if first, ok := c.first[cacheKey{table, location, 0}]; ok && dt < first {
+		delete(c.first, cacheKey{table, location, 0})
+	}
+}
+
+// earliest is the table's first bucket for the location; ok is false when it has none.
+func (c *rollupCache) earliest(table string, location string) (int64, bool, error) {
+	key := cacheKey{table, location, 0}
+	c.mu.Lock()
+	first, ok := c.first[key]
+	c.mu.Unlock()
+	if ok {
+		return first, true, nil
+	}
+	dt, err := c.firstBucket(table, location)
+	if err != nil || !dt.Valid {
+		return 0, false, err
+	}
+	c.mu.Lock()
+	c.first[key] = dt.Int64
+	c.mu.Unlock()
+	return dt.Int64, true, nil
+}
+
+// Stats is a snapshot of the cache's size and counters.
+func (c *rollupCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Version is the rollup version and when it last changed.
+func (c *rollupCache) Version() (uint64, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats.Version, c.modified
+}
+
+// cacheChunk is the start and end of the chunk of table holding the bucket at dt.
+func cacheChunk(table string, location string, dt int64) (int64, int64) {
+	day := dayStart(localTime(location, dt))
+	if strings.HasPrefix(table, "day_") {
+		month := day.AddDate(0, 0, 1-day.Day())
+		return month.Unix(), month.AddDate(0, 1, 0).Unix()
+	}
+	return day.Unix(), day.AddDate(0, 0, 1).Unix()
+}
+
+// cachedRange is the table's rollups with begin <= datetime < end, oldest first. Chunks that
+// closed before now come from the cache, and query, which takes the same kind of range, fetches
+// the rest: each run of missing chunks whole, so they can be cached, and the open ones at the
+// end as asked.
+func cachedRange[T any](c *rollupCache, table string, location string, begin int64, end int64, now time.Time,
+	query func(begin int64, end int64) ([]T, error), dt func(T) int64) ([]T, error) {
+	if !c.enabled() {
+		return query(begin, end)
+	}
+	first, ok, err := c.earliest(table, location)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return query(begin, end)
+	}
+	if begin < first {
+		begin = first
+	}
+
+	out := make([]T, 0)
+	add := func(recs []T) {
+		for _, r := range recs {
+			if d := dt(r); d >= begin && d < end {
+				out = append(out, r)
+			}
+		}
+	}
+	closed := now.Add(-rollupCacheSettle).Unix()
+	var missing []int64 // the starts of the current run of missing chunks, and its end
+	fetch := func() error {
+		if len(missing) == 0 {
+			return nil
+		}
+		version, _ := c.Version()
+		recs, err := query(missing[0], missing[len(missing)-1])
+		if err != nil {
+			return err
+		}
+		i := 0
+		for m := 0; m < len(missing)-1; m++ {
+			j := i
+			for j < len(recs) && dt(recs[j]) < missing[m+1] {
+				j++
+			}
+			c.put(cacheKey{table, location, missing[m]}, recs[i:j:j], version)
+			i = j
+		}
+		add(recs)
+		missing = missing[:0]
+		return nil
+	}
+
+	for b := begin; b < end; {
+		chunk, next := cacheChunk(table, location, b)
+		if next > closed {
+			if err := fetch(); err != nil {
+				return nil, err
+			}
+			recs, err := query(b, end)
+			if err != nil {
+				return nil, err
+			}
+			add(recs)
+			return out, nil
+		}
+		if v, ok := c.get(cacheKey{table, location, chunk}); ok {
+			if err := fetch(); err != nil {
+				return nil, err
+			}
+			recs, _ := v.([]T)
+			add(recs)
+		} else if len(missing) == 0 {
+			missing = append(missing, chunk, next)
+		} else {
+			missing = append(missing, next)
+		}
+		b = next
+	}
+	if err := fetch(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func statsTime(r StatsDisplayRecord) int64 { return r.DateTime }
+
+func percentTime(r BatteryPctDisplayRecord) int64 { return r.DateTime }
+
+// getFirstBucket is the datetime of the location's first row in a rollup table.
+func getFirstBucket(table string, location string) (sql.NullInt64, error) {
+	var dt sql.NullInt64
+	err := db.QueryRow("select min(datetime) from "+table+" where location = ?", location).Scan(&dt)
+	if err != nil {
+		log.Error().Err(err).Msgf("getFirstBucket(%s, %s): %+v", table, location, err)
+	}
+	return dt, err
+}
+
+// cacheAPIHandler serves the cache's stats, which add up every location, to users who can
+// see all of them.
+func cacheAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if u := requestUser(r); u != nil && !u.all {
+		http.Error(w, "the cache stats cover every location", http.StatusForbidden)
+		return
+	}
+	writeJSON(w, rollupsCache.Stats())
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// fakeRollups is an hour of five minute stats every day from first up to now, with the
+// queries made of them.
+type fakeRollups struct {
+	recs    []StatsDisplayRecord
+	queries [][2]int64
+}
+
+func newFakeRollups(first time.Time, now time.Time) *fakeRollups {
+	f := &fakeRollups{}
+	for d := first; d.Before(now); d = d.AddDate(0, 0, 1) {
+		for m := 0; m < 60; m += 5 {
+			f.recs = append(f.recs, StatsDisplayRecord{Location: "T", DateTime: d.Add(time.Duration(12*60+m) * time.Minute).Unix()})
+		}
+	}
+	return f
+}
+
+func (f *fakeRollups) query(begin int64, end int64) ([]StatsDisplayRecord, error) {
+	f.queries = append(f.queries, [2]int64{begin, end})
+	out := make([]StatsDisplayRecord, 0)
+	for _, r := range f.recs {
+		if r.DateTime >= begin && r.DateTime < end {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+func testRollupCache(size int, first time.Time) *rollupCache {
+	c := newRollupCache(size)
+	c.firstBucket = func(string, string) (sql.NullInt64, error) {
+		return sql.NullInt64{Int64: first.Unix(), Valid: true}, nil
+	}
+	return c
+}
+
+func TestCachedRange(t *testing.T) {
+	registry.set([]LocationInfo{{ID: "T", TimeLocation: time.UTC}})
+	defer registry.set(nil)
+	first := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	now := time.Date(2024, 3, 10, 12, 30, 0, 0, time.UTC)
+	f := newFakeRollups(first, now)
+	c := testRollupCache(100, first)
+
+	// from before the first rollup to now: the closed days in one query, then today
+	got, err := cachedRange(c, "five_min_top_stats", "T", 0, now.Unix(), now, f.query, statsTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 9*12+6 || len(f.queries) != 2 {
+		t.Fatalf("got %d records from queries %v", len(got), f.queries)
+	}
+	if q := f.queries[0]; q[0] != first.Unix() || q[1] != first.AddDate(0, 0, 9).Unix() {
+		t.Errorf("closed days query = %v", q)
+	}
+
+	// again, and only today is queried
+	f.queries = nil
+	begin := first.AddDate(0, 0, 2).Add(12*time.Hour + 30*time.Minute)
+	got, err = cachedRange(c, "five_min_top_stats", "T", begin.Unix(), now.Unix(), now, f.query, statsTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 6+6*12+6 || got[0].DateTime != begin.Unix() || len(f.queries) != 1 {
+		t.Fatalf("got %d records from %d from queries %v", len(got), got[0].DateTime, f.queries)
+	}
+	if s := c.Stats(); s.Hits != 7 || s.Misses != 9 || s.Entries != 9 {
+		t.Errorf("stats = %+v", s)
+	}
+
+	// a rebuilt day is queried again
+	c.invalidate("five_min_top_stats", "T", first.AddDate(0, 0, 4).Add(time.Hour).Unix())
+	f.queries = nil
+	if _, err := cachedRange(c, "five_min_top_stats", "T", first.Unix(), now.Unix(), now, f.query, statsTime); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.queries) != 2 || f.queries[0] != [2]int64{first.AddDate(0, 0, 4).Unix(), first.AddDate(0, 0, 5).Unix()} {
+		t.Errorf("queries after invalidating = %v", f.queries)
+	}
+	if s := c.Stats(); s.Invalidations != 1 {
+		t.Errorf("stats = %+v", s)
+	}
+}
+
+func TestCachedRangeRebuiltWhileQuerying(t *testing.T) {
+	registry.set([]LocationInfo{{ID: "T", TimeLocation: time.UTC}})
+	defer registry.set(nil)
+	first := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	now := time.Date(2024, 3, 10, 12, 30, 0, 0, time.UTC)
+	f := newFakeRollups(first, now)
+	c := testRollupCache(100, first)
+
+	// a rebuild lands between the query reading the old rows and them being cached
+	query := func(begin int64, end int64) ([]StatsDisplayRecord, error) {
+		recs, err := f.query(begin, end)
+		c.invalidate("five_min_top_stats", "T", first.Add(time.Hour).Unix())
+		return recs, err
+	}
+	if _, err := cachedRange(c, "five_min_top_stats", "T", first.Unix(), first.AddDate(0, 0, 3).Unix(), now, query, statsTime); err != nil {
+		t.Fatal(err)
+	}
+	if s := c.Stats(); s.Entries != 0 {
+		t.Errorf("cached rows read before a rebuild: %+v", s)
+	}
+}
+
+func TestRollupCacheEvicts(t *testing.T) {
+	registry.set([]LocationInfo{{ID: "T", TimeLocation: time.UTC}})
+	defer registry.set(nil)
+	first := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	now := time.Date(2024, 3, 10, 12, 30, 0, 0, time.UTC)
+	f := newFakeRollups(first, now)
+
+	c := testRollupCache(3, first)
+	got, err := cachedRange(c, "five_min_top_stats", "T", first.Unix(), now.Unix(), now, f.query, statsTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := c.Stats(); len(got) != 9*12+6 || s.Entries != 3 || s.Evictions != 6 {
+		t.Errorf("got %d records, stats %+v", len(got), s)
+	}
+
+	// size 0 turns it off
+	c = testRollupCache(0, first)
+	f.queries = nil
+	if got, _ := cachedRange(c, "five_min_top_stats", "T", first.Unix(), now.Unix(), now, f.query, statsTime); len(got) != 9*12+6 || len(f.queries) != 1 {
+		t.Errorf("got %d records from queries %v", len(got), f.queries)
+	}
+}
+
+func TestCacheChunk(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	registry.set([]LocationInfo{{ID: "VT", TimeLocation: ny}})
+	defer registry.set(nil)
+	dt := time.Date(2024, 3, 10, 12, 0, 0, 0, ny).Unix()
+	if b, e := cacheChunk("five_min_top_stats", "VT", dt); b != time.Date(2024, 3, 10, 0, 0, 0, 0, ny).Unix() || e-b != 23*3600 {
+		t.Errorf("day chunk %d to %d", b, e)
+	}
+	if b, e := cacheChunk("day_top_stats", "VT", dt); b != time.Date(2024, 3, 1, 0, 0, 0, 0, ny).Unix() || e != time.Date(2024, 4, 1, 0, 0, 0, 0, ny).Unix() {
+		t.Errorf("month chunk %d to %d", b, e)
+	}
+}
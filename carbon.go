@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// whPerKWh converts the rollup energy columns (Wh) to kWh.
+const whPerKWh = 1000
+
+var currentCarbonProfile atomic.Pointer[CarbonProfile]
+
+// carbonProfile is the grid intensity profile loaded from CARBON_PROFILE, nil when carbon accounting is off.
+func carbonProfile() *CarbonProfile {
+	return currentCarbonProfile.Load()
+}
+
+// CarbonProfile is the grid carbon intensity in g CO2/kWh by month and hour of day.
+type CarbonProfile struct {
+	Intensity [12][24]float64
+}
+
+var seasons = map[string][]int{
+	"winter": {12, 1, 2},
+	"spring": {3, 4, 5},
+	"summer": {6, 7, 8},
+	"fall":   {9, 10, 11},
+	"autumn": {9, 10, 11},
+}
+
+func profileMonths(s string) ([]int, bool, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" || s == "*" {
+		return []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}, false, nil
+	}
+	if months, ok := seasons[s]; ok {
+		return months, true, nil
+	}
+	m, err := strconv.Atoi(s)
+	if err != nil || m < 1 || m > 12 {
+		return nil, false, fmt.Errorf("bad month %q", s)
+	}
+	return []int{m}, true, nil
+}
+
+func profileHours(s string) ([]int, bool, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "*" {
+		hours := make([]int, 24)
+		for h := range hours {
+			hours[h] = h
+		}
+		return hours, false, nil
+	}
+	h, err := strconv.Atoi(s)
+	if err != nil || h < 0 || h > 23 {
+		return nil, false, fmt.Errorf("bad hour %q", s)
+	}
+	return []int{h}, true, nil
+}
+
+// parseCarbonProfile reads month,hour,intensity rows. month may be 1-12 or a season and either
+// column may be blank or * to match everything. More specific rows override less specific ones.
+func parseCarbonProfile(in io.Reader) (*CarbonProfile, error) {
+	r := csv.NewReader(in)
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) < 2 {
+		return nil, fmt.Errorf("carbon profile has no rows")
+	}
+	type entry struct {
+		months, hours []int
+		specificity   int
+		intensity     float64
+	}
+	entries := make([]entry, 0, len(rows)-1)
+	for i, row := range rows[1:] {
+		if len(row) != 3 {
+			return nil, fmt.Errorf("line %d: want month,hour,intensity", i+2)
+		}
+		var e entry
+		var monthSpecific, hourSpecific bool
+		if e.months, monthSpecific, err = profileMonths(row[0]); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+2, err)
+		}
+		if e.hours, hourSpecific, err = profileHours(row[1]); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+2, err)
+		}
+		if e.intensity, err = strconv.ParseFloat(strings.TrimSpace(row[2]), 64); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+2, err)
+		}
+		if monthSpecific {
+			e.specificity++
+		}
+		if hourSpecific {
+			e.specificity += 2
+		}
+		entries = append(entries, e)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].specificity < entries[j].specificity })
+
+	p := &CarbonProfile{}
+	for _, e := range entries {
+		for _, m := range e.months {
+			for _, h := range e.hours {
+				p.Intensity[m-1][h] = e.intensity
+			}
+		}
+	}
+	return p, nil
+}
+
+func loadCarbonProfile(path string) (*CarbonProfile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseCarbonProfile(f)
+}
+
+// initCarbonProfile loads CARBON_PROFILE if it is set.
+func initCarbonProfile() {
+	path := config().CarbonProfile
+	if path == "" {
+		log.Info().Msg("no carbon_profile - carbon accounting disabled")
+		currentCarbonProfile.Store(nil)
+		carbonMonths.reset()
+		return
+	}
+	p, err := loadCarbonProfile(path)
+	if err != nil {
+		log.Error().Err(err).Msgf("loading carbon profile %s", path)
+		return
+	}
+	currentCarbonProfile.Store(p)
+	carbonMonths.reset()
+	log.Info().Msgf("loaded carbon profile %s", path)
+}
+
+// at returns the intensity in g CO2/kWh for the hour containing t.
+func (p *CarbonProfile) at(t time.Time) float64 {
+	return p.Intensity[t.Month()-1][t.Hour()]
+}
+
+// HourlyEnergy is an hour of grid and solar energy in Wh.
+type HourlyEnergy struct {
+	DateTime      int64
+	GridImported  float64
+	GridExported  float64
+	SolarProduced float64
+}
+
+// CarbonTotals is the kg CO2 for a day, month or lifetime.
+type CarbonTotals struct {
+	Period          string  `json:"period"`
+	GridKg          float64 `json:"gridKg"`
+	AvoidedSelfKg   float64 `json:"avoidedSelfKg"`
+	AvoidedExportKg float64 `json:"avoidedExportKg"`
+	NetKg           float64 `json:"netKg"`
+}
+
+// CarbonReport is the carbon accounting for a location.
+type CarbonReport struct {
+	Location string         `json:"location"`
+	Daily    []CarbonTotals `json:"daily"`
+	Monthly  []CarbonTotals `json:"monthly"`
+	Lifetime CarbonTotals   `json:"lifetime"`
+}
+
+// getHourlyEnergy sums the five minute grid and solar energy into hours.
+func getHourlyEnergy(location string, beginDate int64, endDate int64) ([]HourlyEnergy, error) {
+	log.Debug().Msgf("getHourlyEnergy(%s, %d, %d)", location, beginDate, endDate)
+	dbConnect()
+	rows, err := db.Query(`select datetime div 3600 * 3600 hr, sum(site_energy_imported), sum(site_energy_exported), sum(solar_energy_exported)
+			from five_min_top_stats where location = ? and datetime >= ? and datetime <= ? group by hr order by hr`,
+		location, beginDate, endDate)
+	if err != nil {
+		log.Error().Err(err).Msgf("getHourlyEnergy(): %+v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	recs := make([]HourlyEnergy, 0)
+	for rows.Next() {
+		var h HourlyEnergy
+		if err := rows.Scan(&h.DateTime, &h.GridImported, &h.GridExported, &h.SolarProduced); err != nil {
+			log.Error().Err(err).Msgf("getHourlyEnergy(): %+v", err)
+			return recs, err
+		}
+		recs = append(recs, h)
+	}
+	return recs, rows.Err()
+}
+
+// carbonByPeriod totals emissions per period, where layout formats an hour in tz into its period (e.g. "2006-01"
+// for months). An empty layout totals everything into one period.
+func carbonByPeriod(hourly []HourlyEnergy, p *CarbonProfile, tz *time.Location, layout string) []CarbonTotals {
+	totals := make([]CarbonTotals, 0)
+	for _, h := range hourly {
+		t := time.Unix(h.DateTime, 0).In(tz)
+		period := t.Format(layout)
+		if layout == "" {
+			period = "lifetime"
+		}
+		if len(totals) == 0 || totals[len(totals)-1].Period != period {
+			totals = append(totals, CarbonTotals{Period: period})
+		}
+		c := &totals[len(totals)-1]
+		kgPerWh := p.at(t) / 1000 / whPerKWh
+		selfConsumed := h.SolarProduced - h.GridExported
+		if selfConsumed < 0 {
+			selfConsumed = 0
+		}
+		c.GridKg += h.GridImported * kgPerWh
+		c.AvoidedSelfKg += selfConsumed * kgPerWh
+		c.AvoidedExportKg += h.GridExported * kgPerWh
+		c.NetKg = c.GridKg - c.AvoidedSelfKg - c.AvoidedExportKg
+	}
+	return totals
+}
+
+// carbonMonthCache keeps the carbon totals of closed months, so the monthly and lifetime
+// totals don't rescan all the five minute history on every request. Months are dropped when
+// saveStats rewrites their rollups; rebuilds by another process need a SIGHUP, which empties it.
+type carbonMonthCache struct {
+	mu      sync.Mutex
+	profile *CarbonProfile
+	months  map[string]map[string]CarbonTotals // by location then month, with an empty Period for months without data
+}
+
+var carbonMonths = &carbonMonthCache{}
+
+func (c *carbonMonthCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.profile, c.months = nil, nil
+}
+
+// invalidate drops the month holding dt.
+func (c *carbonMonthCache) invalidate(location string, dt int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.months[location], localTime(location, dt).Format("2006-01"))
+}
+
+// closedMonths is the location's monthly totals with profile p from the month holding first
+// to the month starting at before. Months that aren't cached come from hourly, which takes
+// the first and last second to sum, in one call.
+func (c *carbonMonthCache) closedMonths(location string, p *CarbonProfile, first time.Time, before time.Time,
+	hourly func(begin int64, end int64) ([]HourlyEnergy, error)) ([]CarbonTotals, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.profile != p {
+		c.profile, c.months = p, nil
+	}
+	if c.months == nil {
+		c.months = make(map[string]map[string]CarbonTotals)
+	}
+	cached := c.months[location]
+	if cached == nil {
+		cached = make(map[string]CarbonTotals)
+		c.months[location] = cached
+	}
+
+	var months []time.Time
+	var missing time.Time
+	for m := dayStart(first.AddDate(0, 0, 1-first.Day())); m.Before(before); m = dayStart(m.AddDate(0, 1, 0)) {
+		months = append(months, m)
+		if _, ok := cached[m.Format("2006-01")]; !ok && missing.IsZero() {
+			missing = m
+		}
+	}
+	if !missing.IsZero() {
+		recs, err := hourly(missing.Unix(), before.Unix()-1)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range months {
+			if !m.Before(missing) {
+				cached[m.Format("2006-01")] = CarbonTotals{}
+			}
+		}
+		for _, t := range carbonByPeriod(recs, p, before.Location(), "2006-01") {
+			cached[t.Period] = t
+		}
+	}
+
+	totals := make([]CarbonTotals, 0, len(months))
+	for _, m := range months {
+		if t := cached[m.Format("2006-01")]; t.Period != "" {
+			totals = append(totals, t)
+		}
+	}
+	return totals, nil
+}
+
+// carbonReport is the location's carbon accounting with profile p: the days from beginDate and
+// the months and lifetime up to endDate.
+func carbonReport(location string, p *CarbonProfile, beginDate int64, endDate int64) (CarbonReport, error) {
+	report := CarbonReport{Location: location}
+	tz := locationTZ(location)
+	dbConnect()
+	firstBucket, err := getFirstBucket("five_min_top_stats", location)
+	if err != nil || !firstBucket.Valid {
+		return report, err
+	}
+
+	// months before the one holding endDate, or now if that's sooner, are closed
+	last := time.Unix(endDate-1, 0)
+	if now := time.Now(); last.After(now) {
+		last = now
+	}
+	last = last.In(tz)
+	open := dayStart(last.AddDate(0, 0, 1-last.Day()))
+	closed, err := carbonMonths.closedMonths(location, p, time.Unix(firstBucket.Int64, 0).In(tz), open,
+		func(begin int64, end int64) ([]HourlyEnergy, error) { return getHourlyEnergy(location, begin, end) })
+	if err != nil {
+		return report, err
+	}
+
+	from := open.Unix()
+	if beginDate < from {
+		from = beginDate
+	}
+	hourly, err := getHourlyEnergy(location, from, endDate-1)
+	if err != nil {
+		return report, err
+	}
+	current := sort.Search(len(hourly), func(i int) bool { return hourly[i].DateTime >= open.Unix() })
+	report.Monthly = append(closed, carbonByPeriod(hourly[current:], p, tz, "2006-01")...)
+	if len(report.Monthly) > 0 {
+		report.Lifetime.Period = "lifetime"
+	}
+	for _, m := range report.Monthly {
+		report.Lifetime.GridKg += m.GridKg
+		report.Lifetime.AvoidedSelfKg += m.AvoidedSelfKg
+		report.Lifetime.AvoidedExportKg += m.AvoidedExportKg
+		report.Lifetime.NetKg += m.NetKg
+	}
+
+	first := sort.Search(len(hourly), func(i int) bool { return hourly[i].DateTime >= beginDate })
+	report.Daily = carbonByPeriod(hourly[first:], p, tz, "2006-01-02")
+	return report, nil
+}
+
+// addDailyCarbon fills in the carbon columns of the daily stats rows.
+func addDailyCarbon(recs []StatsDisplayRecord, daily []CarbonTotals) {
+	byDay := make(map[string]CarbonTotals)
+	for _, c := range daily {
+		byDay[c.Period] = c
+	}
+	for i := range recs {
+		c := byDay[recs[i].DT]
+		recs[i].GridCO2 = c.GridKg
+		recs[i].AvoidedCO2 = c.AvoidedSelfKg + c.AvoidedExportKg
+	}
+}
+
+func carbonAPIHandler(w http.ResponseWriter, r *http.Request) {
+	p := carbonProfile()
+	if p == nil {
+		http.Error(w, "carbon accounting is not configured", http.StatusNotFound)
+		return
+	}
+	loc, ok := requestLocation(w, r)
+	if !ok {
+		return
+	}
+	location := loc.ID
+	days, err := daysParam(r, "days", config().GraphDays)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now().In(loc.TZ())
+	report, err := carbonReport(location, p, dayStart(now.AddDate(0, 0, -days)).Unix(), now.Unix()+1)
+	if err != nil {
+		s := fmt.Sprintf("%+v", err)
+		http.Error(w, s, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, report)
+}
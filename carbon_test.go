@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCarbonProfile(t *testing.T) {
+	in := `month,hour,intensity
+*,*,400
+summer,,300
+7,12,100
+# evening peak all year
+,18,600
+`
+	p, err := parseCarbonProfile(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("parseCarbonProfile: %v", err)
+	}
+	tests := []struct {
+		month time.Month
+		hour  int
+		want  float64
+	}{
+		{time.January, 3, 400},
+		{time.August, 3, 300},
+		{time.July, 12, 100},
+		{time.July, 18, 600},
+	}
+	for _, tc := range tests {
+		at := time.Date(2026, tc.month, 1, tc.hour, 30, 0, 0, time.Local)
+		if got := p.at(at); got != tc.want {
+			t.Errorf("%s %02d:30: got %.0f, want %.0f", tc.month, tc.hour, got, tc.want)
+		}
+	}
+
+	if _, err := parseCarbonProfile(strings.NewReader("month,hour,intensity\n13,,1\n")); err == nil {
+		t.Error("expected an error for month 13")
+	}
+}
+
+func TestCarbonByPeriod(t *testing.T) {
+	p := &CarbonProfile{}
+	for m := range p.Intensity {
+		for h := range p.Intensity[m] {
+			p.Intensity[m][h] = 500
+		}
+	}
+	day := time.Date(2026, 4, 30, 22, 0, 0, 0, time.Local)
+	hourly := []HourlyEnergy{
+		{DateTime: day.Unix(), GridImported: 2000},
+		{DateTime: day.Add(time.Hour).Unix(), GridImported: 0, GridExported: 1000, SolarProduced: 3000},
+		{DateTime: day.Add(2 * time.Hour).Unix(), GridImported: 1000},
+	}
+	months := carbonByPeriod(hourly, p, time.Local, "2006-01")
+	if len(months) != 2 {
+		t.Fatalf("got %d months, want 2", len(months))
+	}
+	april := months[0]
+	if april.GridKg != 1 || april.AvoidedSelfKg != 1 || april.AvoidedExportKg != 0.5 || math.Abs(april.NetKg+0.5) > 1e-9 {
+		t.Errorf("unexpected april totals: %+v", april)
+	}
+	lifetime := carbonByPeriod(hourly, p, time.Local, "")
+	if len(lifetime) != 1 || lifetime[0].GridKg != 1.5 {
+		t.Errorf("unexpected lifetime totals: %+v", lifetime)
+	}
+}
+
+func TestCarbonMonthCache(t *testing.T) {
+	tz := locationTZ("T")
+	p := &CarbonProfile{}
+	var hourly []HourlyEnergy
+	for _, m := range []time.Month{1, 3, 4} {
+		hourly = append(hourly, HourlyEnergy{DateTime: time.Date(2026, m, 10, 12, 0, 0, 0, tz).Unix(), GridImported: 1000})
+	}
+	var calls [][2]int64
+	query := func(begin int64, end int64) ([]HourlyEnergy, error) {
+		calls = append(calls, [2]int64{begin, end})
+		out := make([]HourlyEnergy, 0)
+		for _, h := range hourly {
+			if h.DateTime >= begin && h.DateTime <= end {
+				out = append(out, h)
+			}
+		}
+		return out, nil
+	}
+	c := &carbonMonthCache{}
+	first, before := time.Date(2026, 1, 15, 8, 0, 0, 0, tz), time.Date(2026, 5, 1, 0, 0, 0, 0, tz)
+	months := func() string {
+		t.Helper()
+		totals, err := c.closedMonths("T", p, first, before, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var periods []string
+		for _, m := range totals {
+			periods = append(periods, m.Period)
+		}
+		return strings.Join(periods, " ")
+	}
+
+	if got := months(); got != "2026-01 2026-03 2026-04" || len(calls) != 1 || calls[0] != [2]int64{time.Date(2026, 1, 1, 0, 0, 0, 0, tz).Unix(), before.Unix() - 1} {
+		t.Fatalf("got %q with queries %v", got, calls)
+	}
+	if got := months(); got != "2026-01 2026-03 2026-04" || len(calls) != 1 {
+		t.Errorf("cached got %q with queries %v", got, calls)
+	}
+	c.invalidate("T", hourly[1].DateTime)
+	if got := months(); got != "2026-01 2026-03 2026-04" || len(calls) != 2 || calls[1][0] != time.Date(2026, 3, 1, 0, 0, 0, 0, tz).Unix() {
+		t.Errorf("after invalidating March got %q with queries %v", got, calls)
+	}
+	p = &CarbonProfile{}
+	if months(); len(calls) != 3 || calls[2][0] != calls[0][0] {
+		t.Errorf("a new profile queried %v", calls)
+	}
+}
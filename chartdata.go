@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// chartTier is one resolution of the dashboard charts: the spacing of its points and the
+// longest range it's used for, which keeps a chart to about a thousand points.
+type chartTier struct {
+	Name    string
+	Step    time.Duration
+	MaxSpan time.Duration // 0 for any range
+}
+
+var chartTiers = []chartTier{
+	{"five-min", 5 * time.Minute, 3 * 24 * time.Hour},
+	{"hour", time.Hour, 45 * 24 * time.Hour},
+	{"day", 24 * time.Hour, 0},
+}
+
+// tierFor is the finest tier for a range of span.
+func tierFor(span time.Duration) chartTier {
+	for _, t := range chartTiers {
+		if t.MaxSpan == 0 || span <= t.MaxSpan {
+			return t
+		}
+	}
+	return chartTiers[len(chartTiers)-1]
+}
+
+// gaps is g for the tier's points, which are at least a step apart, so only a missing point
+// is a gap.
+func (t chartTier) gaps(g chartGaps) chartGaps {
+	if step := int64(t.Step/time.Millisecond) * 3 / 2; g.Gap > 0 && g.Gap < step {
+		g.Gap = step
+	}
+	return g
+}
+
+// ChartData is the dashboard chart series for a range, from the tier that suits its length.
+type ChartData struct {
+	Location        string       `json:"location"`
+	Tier            string       `json:"tier"`
+	From            int64        `json:"from"` // ms
+	To              int64        `json:"to"`
+	Solar           []chartPoint `json:"solar"`
+	Load            []chartPoint `json:"load"`
+	Grid            []chartPoint `json:"grid"`
+	Battery         []chartPoint `json:"battery"`
+	Zones           []chartZone  `json:"zones"`
+	BatteryPct      []chartPoint `json:"batteryPct"`
+	BatteryPctZones []chartZone  `json:"batteryPctZones"`
+}
+
+// hourlyStats merges five minute stats into local hours.
+func hourlyStats(location string, recs []StatsDisplayRecord) []StatsDisplayRecord {
+	hours := mergeStats(location, recs, hourBucket(location))
+	for i := range hours {
+		h := &hours[i]
+		h.SiteAvg = h.TotalSiteSamples / float64(h.NumSiteSamples)
+		h.LoadAvg = h.TotalLoadSamples / float64(h.NumLoadSamples)
+		h.BatteryAvg = h.TotalBatterySamples / float64(h.NumBatterySamples)
+		h.SolarAvg = h.TotalSolarSamples / float64(h.NumSolarSamples)
+	}
+	return hours
+}
+
+// hourlyPercent merges five minute battery charge into local hours.
+func hourlyPercent(location string, recs []BatteryPctDisplayRecord) []BatteryPctDisplayRecord {
+	hours := mergePercent(location, recs, hourBucket(location))
+	for i := range hours {
+		hours[i].AvgPct = hours[i].TotalSamples / float64(hours[i].NumSamples)
+	}
+	return hours
+}
+
+// chartData queries the tier of rollups for the range from begin up to end. Day ranges are
+// widened to whole local days.
+func chartData(loc LocationInfo, begin time.Time, end time.Time, g chartGaps) (ChartData, error) {
+	log.Debug().Msgf("chartData(%s, %s, %s)", loc.ID, begin, end)
+	dbConnect()
+	tier := tierFor(end.Sub(begin))
+	var stats []StatsDisplayRecord
+	var pct []BatteryPctDisplayRecord
+	var err error
+	if tier.Name == "day" {
+		begin, end = dayStart(begin.In(loc.TZ())), dayStart(end.In(loc.TZ()).Add(-time.Second)).AddDate(0, 0, 1)
+		if stats, err = getDayStatsRange(loc.ID, begin.Unix(), end.Unix()); err != nil {
+			return ChartData{}, err
+		}
+		if pct, err = getDayBatteryPctRange(loc.ID, begin.Unix(), end.Unix()); err != nil {
+			return ChartData{}, err
+		}
+	} else {
+		if stats, err = getFiveMinStats(loc.ID, begin.Unix(), end.Unix()-1); err != nil {
+			return ChartData{}, err
+		}
+		if pct, err = getFiveMinBattery(loc.ID, begin.Unix(), end.Unix()-1); err != nil {
+			return ChartData{}, err
+		}
+		if tier.Name == "hour" {
+			stats, pct = hourlyStats(loc.ID, stats), hourlyPercent(loc.ID, pct)
+		}
+	}
+
+	data := ChartData{Location: loc.ID, Tier: tier.Name, From: begin.UnixMilli(), To: end.UnixMilli()}
+	data.Solar, data.Load, data.Grid, data.Battery, data.Zones = statsChartData(stats, tier.gaps(g))
+	data.BatteryPct, data.BatteryPctZones = batteryChartData(pct, tier.gaps(g))
+	return data, nil
+}
+
+// maxChartMs is the end of 9999, the last time a chart can ask for.
+const maxChartMs = 253402300799999
+
+// msParam is the named query parameter, ms since the epoch, as a time.
+func msParam(r *http.Request, name string) (time.Time, error) {
+	v := r.URL.Query().Get(name)
+	ms, err := strconv.ParseFloat(v, 64) // Highcharts extremes aren't always whole
+	if err != nil || math.IsNaN(ms) || ms < 0 || ms > maxChartMs {
+		return time.Time{}, fmt.Errorf("%s: %q is not a time in ms", name, v)
+	}
+	return time.UnixMilli(int64(ms)), nil
+}
+
+// chartAPIHandler serves the dashboard charts' data for the from and to params, in ms, which
+// the charts fetch as the navigator zooms. Ranges beyond the budgets are cut to their end.
+func chartAPIHandler(w http.ResponseWriter, r *http.Request) {
+	loc, ok := requestLocation(w, r)
+	if !ok {
+		return
+	}
+	begin, err := msParam(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	end, err := msParam(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !begin.Before(end) {
+		http.Error(w, "the range ends before it begins", http.StatusBadRequest)
+		return
+	}
+	data, err := chartData(loc, chartBudget(begin, end), end, requestChartGaps(r))
+	if err != nil {
+		s := fmt.Sprintf("%+v", err)
+		http.Error(w, s, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, data)
+}
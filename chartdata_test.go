@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTierFor(t *testing.T) {
+	for _, c := range []struct {
+		span time.Duration
+		want string
+	}{
+		{3 * time.Hour, "five-min"},
+		{3 * 24 * time.Hour, "five-min"},
+		{7 * 24 * time.Hour, "hour"},
+		{45 * 24 * time.Hour, "hour"},
+		{60 * 24 * time.Hour, "day"},
+		{10 * 365 * 24 * time.Hour, "day"},
+	} {
+		if got := tierFor(c.span); got.Name != c.want {
+			t.Errorf("tierFor(%s) = %s, want %s", c.span, got.Name, c.want)
+		}
+	}
+}
+
+func TestChartTierGaps(t *testing.T) {
+	g := chartGaps{Gap: 15 * 60000}
+	if got := tierFor(time.Hour).gaps(g); got != g {
+		t.Errorf("five minute gaps = %+v, want %+v", got, g)
+	}
+	if got := tierFor(30 * 24 * time.Hour).gaps(g); got.Gap != 90*60000 {
+		t.Errorf("hourly gap = %d, want 90 minutes", got.Gap)
+	}
+	if got := tierFor(90 * 24 * time.Hour).gaps(chartGaps{}); got.Gap != 0 {
+		t.Errorf("gap 0 should stay 0, got %d", got.Gap)
+	}
+}
+
+func TestHourlyStats(t *testing.T) {
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Skip(err)
+	}
+	registry.set([]LocationInfo{{ID: "IN", TimeLocation: kolkata}})
+	defer registry.set(nil)
+
+	// 10:00 to 11:55 local, five minutes apart
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, kolkata).Unix()
+	recs := make([]StatsDisplayRecord, 0)
+	for i := int64(0); i < 24; i++ {
+		var m [4]meterStats
+		m[meterSolar].add(start+i*300, float64(1000*(i/12+1)))
+		m[meterLoad].add(start+i*300, 500)
+		recs = append(recs, statsRecord("IN", start+i*300, m))
+	}
+	hours := hourlyStats("IN", recs)
+	if len(hours) != 2 || hours[0].DateTime != start || hours[1].DateTime != start+3600 {
+		t.Fatalf("got %d hours %+v", len(hours), hours)
+	}
+	if hours[0].SolarAvg != 1000 || hours[1].SolarAvg != 2000 || hours[0].LoadAvg != 500 {
+		t.Errorf("averages %g %g %g", hours[0].SolarAvg, hours[1].SolarAvg, hours[0].LoadAvg)
+	}
+	// no battery samples is a gap, which the chart data breaks the line at
+	if !math.IsNaN(hours[0].BatteryAvg) {
+		t.Errorf("battery average = %g, want NaN", hours[0].BatteryAvg)
+	}
+	_, _, _, batt, _ := statsChartData(hours, chartGaps{})
+	if b, err := json.Marshal(batt); err != nil || string(b) != fmt.Sprintf("[[%d,null],[%d,null]]", start*1000, (start+3600)*1000) {
+		t.Errorf("battery series = %s, %v", b, err)
+	}
+}
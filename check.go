@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	staleAfter     = time.Hour     // no energy samples for this long means the collector is down
+	rollupLagAfter = 2 * time.Hour // five minute rollups this far behind the raw data need a rollup run
+)
+
+// latestUnix returns the largest value of expr in table for location, or ok false if there are no rows.
+func latestUnix(table string, expr string, location string) (int64, bool, error) {
+	var latest sql.NullFloat64
+	err := db.QueryRow("select max("+expr+") from "+table+" where location = ?", location).Scan(&latest)
+	if err != nil {
+		log.Error().Err(err).Msgf("latestUnix(%s, %s)", table, location)
+		return 0, false, err
+	}
+	return int64(latest.Float64), latest.Valid, nil
+}
+
+// checkIntegrity verifies that every table exists, that each location's collector and rollups
+// are keeping up, and that the last qualityDays days pass the data-quality scan, returning a
+// description of each problem found.
+func checkIntegrity(now time.Time, qualityDays int) ([]string, error) {
+	dbConnect()
+	var problems []string
+	for _, m := range migrations {
+		if _, err := db.Exec("select 1 from " + m.table + " limit 1"); err != nil {
+			problems = append(problems, fmt.Sprintf("table %s: %v (run migrate)", m.table, err))
+		}
+	}
+	if len(problems) > 0 {
+		return problems, nil
+	}
+
+	for _, loc := range registry.list() {
+		raw, ok, err := latestUnix("energy", "unix_timestamp(dt)", loc.ID)
+		if err != nil {
+			return problems, err
+		}
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: no energy samples", loc.ID))
+			continue
+		}
+		if age := now.Sub(time.Unix(raw, 0)); age > staleAfter {
+			problems = append(problems, fmt.Sprintf("%s: last energy sample %s ago", loc.ID, age.Round(time.Minute)))
+		}
+		fiveMin, ok, err := latestUnix("five_min_top_stats", "datetime", loc.ID)
+		if err != nil {
+			return problems, err
+		}
+		if !ok || time.Unix(raw, 0).Sub(time.Unix(fiveMin, 0)) > rollupLagAfter {
+			problems = append(problems, fmt.Sprintf("%s: five minute rollups end at %s, raw data at %s",
+				loc.ID, localTime(loc.ID, fiveMin).Format("2006-01-02 15:04"), localTime(loc.ID, raw).Format("2006-01-02 15:04")))
+		}
+		yesterday := dayStart(now.In(loc.TZ()).AddDate(0, 0, -1)).Unix()
+		day, ok, err := latestUnix("day_top_stats", "datetime", loc.ID)
+		if err != nil {
+			return problems, err
+		}
+		if !ok || day < yesterday {
+			problems = append(problems, fmt.Sprintf("%s: no daily rollup for %s", loc.ID, localTime(loc.ID, yesterday).Format("2006-01-02")))
+		}
+		if qualityDays <= 0 {
+			continue
+		}
+		begin, end := qualityPeriod(loc, qualityDays, now)
+		report, err := qualityReport(loc, begin, end)
+		if err != nil {
+			return problems, err
+		}
+		for i, issue := range report.Issues {
+			if i == qualityIssuesShown {
+				problems = append(problems, fmt.Sprintf("%s: %d more data-quality issues, see /quality?location=%s&days=%d",
+					loc.ID, len(report.Issues)-i, loc.ID, qualityDays))
+				break
+			}
+			problems = append(problems, fmt.Sprintf("%s: %s", loc.ID, issue))
+		}
+	}
+	return problems, nil
+}
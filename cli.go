@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// command is a subcommand of the binary.
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string) error
+}
+
+// commands is in the order the usage lists them. It is filled in by init to avoid an
+// initialization cycle with usage.
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "", "serve the dashboard and APIs (the default)", serveCommand},
+		{"ingest", "[file]", "store collector messages from MQTT, or aggregates JSON lines from a file (- for stdin)", ingestCommand},
+		{"migrate", "", "create any missing tables", migrateCommand},
+		{"rollup", "", "rebuild the five minute and daily rollups from the raw samples", rollupCommand},
+		{"import", "weather|tesla|pypowerwall file...", "import weather files, or Tesla app or pypowerwall energy history CSVs", importCommand},
+		{"export", "", "write a location's rollups as CSV or JSON", exportCommand},
+		{"report", "", "print a location's totals for a period", reportCommand},
+		{"check", "", "verify the tables, collector, rollups and data quality, exiting 1 on problems", checkCommand},
+		{"simulate", "", "generate synthetic Powerwall data for a virtual home", simulateCommand},
+		{"passwd", "", "print the password_hash of a password read from stdin, for auth.users", passwdCommand},
+	}
+}
+
+// errUsage means the command line was wrong and the usage has already been printed.
+var errUsage = errors.New("usage")
+
+// errCheckFailed means check found problems it has already reported.
+var errCheckFailed = errors.New("check failed")
+
+var cliOutput io.Writer = os.Stdout
+
+var cliInput io.Reader = os.Stdin
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags] [args]\n\ncommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun %s <command> -h for a command's flags\n", os.Args[0])
+}
+
+// runCLI runs the command named by args[0], or serve if there is none, and returns the exit code.
+func runCLI(args []string) int {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		err := c.run(args)
+		switch {
+		case err == nil:
+			return 0
+		case errors.Is(err, errUsage), errors.Is(err, flag.ErrHelp):
+			return 2
+		case errors.Is(err, errCheckFailed):
+			return 1
+		}
+		log.Error().Err(err).Msg(name)
+		return 1
+	}
+	if name != "help" {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	}
+	usage()
+	return 2
+}
+
+// cliFlags is a command's flag set with the flags every command shares.
+type cliFlags struct {
+	*flag.FlagSet
+	config string
+}
+
+func newFlagSet(c string, args string) *cliFlags {
+	fs := &cliFlags{FlagSet: flag.NewFlagSet(c, flag.ContinueOnError)}
+	fs.StringVar(&fs.config, "config", os.Getenv("CONFIG"), "YAML config file; env vars override its settings")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s [flags] %s\n", os.Args[0], c, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// start parses the flags, loads the config and sets up logging. Commands that use the database
+// also connect and load the location registry.
+func (fs *cliFlags) start(args []string, useDB bool) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c, err := loadConfig(fs.config)
+	if err != nil {
+		return err
+	}
+	applyConfig(c)
+	if !useDB {
+		return nil
+	}
+	return connectDB()
+}
+
+// connectDB connects to the database, creates the data_versions table every writer records
+// its changes in, and loads the location registry.
+func connectDB() error {
+	dbConnect()
+	if err := ensureDataVersionsTable(); err != nil {
+		return err
+	}
+	return loadLocationRegistry()
+}
+
+// cliLocation looks up a location given on the command line, defaulting to the default location.
+func cliLocation(id string) (LocationInfo, error) {
+	if id == "" {
+		id = registry.defaultID()
+	}
+	l, ok := registry.lookup(id)
+	if !ok {
+		return l, fmt.Errorf("unknown location %q", id)
+	}
+	return l, nil
+}
+
+// cliLocations is every registered location, or just the one named.
+func cliLocations(id string) ([]LocationInfo, error) {
+	if id == "" {
+		return registry.list(), nil
+	}
+	l, err := cliLocation(id)
+	return []LocationInfo{l}, err
+}
+
+func serveCommand(args []string) error {
+	fs := newFlagSet("serve", "")
+	if err := fs.start(args, true); err != nil {
+		return err
+	}
+	return serve(fs.config)
+}
+
+func ingestCommand(args []string) error {
+	fs := newFlagSet("ingest", "[file]")
+	location := fs.String("location", "", "location of the samples in file (default: the default location)")
+	clientID := fs.String("client-id", "energy-ingest", "MQTT client id; keep it stable so the broker queues messages while ingest is down")
+	if err := fs.start(args, true); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return ingestMQTT(*clientID)
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+	loc, err := cliLocation(*location)
+	if err != nil {
+		return err
+	}
+	in := os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		if in, err = os.Open(name); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	n, err := ingestReader(in, loc.ID)
+	log.Info().Msgf("stored %d %s samples", n, loc.ID)
+	return err
+}
+
+func migrateCommand(args []string) error {
+	fs := newFlagSet("migrate", "")
+	if err := fs.start(args, false); err != nil {
+		return err
+	}
+	return migrate()
+}
+
+func rollupCommand(args []string) error {
+	fs := newFlagSet("rollup", "")
+	location := fs.String("location", "", "location to roll up (default: all)")
+	from := fs.String("from", "", "first day to rebuild, 2006-01-02 in the location's time zone (default: yesterday)")
+	to := fs.String("to", "", "last day to rebuild, 2006-01-02 in the location's time zone (default: yesterday, the last closed day; "+
+		"today is still being collected, so its rebuilt rows go stale)")
+	if err := fs.start(args, true); err != nil {
+		return err
+	}
+	locs, err := cliLocations(*location)
+	if err != nil {
+		return err
+	}
+	for _, loc := range locs {
+		begin, end, err := rollupDays(*from, *to, time.Now().In(loc.TZ()))
+		if err != nil {
+			return err
+		}
+		if today := dayStart(time.Now().In(loc.TZ())); end.After(today) {
+			log.Warn().Msgf("%s: rolling up today, which is still being collected; its rows go stale until the next rollup", loc.ID)
+		}
+		res, err := rollupRange(loc.ID, begin, end)
+		if err != nil {
+			return err
+		}
+		log.Info().Msgf("%s: rolled up %d samples into %d five minute and %d daily rows", loc.ID, res.Samples, res.FiveMin, res.Days)
+	}
+	return nil
+}
+
+// rollupDays is the start of the first day and the end of the last day of the rollup's -from
+// and -to, which default to the last closed day before now's.
+func rollupDays(from string, to string, now time.Time) (time.Time, time.Time, error) {
+	today := dayStart(now)
+	begin, end := dayStart(today.AddDate(0, 0, -1)), today
+	var err error
+	if from != "" {
+		if begin, err = time.ParseInLocation("2006-01-02", from, now.Location()); err != nil {
+			return begin, end, fmt.Errorf("-from: %w", err)
+		}
+	}
+	if to != "" {
+		last, err := time.ParseInLocation("2006-01-02", to, now.Location())
+		if err != nil {
+			return begin, end, fmt.Errorf("-to: %w", err)
+		}
+		end = dayStart(last.AddDate(0, 0, 1))
+	}
+	if !end.After(begin) {
+		return begin, end, fmt.Errorf("-from %s is after -to %s", begin.Format("2006-01-02"), end.AddDate(0, 0, -1).Format("2006-01-02"))
+	}
+	return begin, end, nil
+}
+
+func importCommand(args []string) error {
+	fs := newFlagSet("import", "weather|tesla|pypowerwall file...")
+	location := fs.String("location", "", "location for records without one (default: the default location)")
+	samples := fs.Bool("samples", false, "store history as energy and battery samples for rollup instead of writing the rollups directly")
+	if err := fs.start(args, true); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return errUsage
+	}
+	loc, err := cliLocation(*location)
+	if err != nil {
+		return err
+	}
+	kind, files := fs.Arg(0), fs.Args()[1:]
+	if kind == "weather" {
+		for _, file := range files {
+			n, err := importWeatherFile(file, loc.ID)
+			if err != nil {
+				return err
+			}
+			log.Info().Msgf("imported %d weather records from %s", n, file)
+		}
+		return nil
+	}
+	if _, ok := historyFormats[kind]; !ok {
+		fs.Usage()
+		return errUsage
+	}
+	res, err := importHistoryFiles(files, loc.ID, kind, *samples)
+	writeHistoryReport(cliOutput, loc.ID, res)
+	return err
+}
+
+func exportCommand(args []string) error {
+	fs := newFlagSet("export", "")
+	location := fs.String("location", "", "location to export (default: the default location)")
+	period := fs.String("period", time.Now().Format("2006-01"), "year, month, ISO week, day or from..to range")
+	table := fs.String("table", "day", "day, five-min or battery")
+	format := fs.String("format", "csv", "csv or json")
+	if err := fs.start(args, true); err != nil {
+		return err
+	}
+	loc, err := cliLocation(*location)
+	if err != nil {
+		return err
+	}
+	p, err := parsePeriod(*period, loc.TZ())
+	if err != nil {
+		return err
+	}
+	return export(cliOutput, loc.ID, p, *table, *format)
+}
+
+func reportCommand(args []string) error {
+	fs := newFlagSet("report", "")
+	location := fs.String("location", "", "location to report on (default: all)")
+	period := fs.String("period", time.Now().Format("2006-01"), "year, month, ISO week, day or from..to range")
+	if err := fs.start(args, true); err != nil {
+		return err
+	}
+	locs, err := cliLocations(*location)
+	if err != nil {
+		return err
+	}
+	for i, loc := range locs {
+		p, err := parsePeriod(*period, loc.TZ())
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Fprintln(cliOutput)
+		}
+		if err := writeReport(cliOutput, loc, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkCommand(args []string) error {
+	fs := newFlagSet("check", "")
+	days := fs.Int("days", 1, "days of data to scan for gaps, duplicates, impossible values and rollup mismatches; 0 to skip")
+	if err := fs.start(args, true); err != nil {
+		return err
+	}
+	problems, err := checkIntegrity(time.Now(), *days)
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Fprintln(cliOutput, p)
+	}
+	if len(problems) > 0 {
+		return errCheckFailed
+	}
+	fmt.Fprintln(cliOutput, "ok")
+	return nil
+}
+
+func simulateCommand(args []string) error {
+	fs := newFlagSet("simulate", "")
+	location := fs.String("location", "", "location to simulate; a registered location supplies PV size, battery and position (default: the default location)")
+	from := fs.String("from", "", "backfill from this day, 2006-01-02 (default: today)")
+	to := fs.String("to", "", "backfill up to the end of this day, 2006-01-02 (default: now)")
+	interval := fs.Duration("interval", 30*time.Second, "time between samples")
+	realtime := fs.Bool("realtime", false, "after any backfill, keep generating samples in real time until interrupted")
+	toDB := fs.Bool("db", false, "store samples in the energy and battery tables")
+	toMQTT := fs.Bool("mqtt", false, "publish samples to the MQTT broker as the collector does")
+	out := fs.String("out", "", "write aggregates JSON lines to this file (- for stdout), for ingest")
+	seed := fs.Int64("seed", 1, "random seed; the same seed gives the same data")
+	reserve := fs.Float64("reserve", 20, "battery backup reserve percent")
+	rollup := fs.Bool("rollup", false, "roll up the backfilled days that have ended (implies -db)")
+	if err := fs.start(args, false); err != nil {
+		return err
+	}
+	if *interval <= 0 || *reserve < 0 || *reserve > 100 {
+		fs.Usage()
+		return errUsage
+	}
+	*toDB = *toDB || *rollup
+	if *toDB {
+		if err := connectDB(); err != nil {
+			return err
+		}
+	}
+	loc, err := simLocation(*location)
+	if err != nil {
+		return err
+	}
+
+	var sinks []SimSink
+	if *toDB {
+		sinks = append(sinks, dbSimSink{})
+	}
+	if *toMQTT {
+		sink, err := newMQTTSimSink("energy-simulate-" + strings.ToLower(loc.ID))
+		if err != nil {
+			return err
+		}
+		defer sink.client.Disconnect(1000)
+		sinks = append(sinks, sink)
+	}
+	if *out != "" {
+		w := cliOutput
+		if *out != "-" {
+			f, err := os.Create(*out)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		sinks = append(sinks, writerSimSink{w})
+	}
+	if len(sinks) == 0 {
+		return fmt.Errorf("nowhere to send samples: use -db, -mqtt or -out")
+	}
+
+	home := virtualHome(loc)
+	home.BackupReserve = *reserve
+	sim := NewSimulator(home, *seed)
+	now := time.Now()
+	begin, end := now, now
+	if *from != "" {
+		if begin, err = time.ParseInLocation("2006-01-02", *from, home.TZ); err != nil {
+			return fmt.Errorf("-from: %w", err)
+		}
+	}
+	if *to != "" {
+		last, err := time.ParseInLocation("2006-01-02", *to, home.TZ)
+		if err != nil {
+			return fmt.Errorf("-to: %w", err)
+		}
+		end = last.AddDate(0, 0, 1)
+	}
+	n, err := simulate(sim, begin, end, *interval, sinks)
+	log.Info().Msgf("%s: simulated %d samples, battery at %.0f%%", loc.ID, n, sim.Percent())
+	if err != nil {
+		return err
+	}
+	if *rollup && n > 0 {
+		// like the rollup command, only roll up closed days; today's rows would go stale
+		first, last, err := rollupDays(begin.In(home.TZ).Format("2006-01-02"), *to, now.In(home.TZ))
+		if today := dayStart(now.In(home.TZ)); last.After(today) {
+			last = today
+		}
+		if err != nil || !last.After(first) {
+			log.Info().Msgf("%s: no closed days to roll up; run the rollup command once today ends", loc.ID)
+		} else {
+			res, err := rollupRange(loc.ID, first, last)
+			if err != nil {
+				return err
+			}
+			log.Info().Msgf("%s: rolled up %d samples into %d five minute and %d daily rows", loc.ID, res.Samples, res.FiveMin, res.Days)
+		}
+	}
+	if !*realtime {
+		return nil
+	}
+	stop := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		close(stop)
+	}()
+	return simulateLive(sim, *interval, sinks, stop)
+}
+
+func passwdCommand(args []string) error {
+	fs := newFlagSet("passwd", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(cliInput).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return errors.New("no password on stdin")
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(cliOutput, hash)
+	return nil
+}
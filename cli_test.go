@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCLIUsage(t *testing.T) {
+	testInit()
+	if code := runCLI([]string{"frobnicate"}); code != 2 {
+		t.Errorf("unknown command: got exit code %d, want 2", code)
+	}
+	if code := runCLI([]string{"import", "-h"}); code != 2 {
+		t.Errorf("-h: got exit code %d, want 2", code)
+	}
+	t.Setenv("DEMAND_WINDOW", "20")
+	if code := runCLI([]string{"migrate"}); code != 1 {
+		t.Errorf("bad config: got exit code %d, want 1", code)
+	}
+}
+
+func TestPasswdCommand(t *testing.T) {
+	var out bytes.Buffer
+	cliInput, cliOutput = strings.NewReader("correct horse\n"), &out
+	defer func() { cliInput, cliOutput = os.Stdin, os.Stdout }()
+	if code := runCLI([]string{"passwd"}); code != 0 {
+		t.Fatalf("exit code %d", code)
+	}
+	applyAuth(AuthConfig{Mode: "basic", Users: []UserConfig{{Name: "alice", PasswordHash: strings.TrimSpace(out.String())}}})
+	defer applyAuth(AuthConfig{})
+	if currentAuth.Load().password("alice", "correct horse") == nil {
+		t.Errorf("%q isn't the hash of the password", out.String())
+	}
+}
+
+func TestTopicLocation(t *testing.T) {
+	location, kind, err := topicLocation("energy/vt/battery")
+	if err != nil || location != "VT" || kind != "battery" {
+		t.Errorf("got %s %s %v", location, kind, err)
+	}
+	if _, _, err := topicLocation("energy/vt"); err == nil {
+		t.Error("expected an error for a short topic")
+	}
+}
+
+func TestAggregatesTime(t *testing.T) {
+	dt, ok := aggregatesTime([]byte(`{"site":{"last_communication_time":"2026-06-14T12:00:01.5-04:00","instant_power":120}}`))
+	if !ok || !dt.Equal(time.Date(2026, 6, 14, 16, 0, 1, 500000000, time.UTC)) {
+		t.Errorf("got %s %v", dt, ok)
+	}
+	if _, ok := aggregatesTime([]byte(`{"site":{}}`)); ok {
+		t.Error("expected no time")
+	}
+}
+
+func TestWriteStatsCSV(t *testing.T) {
+	var b bytes.Buffer
+	recs := []StatsDisplayRecord{{Location: "VT", DateTime: 1781409600, DT: "2026-06-14", SiteImported: 1200.5, NumSiteSamples: 3}}
+	if err := writeStatsCSV(&b, recs); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "VT,1781409600,2026-06-14,0,1200.5,") {
+		t.Errorf("unexpected CSV:\n%s", b.String())
+	}
+}
+
+func TestRollupDays(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	now := time.Date(2026, 3, 9, 0, 30, 0, 0, ny)
+	day := func(d int) time.Time { return time.Date(2026, 3, d, 0, 0, 0, 0, ny) }
+	for _, c := range []struct {
+		from, to   string
+		begin, end time.Time
+		err        bool
+	}{
+		{"", "", day(8), day(9), false}, // yesterday, the 23 hour DST day
+		{"2026-03-01", "", day(1), day(9), false},
+		{"2026-03-01", "2026-03-09", day(1), day(10), false},
+		{"2026-03-09", "", time.Time{}, time.Time{}, true},
+		{"March 1", "", time.Time{}, time.Time{}, true},
+	} {
+		begin, end, err := rollupDays(c.from, c.to, now)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q to %q: no error", c.from, c.to)
+			}
+			continue
+		}
+		if err != nil || !begin.Equal(c.begin) || !end.Equal(c.end) {
+			t.Errorf("%q to %q: got %v to %v, %v", c.from, c.to, begin, end, err)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var compareTmpl *template.Template
+
+// Period is a half open [Begin, End) range of days named by Label.
+type Period struct {
+	Label string
+	Begin time.Time
+	End   time.Time
+}
+
+// parsePeriod accepts a year (2026), month (2026-06), ISO week (2026-W23), day (2026-06-14)
+// or an inclusive range of days (2026-06-01..2026-06-15), with days starting at midnight in tz.
+func parsePeriod(s string, tz *time.Location) (Period, error) {
+	s = strings.TrimSpace(s)
+	p := Period{Label: s}
+	if from, to, ok := strings.Cut(s, ".."); ok {
+		begin, err := time.ParseInLocation("2006-01-02", from, tz)
+		if err != nil {
+			return p, fmt.Errorf("bad range start %q", from)
+		}
+		end, err := time.ParseInLocation("2006-01-02", to, tz)
+		if err != nil {
+			return p, fmt.Errorf("bad range end %q", to)
+		}
+		if end.Before(begin) {
+			return p, fmt.Errorf("range %q ends before it begins", s)
+		}
+		p.Begin, p.End = begin, end.AddDate(0, 0, 1)
+		return p, nil
+	}
+	if year, week, ok := strings.Cut(s, "-W"); ok {
+		y, err1 := strconv.Atoi(year)
+		w, err2 := strconv.Atoi(week)
+		if err1 != nil || err2 != nil || w < 1 || w > 53 {
+			return p, fmt.Errorf("bad week %q", s)
+		}
+		// ISO week 1 is the week with the year's first Thursday
+		jan4 := time.Date(y, time.January, 4, 0, 0, 0, 0, tz)
+		monday := jan4.AddDate(0, 0, -((int(jan4.Weekday()) + 6) % 7))
+		p.Begin = monday.AddDate(0, 0, 7*(w-1))
+		p.End = p.Begin.AddDate(0, 0, 7)
+		return p, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, tz); err == nil {
+		p.Begin, p.End = t, t.AddDate(0, 0, 1)
+		return p, nil
+	}
+	if t, err := time.ParseInLocation("2006-01", s, tz); err == nil {
+		p.Begin, p.End = t, t.AddDate(0, 1, 0)
+		return p, nil
+	}
+	if t, err := time.ParseInLocation("2006", s, tz); err == nil {
+		p.Begin, p.End = t, t.AddDate(1, 0, 0)
+		return p, nil
+	}
+	return p, fmt.Errorf("unrecognized period %q", s)
+}
+
+// PeriodTotals sums the daily stats for a period.
+type PeriodTotals struct {
+	Label             string               `json:"label"`
+	Begin             string               `json:"begin"`
+	End               string               `json:"end"`
+	Days              int                  `json:"days"`
+	Production        float64              `json:"production"`
+	Consumption       float64              `json:"consumption"`
+	GridImport        float64              `json:"gridImport"`
+	GridExport        float64              `json:"gridExport"`
+	BatteryThroughput float64              `json:"batteryThroughput"`
+	Daily             []StatsDisplayRecord `json:"-"`
+}
+
+// CompareRow is one measure for both periods.
+type CompareRow struct {
+	Name    string   `json:"name"`
+	A       float64  `json:"a"`
+	B       float64  `json:"b"`
+	Delta   float64  `json:"delta"`
+	Percent *float64 `json:"percent"`
+}
+
+// Comparison is two periods side by side.
+type Comparison struct {
+	Location          string       `json:"location"`
+	Info              LocationInfo `json:"-"`
+	A                 PeriodTotals `json:"a"`
+	B                 PeriodTotals `json:"b"`
+	Rows              []CompareRow `json:"rows"`
+	ProductionGraphA  []chartPoint `json:"-"`
+	ProductionGraphB  []chartPoint `json:"-"`
+	ConsumptionGraphA []chartPoint `json:"-"`
+	ConsumptionGraphB []chartPoint `json:"-"`
+	GridImportGraphA  []chartPoint `json:"-"`
+	GridImportGraphB  []chartPoint `json:"-"`
+	BatteryGraphA     []chartPoint `json:"-"`
+	BatteryGraphB     []chartPoint `json:"-"`
+	QueryA            string       `json:"-"`
+	QueryB            string       `json:"-"`
+}
+
+// PercentChange formats Percent for display.
+func (r CompareRow) PercentChange() string {
+	if r.Percent == nil {
+		return "n/a"
+	}
+	return fmt.Sprintf("%+.1f%%", *r.Percent)
+}
+
+func periodTotals(p Period, daily []StatsDisplayRecord) PeriodTotals {
+	t := PeriodTotals{
+		Label: p.Label,
+		Begin: p.Begin.Format("2006-01-02"),
+		End:   p.End.AddDate(0, 0, -1).Format("2006-01-02"),
+		Days:  len(daily),
+		Daily: daily,
+	}
+	for _, d := range daily {
+		t.Production += d.SolarExported
+		t.Consumption += d.LoadImported
+		t.GridImport += d.SiteImported
+		t.GridExport += d.SiteExported
+		t.BatteryThroughput += d.BatteryImported + d.BatteryExported
+	}
+	return t
+}
+
+func compareRow(name string, a float64, b float64) CompareRow {
+	row := CompareRow{Name: name, A: a, B: b, Delta: b - a}
+	if a != 0 {
+		pct := (b - a) / math.Abs(a) * 100
+		row.Percent = &pct
+	}
+	return row
+}
+
+func compareRows(a PeriodTotals, b PeriodTotals) []CompareRow {
+	return []CompareRow{
+		compareRow("Production", a.Production, b.Production),
+		compareRow("Consumption", a.Consumption, b.Consumption),
+		compareRow("Grid Import", a.GridImport, b.GridImport),
+		compareRow("Grid Export", a.GridExport, b.GridExport),
+		compareRow("Battery Throughput", a.BatteryThroughput, b.BatteryThroughput),
+	}
+}
+
+// overlayChartData plots each day against its day number in the period so both periods share an x axis.
+func overlayChartData(in []StatsDisplayRecord, begin time.Time) (production []chartPoint, consumption []chartPoint, gridImport []chartPoint, battery []chartPoint) {
+	prod, cons, grid, batt := make([]chartPoint, 0, len(in)), make([]chartPoint, 0, len(in)), make([]chartPoint, 0, len(in)), make([]chartPoint, 0, len(in))
+	for _, v := range in {
+		day := int64(math.Round(time.Unix(v.DateTime, 0).Sub(begin).Hours()/24)) + 1
+		prod = append(prod, chartPoint{X: day, Y: v.SolarExported})
+		cons = append(cons, chartPoint{X: day, Y: v.LoadImported})
+		grid = append(grid, chartPoint{X: day, Y: v.SiteImported})
+		batt = append(batt, chartPoint{X: day, Y: v.BatteryImported + v.BatteryExported})
+	}
+	return prod, cons, grid, batt
+}
+
+func comparePeriods(location string, a Period, b Period) (Comparison, error) {
+	log.Debug().Msgf("comparePeriods(%s, %s, %s)", location, a.Label, b.Label)
+	c := Comparison{Location: location, QueryA: a.Label, QueryB: b.Label}
+	dailyA, err := getDayStatsRange(location, a.Begin.Unix(), a.End.Unix())
+	if err != nil {
+		return c, err
+	}
+	dailyB, err := getDayStatsRange(location, b.Begin.Unix(), b.End.Unix())
+	if err != nil {
+		return c, err
+	}
+	c.A = periodTotals(a, dailyA)
+	c.B = periodTotals(b, dailyB)
+	c.Rows = compareRows(c.A, c.B)
+	c.ProductionGraphA, c.ConsumptionGraphA, c.GridImportGraphA, c.BatteryGraphA = overlayChartData(dailyA, a.Begin)
+	c.ProductionGraphB, c.ConsumptionGraphB, c.GridImportGraphB, c.BatteryGraphB = overlayChartData(dailyB, b.Begin)
+	return c, nil
+}
+
+// comparePeriodParams reads the a and b periods in tz, defaulting to this month vs the same month last year.
+func comparePeriodParams(r *http.Request, tz *time.Location) (Period, Period, error) {
+	now := time.Now().In(tz)
+	a := r.URL.Query().Get("a")
+	if a == "" {
+		a = now.AddDate(-1, 0, 0).Format("2006-01")
+	}
+	b := r.URL.Query().Get("b")
+	if b == "" {
+		b = now.Format("2006-01")
+	}
+	pa, err := parsePeriod(a, tz)
+	if err == nil {
+		err = checkSpan("a", pa.Begin, pa.End)
+	}
+	if err != nil {
+		return pa, Period{}, err
+	}
+	pb, err := parsePeriod(b, tz)
+	if err == nil {
+		err = checkSpan("b", pb.Begin, pb.End)
+	}
+	return pa, pb, err
+}
+
+func compareHandler(w http.ResponseWriter, r *http.Request) {
+	loc, ok := requestLocation(w, r)
+	if !ok {
+		return
+	}
+	location := loc.ID
+	a, b, err := comparePeriodParams(r, loc.TZ())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := comparePeriods(location, a, b)
+	if err != nil {
+		s := fmt.Sprintf("%+v", err)
+		http.Error(w, s, http.StatusInternalServerError)
+		return
+	}
+	c.Info = loc
+	if err := compareTmpl.Execute(w, c); err != nil {
+		msg := http.StatusText(http.StatusInternalServerError)
+		log.Error().Err(err).Msg(msg)
+	}
+}
+
+func compareAPIHandler(w http.ResponseWriter, r *http.Request) {
+	loc, ok := requestLocation(w, r)
+	if !ok {
+		return
+	}
+	location := loc.ID
+	a, b, err := comparePeriodParams(r, loc.TZ())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := comparePeriods(location, a, b)
+	if err != nil {
+		s := fmt.Sprintf("%+v", err)
+		http.Error(w, s, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, c)
+}
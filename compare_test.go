@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCompare(t *testing.T) {
+	testInit()
+	compareTmpl = parseTemplate("compare.html")
+}
+
+func TestParsePeriod(t *testing.T) {
+	tests := []struct {
+		in         string
+		begin, end string
+	}{
+		{"2026", "2026-01-01", "2027-01-01"},
+		{"2026-06", "2026-06-01", "2026-07-01"},
+		{"2026-06-14", "2026-06-14", "2026-06-15"},
+		{"2026-W01", "2025-12-29", "2026-01-05"},
+		{"2026-W23", "2026-06-01", "2026-06-08"},
+		{"2026-06-01..2026-06-15", "2026-06-01", "2026-06-16"},
+	}
+	for _, tc := range tests {
+		p, err := parsePeriod(tc.in, time.Local)
+		if err != nil {
+			t.Errorf("parsePeriod(%q): %v", tc.in, err)
+			continue
+		}
+		if got := p.Begin.Format("2006-01-02"); got != tc.begin {
+			t.Errorf("parsePeriod(%q) begin: got %s, want %s", tc.in, got, tc.begin)
+		}
+		if got := p.End.Format("2006-01-02"); got != tc.end {
+			t.Errorf("parsePeriod(%q) end: got %s, want %s", tc.in, got, tc.end)
+		}
+	}
+	for _, bad := range []string{"", "June", "2026-13", "2026-W60", "2026-06-15..2026-06-01"} {
+		if _, err := parsePeriod(bad, time.Local); err == nil {
+			t.Errorf("parsePeriod(%q): expected an error", bad)
+		}
+	}
+}
+
+func TestCompareRows(t *testing.T) {
+	day := time.Date(2025, 6, 1, 0, 0, 0, 0, time.Local).Unix()
+	a := periodTotals(Period{Label: "a"}, []StatsDisplayRecord{{DateTime: day, SolarExported: 100, LoadImported: 50, BatteryImported: 10, BatteryExported: 5}})
+	b := periodTotals(Period{Label: "b"}, []StatsDisplayRecord{{DateTime: day, SolarExported: 150, LoadImported: 40, SiteImported: 5}})
+	rows := compareRows(a, b)
+	if rows[0].Delta != 50 || rows[0].PercentChange() != "+50.0%" {
+		t.Errorf("unexpected production row: %+v", rows[0])
+	}
+	if rows[1].PercentChange() != "-20.0%" {
+		t.Errorf("unexpected consumption row: %+v", rows[1])
+	}
+	if rows[2].PercentChange() != "n/a" {
+		t.Errorf("grid import from zero should have no percentage: %+v", rows[2])
+	}
+	if rows[4].A != 15 {
+		t.Errorf("unexpected battery throughput: %+v", rows[4])
+	}
+}
+
+func TestParsePeriodDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no tzdata")
+	}
+	p, err := parsePeriod("2026-03-08", ny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.End.Sub(p.Begin); got != 23*time.Hour {
+		t.Errorf("spring forward day is %s long", got)
+	}
+	if want := time.Date(2026, 3, 8, 5, 0, 0, 0, time.UTC); !p.Begin.Equal(want) {
+		t.Errorf("begin: got %s, want %s", p.Begin.UTC(), want)
+	}
+	p, _ = parsePeriod("2026-10-26..2026-11-01", ny)
+	if got := p.End.Sub(p.Begin); got != 7*24*time.Hour+time.Hour {
+		t.Errorf("fall back week is %s long", got)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the service configuration. It is read from a YAML file and env vars override it.
+type Config struct {
+	Port             string         `yaml:"port"`
+	Console          bool           `yaml:"console"`
+	Debug            bool           `yaml:"debug"`
+	DefaultLimit     int            `yaml:"default_limit"` // days of daily stats on the dashboard
+	GraphDays        int            `yaml:"graph_days"`    // days the charts and reports cover by default
+	LiveLimit        int            `yaml:"live_limit"`    // records on the live page
+	ChartGap         int            `yaml:"chart_gap"`     // minutes without data that break a chart line, 0 to never break
+	ChartFill        string         `yaml:"chart_fill"`    // fill chart gaps: "", linear or profile
+	CacheSize        int            `yaml:"cache_size"`    // closed days (months for daily rollups) of rollups kept in memory, 0 for none
+	DefaultLocation  string         `yaml:"default_location"`
+	EnergyPrice      float64        `yaml:"energy_price"`  // per kWh, unless a location has its own tariff
+	DemandWindow     int            `yaml:"demand_window"` // minutes
+	DemandTracking   bool           `yaml:"demand_tracking"`
+	AnomalyDetection bool           `yaml:"anomaly_detection"`
+	CarbonProfile    string         `yaml:"carbon_profile"`
+	DB               DBConfig       `yaml:"db"`
+	MQTT             MQTTConfig     `yaml:"mqtt"`
+	Alerts           AlertConfig    `yaml:"alerts"`
+	Auth             AuthConfig     `yaml:"auth"`
+	Limits           LimitsConfig   `yaml:"limits"`
+	Locations        []LocationInfo `yaml:"locations"`
+}
+
+// DBConfig is the Cloud SQL connection. Changes need a restart.
+type DBConfig struct {
+	Name                   string `yaml:"name"`
+	User                   string `yaml:"user"`
+	Password               string `yaml:"password"`
+	InstanceConnectionName string `yaml:"instance_connection_name"`
+	SocketDir              string `yaml:"socket_dir"`
+}
+
+// MQTTConfig is the websocket broker the live page subscribes to.
+type MQTTConfig struct {
+	Broker string `yaml:"broker"`
+	Port   int    `yaml:"port"`
+	Path   string `yaml:"path"`
+	UseSSL bool   `yaml:"use_ssl"`
+}
+
+// AlertConfig says where detector alerts go besides the log.
+type AlertConfig struct {
+	WebhookURL string `yaml:"webhook_url"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Port:            "8080",
+		DefaultLimit:    7,
+		DefaultLocation: "VT",
+		GraphDays:       60,
+		LiveLimit:       2000,
+		ChartGap:        15,
+		CacheSize:       2000,
+		EnergyPrice:     defaultEnergyPrice,
+		DemandWindow:    defaultDemandWindow,
+		DB:              DBConfig{SocketDir: "/cloudsql"},
+		MQTT:            MQTTConfig{Broker: "msg.tom.org", Port: 8083, Path: "/mqtt", UseSSL: true},
+		Limits:          LimitsConfig{RatePerMinute: 120, Burst: 30, MaxRows: 10000, MaxDays: 3660},
+	}
+}
+
+var currentConfig atomic.Pointer[Config]
+
+// config returns the active configuration, or the defaults before one is loaded.
+func config() *Config {
+	if c := currentConfig.Load(); c != nil {
+		return c
+	}
+	c := defaultConfig()
+	return &c
+}
+
+// loadConfig reads path (if not empty), applies env overrides and validates the result.
+func loadConfig(path string) (*Config, error) {
+	c := defaultConfig()
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		if err := dec.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	problems := applyEnv(&c, os.LookupEnv)
+	problems = append(problems, c.validate()...)
+	if len(problems) > 0 {
+		name := path
+		if name == "" {
+			name = "config"
+		}
+		return nil, fmt.Errorf("%s is invalid:\n  %s", name, strings.Join(problems, "\n  "))
+	}
+	return &c, nil
+}
+
+// applyEnv overrides c with any env vars that are set, returning the ones that don't parse.
+func applyEnv(c *Config, lookup func(string) (string, bool)) []string {
+	var problems []string
+	str := func(name string, dst *string) {
+		if v, ok := lookup(name); ok {
+			*dst = v
+		}
+	}
+	num := func(name string, dst *int) {
+		if v, ok := lookup(name); ok && v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %q is not an integer", name, v))
+				return
+			}
+			*dst = n
+		}
+	}
+	float := func(name string, dst *float64) {
+		if v, ok := lookup(name); ok && v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %q is not a number", name, v))
+				return
+			}
+			*dst = f
+		}
+	}
+	// flags have always been on when set to anything, so only explicit false values turn them off
+	flag := func(name string, dst *bool) {
+		if v, ok := lookup(name); ok {
+			switch strings.ToLower(v) {
+			case "", "0", "false", "no", "off":
+				*dst = false
+			default:
+				*dst = true
+			}
+		}
+	}
+
+	str("PORT", &c.Port)
+	flag("CONSOLE", &c.Console)
+	flag("DEBUG", &c.Debug)
+	num("DEFAULT_LIMIT", &c.DefaultLimit)
+	num("GRAPH_DAYS", &c.GraphDays)
+	num("LIVE_LIMIT", &c.LiveLimit)
+	num("CHART_GAP", &c.ChartGap)
+	str("CHART_FILL", &c.ChartFill)
+	num("CACHE_SIZE", &c.CacheSize)
+	str("DEFAULT_LOCATION", &c.DefaultLocation)
+	float("ENERGY_PRICE", &c.EnergyPrice)
+	num("DEMAND_WINDOW", &c.DemandWindow)
+	flag("DEMAND_TRACKING", &c.DemandTracking)
+	flag("ANOMALY_DETECTION", &c.AnomalyDetection)
+	str("CARBON_PROFILE", &c.CarbonProfile)
+	str("DB_NAME", &c.DB.Name)
+	str("DB_USER", &c.DB.User)
+	str("DB_PASS", &c.DB.Password)
+	str("INSTANCE_CONNECTION_NAME", &c.DB.InstanceConnectionName)
+	str("DB_SOCKET_DIR", &c.DB.SocketDir)
+	str("MQTT_BROKER", &c.MQTT.Broker)
+	num("MQTT_PORT", &c.MQTT.Port)
+	str("ALERT_WEBHOOK_URL", &c.Alerts.WebhookURL)
+	str("AUTH_MODE", &c.Auth.Mode)
+	str("AUTH_SESSION_SECRET", &c.Auth.SessionSecret)
+	str("OIDC_CLIENT_SECRET", &c.Auth.OIDC.ClientSecret)
+	num("RATE_PER_MINUTE", &c.Limits.RatePerMinute)
+	num("MAX_ROWS", &c.Limits.MaxRows)
+	num("MAX_DAYS", &c.Limits.MaxDays)
+	flag("TRUST_FORWARDED_FOR", &c.Limits.TrustForwardedFor)
+	return problems
+}
+
+// validate returns a description of everything wrong with c.
+func (c *Config) validate() []string {
+	var problems []string
+	if p, err := strconv.Atoi(c.Port); err != nil || p < 1 || p > 65535 {
+		problems = append(problems, fmt.Sprintf("port: %q is not a TCP port", c.Port))
+	}
+	counts := []struct {
+		name  string
+		value int
+	}{{"default_limit", c.DefaultLimit}, {"graph_days", c.GraphDays}, {"live_limit", c.LiveLimit}}
+	for _, n := range counts {
+		if n.value < 1 {
+			problems = append(problems, fmt.Sprintf("%s: must be at least 1, got %d", n.name, n.value))
+		}
+	}
+	if c.ChartGap < 0 {
+		problems = append(problems, fmt.Sprintf("chart_gap: must not be negative, got %d", c.ChartGap))
+	}
+	if c.CacheSize < 0 {
+		problems = append(problems, fmt.Sprintf("cache_size: must not be negative, got %d", c.CacheSize))
+	}
+	if !chartFills[c.ChartFill] {
+		problems = append(problems, fmt.Sprintf("chart_fill: must be empty, linear or profile, got %q", c.ChartFill))
+	}
+	if c.EnergyPrice < 0 {
+		problems = append(problems, fmt.Sprintf("energy_price: must not be negative, got %g", c.EnergyPrice))
+	}
+	if c.DemandWindow != 15 && c.DemandWindow != 30 {
+		problems = append(problems, fmt.Sprintf("demand_window: must be 15 or 30 minutes, got %d", c.DemandWindow))
+	}
+	if c.CarbonProfile != "" {
+		if _, err := loadCarbonProfile(c.CarbonProfile); err != nil {
+			problems = append(problems, fmt.Sprintf("carbon_profile: %v", err))
+		}
+	}
+	if c.MQTT.Broker == "" {
+		problems = append(problems, "mqtt.broker: must be set")
+	}
+	if c.MQTT.Port < 1 || c.MQTT.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("mqtt.port: %d is not a TCP port", c.MQTT.Port))
+	}
+	if c.Alerts.WebhookURL != "" {
+		if u, err := url.Parse(c.Alerts.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("alerts.webhook_url: %q is not an http(s) URL", c.Alerts.WebhookURL))
+		}
+	}
+	problems = append(problems, c.Auth.validate()...)
+	problems = append(problems, c.Limits.validate()...)
+
+	seen := make(map[string]bool)
+	for i, l := range c.Locations {
+		l, err := normalizeLocation(l)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("locations[%d]: %v", i, err))
+			continue
+		}
+		if seen[l.ID] {
+			problems = append(problems, fmt.Sprintf("locations[%d]: duplicate id %s", i, l.ID))
+		}
+		if l.Tariff < 0 {
+			problems = append(problems, fmt.Sprintf("locations[%d]: tariff must not be negative", i))
+		}
+		seen[l.ID] = true
+		c.Locations[i] = l
+	}
+	c.DefaultLocation = strings.ToUpper(c.DefaultLocation)
+	return problems
+}
+
+// applyConfig makes c the active configuration and refreshes everything that depends on it,
+// emptying the rollup cache in case another process rebuilt rollups. The database connection,
+// port and background detectors only pick up changes on restart.
+func applyConfig(c *Config) {
+	currentConfig.Store(c)
+	initLogs()
+	initCarbonProfile()
+	applyAuth(c.Auth)
+	applyLimits(c.Limits)
+	rollupsCache.reset(c.CacheSize)
+	if db != nil {
+		if err := loadLocationRegistry(); err != nil {
+			log.Error().Err(err).Msg("loadLocationRegistry()")
+		}
+	}
+}
+
+// watchConfig reloads path on SIGHUP, keeping the running configuration if the new one is invalid.
+func watchConfig(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			c, err := loadConfig(path)
+			if err != nil {
+				log.Error().Err(err).Msg("not reloading config")
+				continue
+			}
+			applyConfig(c)
+			log.Info().Msgf("reloaded config %s", path)
+		}
+	}()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("PORT", "9090")
+	t.Setenv("DEBUG", "")
+	path := writeConfig(t, `
+port: "8081"
+graph_days: 30
+demand_window: 30
+locations:
+  - id: vt
+    name: Vermont
+    timezone: America/New_York
+    tariff: 0.2
+`)
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if c.Port != "9090" {
+		t.Errorf("PORT did not override the file: %s", c.Port)
+	}
+	if c.GraphDays != 30 || c.DemandWindow != 30 || c.LiveLimit != 2000 || c.MQTT.Broker != "msg.tom.org" {
+		t.Errorf("unexpected config: %+v", c)
+	}
+	if len(c.Locations) != 1 || c.Locations[0].ID != "VT" || c.Locations[0].TimeLocation == nil || c.Locations[0].Price() != 0.2 {
+		t.Errorf("unexpected locations: %+v", c.Locations)
+	}
+
+	if c, err := loadConfig(writeConfig(t, "")); err != nil || c.DefaultLimit != 7 {
+		t.Errorf("empty file: %+v %v", c, err)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	t.Setenv("DEFAULT_LIMIT", "lots")
+	path := writeConfig(t, `
+demand_window: 20
+mqtt:
+  port: 0
+alerts:
+  webhook_url: "ftp://example.com"
+limits:
+  max_rows: 0
+locations:
+  - id: VT
+    timezone: America/Nowhere
+  - id: NH
+  - id: nh
+`)
+	_, err := loadConfig(path)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{"DEFAULT_LIMIT", "demand_window", "mqtt.port", "alerts.webhook_url", "limits.max_rows", "locations[0]", "duplicate id NH"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %s:\n%v", want, err)
+		}
+	}
+
+	if _, err := loadConfig(writeConfig(t, "graph_dayz: 3\n")); err == nil || !strings.Contains(err.Error(), "graph_dayz") {
+		t.Errorf("unknown field not reported: %v", err)
+	}
+}
+
+func TestMergeLocations(t *testing.T) {
+	stored := []LocationInfo{{ID: "NH", Name: "NH"}, {ID: "VT", Name: "VT"}}
+	configured := []LocationInfo{{ID: "VT", Name: "Vermont"}, {ID: "MA", Name: "Massachusetts"}}
+	got := mergeLocations(stored, configured)
+	if len(got) != 3 || got[1].Name != "Vermont" || got[2].ID != "MA" {
+		t.Errorf("unexpected merge: %+v", got)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DateRange is the local days a page shows, from Begin up to but not including End.
+type DateRange struct {
+	Begin   time.Time
+	End     time.Time
+	From    string       // first day, 2006-01-02
+	To      string       // last day, 2006-01-02
+	Current bool         // the range includes today, so there is nothing after it
+	Prev    template.URL // from and to query params for the same length of time before
+	Next    template.URL // and after
+}
+
+// requestRange is the range a page's date=, from= and to= params ask for. date takes anything
+// parsePeriod does; from and to are days, either of which can be left out. With neither, the
+// range is the last days days up to today.
+func requestRange(r *http.Request, tz *time.Location, now time.Time, days int) (DateRange, error) {
+	q := r.URL.Query()
+	today := dayStart(now.In(tz))
+	var begin, end time.Time
+	if date := q.Get("date"); date != "" {
+		p, err := parsePeriod(date, tz)
+		if err != nil {
+			return DateRange{}, fmt.Errorf("date: %w", err)
+		}
+		begin, end = p.Begin, p.End
+	} else {
+		end = today.AddDate(0, 0, 1)
+		if to := q.Get("to"); to != "" {
+			last, err := time.ParseInLocation("2006-01-02", to, tz)
+			if err != nil {
+				return DateRange{}, fmt.Errorf("to: %q is not a day", to)
+			}
+			end = last.AddDate(0, 0, 1)
+		}
+		begin = dayStart(end.AddDate(0, 0, -days))
+		if from := q.Get("from"); from != "" {
+			var err error
+			if begin, err = time.ParseInLocation("2006-01-02", from, tz); err != nil {
+				return DateRange{}, fmt.Errorf("from: %q is not a day", from)
+			}
+		}
+	}
+	if !begin.Before(end) {
+		return DateRange{}, fmt.Errorf("the range ends before it begins")
+	}
+	if err := checkSpan("the range", begin, end); err != nil {
+		return DateRange{}, err
+	}
+	return newDateRange(begin, end, today), nil
+}
+
+// newDateRange fills in the navigation for the range from begin up to end.
+func newDateRange(begin time.Time, end time.Time, today time.Time) DateRange {
+	rng := DateRange{Begin: begin, End: end, Current: !end.Before(today.AddDate(0, 0, 1))}
+	rng.From, rng.To = begin.Format("2006-01-02"), end.AddDate(0, 0, -1).Format("2006-01-02")
+
+	// whole months and years step by month and year, anything else by its number of days
+	days := int(math.Round(end.Sub(begin).Hours() / 24))
+	shift := func(t time.Time, n int) time.Time { return dayStart(t.AddDate(0, 0, n*days)) }
+	if begin.Day() == 1 {
+		switch {
+		case end.Equal(begin.AddDate(1, 0, 0)):
+			shift = func(t time.Time, n int) time.Time { return t.AddDate(n, 0, 0) }
+		case end.Equal(begin.AddDate(0, 1, 0)):
+			shift = func(t time.Time, n int) time.Time { return t.AddDate(0, n, 0) }
+		}
+	}
+	query := func(b time.Time, e time.Time) template.URL {
+		return template.URL(url.Values{"from": {b.Format("2006-01-02")}, "to": {e.AddDate(0, 0, -1).Format("2006-01-02")}}.Encode())
+	}
+	rng.Prev = query(shift(begin, -1), begin)
+	rng.Next = query(end, shift(end, 1))
+	return rng
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestRange(t *testing.T) {
+	tz, _ := time.LoadLocation("America/New_York")
+	now := time.Date(2026, 3, 20, 15, 0, 0, 0, tz)
+	cases := []struct {
+		query, from, to, prev, next string
+		current                     bool
+	}{
+		{"", "2026-03-14", "2026-03-20", "from=2026-03-07&to=2026-03-13", "from=2026-03-21&to=2026-03-27", true},
+		{"from=2025-12-01&to=2026-02-28", "2025-12-01", "2026-02-28", "from=2025-09-02&to=2025-11-30", "from=2026-03-01&to=2026-05-29", false},
+		{"to=2026-01-10", "2026-01-04", "2026-01-10", "from=2025-12-28&to=2026-01-03", "from=2026-01-11&to=2026-01-17", false},
+		{"date=2026-01", "2026-01-01", "2026-01-31", "from=2025-12-01&to=2025-12-31", "from=2026-02-01&to=2026-02-28", false},
+		{"date=2026-03-08", "2026-03-08", "2026-03-08", "from=2026-03-07&to=2026-03-07", "from=2026-03-09&to=2026-03-09", false},
+		{"from=2026-03-01&to=2026-03-31", "2026-03-01", "2026-03-31", "from=2026-02-01&to=2026-02-28", "from=2026-04-01&to=2026-04-30", true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/energy?"+c.query, nil)
+		rng, err := requestRange(r, tz, now, 7)
+		if err != nil {
+			t.Errorf("%s: %v", c.query, err)
+			continue
+		}
+		if rng.From != c.from || rng.To != c.to || string(rng.Prev) != c.prev || string(rng.Next) != c.next || rng.Current != c.current {
+			t.Errorf("%s: got %+v", c.query, rng)
+		}
+	}
+	// the day clocks go forward is 23 hours long
+	r := httptest.NewRequest("GET", "/energy?date=2026-03-08", nil)
+	if rng, _ := requestRange(r, tz, now, 7); rng.End.Sub(rng.Begin) != 23*time.Hour {
+		t.Errorf("got %s to %s", rng.Begin, rng.End)
+	}
+	for _, q := range []string{"from=yesterday", "to=2026-13-01", "date=soon", "from=2026-03-10&to=2026-03-01"} {
+		if _, err := requestRange(httptest.NewRequest("GET", "/energy?"+q, nil), tz, now, 7); err == nil {
+			t.Errorf("%s: expected an error", q)
+		}
+	}
+}
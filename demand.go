@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultDemandWindow = 15  // minutes
+	demandAlertFraction = 0.9 // alert when the current window reaches this share of the month's peak
+)
+
+// DemandWindow is the average grid import over a rolling demand window.
+type DemandWindow struct {
+	Start  int64   `json:"start"`
+	End    int64   `json:"end"`
+	Demand float64 `json:"demand"`
+}
+
+// DemandPeak is the highest demand window seen in a billing month.
+type DemandPeak struct {
+	Location string  `json:"location"`
+	Month    string  `json:"month"`
+	Minutes  int     `json:"minutes"`
+	Peak     float64 `json:"peak"`
+	PeakTime int64   `json:"peakTime"`
+	PeakDT   string  `json:"peakDT"`
+}
+
+// demandWindowMinutes is the tariff's demand window, 15 or 30 minutes.
+func demandWindowMinutes() int {
+	minutes := config().DemandWindow
+	if minutes != 15 && minutes != 30 {
+		return defaultDemandWindow
+	}
+	return minutes
+}
+
+// demandMonth is the billing month of dt in the location's timezone.
+func demandMonth(location string, dt int64) string {
+	return localTime(location, dt).Format("2006-01")
+}
+
+// rollingDemand averages grid import (exports count as zero) over every run of contiguous five minute intervals.
+func rollingDemand(in []StatsDisplayRecord, minutes int) []DemandWindow {
+	window := minutes / 5
+	windows := make([]DemandWindow, 0)
+	for i := window - 1; i < len(in); i++ {
+		first := in[i-window+1]
+		if in[i].DateTime-first.DateTime != int64(window-1)*300 {
+			continue
+		}
+		var total float64
+		ok := true
+		for _, r := range in[i-window+1 : i+1] {
+			if r.NumSiteSamples == 0 {
+				ok = false
+				break
+			}
+			if r.SiteAvg > 0 {
+				total += r.SiteAvg
+			}
+		}
+		if !ok {
+			continue
+		}
+		windows = append(windows, DemandWindow{Start: first.DateTime, End: in[i].DateTime + 300, Demand: total / float64(window)})
+	}
+	return windows
+}
+
+// closedDemandWindows is the windows that ended by now's last closed five minute interval; a
+// window reaching into the open one still has samples to come.
+func closedDemandWindows(windows []DemandWindow, now time.Time) []DemandWindow {
+	for len(windows) > 0 && windows[len(windows)-1].End > lastClosedFiveMin(now)+300 {
+		windows = windows[:len(windows)-1]
+	}
+	return windows
+}
+
+// monthlyPeaks returns the highest window per billing month, oldest month first.
+func monthlyPeaks(location string, minutes int, windows []DemandWindow) []DemandPeak {
+	peaks := make([]DemandPeak, 0)
+	for _, w := range windows {
+		month := demandMonth(location, w.Start)
+		if len(peaks) == 0 || peaks[len(peaks)-1].Month != month {
+			peaks = append(peaks, DemandPeak{Location: location, Month: month, Minutes: minutes})
+		}
+		p := &peaks[len(peaks)-1]
+		if w.Demand > p.Peak {
+			p.Peak = w.Demand
+			p.PeakTime = w.Start
+			p.PeakDT = localTime(location, w.Start).Format("2006-01-02 15:04")
+		}
+	}
+	return peaks
+}
+
+const createDemandPeaksTable = `create table if not exists monthly_demand_peaks (
+	location varchar(16) not null,
+	month char(7) not null,
+	window_minutes int not null,
+	peak double not null,
+	peak_dt bigint not null,
+	primary key (location, month, window_minutes)
+)`
+
+// saveDemandPeak raises the stored peak for the month, recording a change in data_versions.
+func saveDemandPeak(p DemandPeak) error {
+	r, err := db.Exec(`insert into monthly_demand_peaks (location, month, window_minutes, peak, peak_dt) values (?, ?, ?, ?, ?)
+		on duplicate key update peak_dt = if(values(peak) > peak, values(peak_dt), peak_dt), peak = greatest(peak, values(peak))`,
+		p.Location, p.Month, p.Minutes, p.Peak, p.PeakTime)
+	if err != nil {
+		log.Error().Err(err).Msgf("saveDemandPeak(%+v)", p)
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil || n > 0 {
+		return touchDataVersion(p.Location)
+	}
+	return nil
+}
+
+// getDemandPeaks returns the stored monthly peaks for a location up to and including the month
+// through (2006-01), newest first.
+func getDemandPeaks(location string, minutes int, through string, limit int) ([]DemandPeak, error) {
+	log.Debug().Msgf("getDemandPeaks(%s, %d, %s, %d)", location, minutes, through, limit)
+	dbConnect()
+	rows, err := db.Query("select location, month, window_minutes, peak, peak_dt from monthly_demand_peaks "+
+		"where location = ? and window_minutes = ? and month <= ? order by month desc limit ?", location, minutes, through, limit)
+	if err != nil {
+		log.Error().Err(err).Msgf("getDemandPeaks(): %+v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	peaks := make([]DemandPeak, 0)
+	for rows.Next() {
+		var p DemandPeak
+		if err := rows.Scan(&p.Location, &p.Month, &p.Minutes, &p.Peak, &p.PeakTime); err != nil {
+			log.Error().Err(err).Msgf("getDemandPeaks(): %+v", err)
+			return peaks, err
+		}
+		p.PeakDT = localTime(p.Location, p.PeakTime).Format("2006-01-02 15:04")
+		peaks = append(peaks, p)
+	}
+	return peaks, rows.Err()
+}
+
+func getDemandPeak(location string, month string, minutes int) (DemandPeak, error) {
+	p := DemandPeak{Location: location, Month: month, Minutes: minutes}
+	row := db.QueryRow("select peak, peak_dt from monthly_demand_peaks where location = ? and month = ? and window_minutes = ?",
+		location, month, minutes)
+	if err := row.Scan(&p.Peak, &p.PeakTime); err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	return p, nil
+}
+
+// demandTracker keeps the monthly peaks up to date and warns before a new one is set.
+type demandTracker struct {
+	sink        AlertSink
+	minutes     int
+	lastAlerted map[string]int64
+}
+
+// checkLocation recomputes this month's windows, stores a new peak from the closed ones and
+// alerts if the latest window, closed or not, is close to it.
+func (t *demandTracker) checkLocation(location string, now time.Time) (DemandWindow, error) {
+	var current DemandWindow
+	now = now.In(locationTZ(location))
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	stored, err := getDemandPeak(location, demandMonth(location, now.Unix()), t.minutes)
+	if err != nil {
+		return current, err
+	}
+	recs, err := getFiveMinStats(location, monthStart.Unix(), now.Unix())
+	if err != nil {
+		return current, err
+	}
+	windows := rollingDemand(recs, t.minutes)
+	if len(windows) == 0 {
+		return current, nil
+	}
+	current = windows[len(windows)-1]
+
+	// the peak before the current window is what it has to beat
+	previous := stored
+	for _, p := range monthlyPeaks(location, t.minutes, windows[:len(windows)-1]) {
+		if p.Peak > previous.Peak {
+			previous = p
+		}
+	}
+	if previous.Peak > 0 && current.Demand >= previous.Peak*demandAlertFraction && t.lastAlerted[location] < current.Start {
+		verb := "is approaching"
+		if current.Demand > previous.Peak {
+			verb = "has set"
+		}
+		_ = t.sink.Send(Alert{
+			Location: location,
+			Kind:     "demand-peak",
+			AsOf:     time.Unix(current.End, 0),
+			Message: fmt.Sprintf("%s %d minute demand %.0fw %s a new monthly peak (previous %.0fw at %s)",
+				location, t.minutes, current.Demand, verb, previous.Peak, localTime(location, previous.PeakTime).Format("2006-01-02 15:04")),
+		})
+		t.lastAlerted[location] = current.End
+	}
+
+	for _, p := range monthlyPeaks(location, t.minutes, closedDemandWindows(windows, now)) {
+		if p.Peak > stored.Peak {
+			if err := saveDemandPeak(p); err != nil {
+				return current, err
+			}
+		}
+	}
+	return current, nil
+}
+
+func (t *demandTracker) run(interval time.Duration) {
+	dbConnect()
+	if _, err := db.Exec(createDemandPeaksTable); err != nil {
+		log.Error().Err(err).Msg("creating monthly_demand_peaks")
+		return
+	}
+	for {
+		for _, location := range registry.ids() {
+			current, err := t.checkLocation(location, time.Now())
+			if err != nil {
+				log.Error().Err(err).Msgf("demandTracker checkLocation(%s)", location)
+			}
+			log.Debug().Msgf("demandTracker: %s current demand %.0fw", location, current.Demand)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// startDemandTracker runs the tracker in the background when DEMAND_TRACKING is set.
+func startDemandTracker(sink AlertSink) {
+	if !config().DemandTracking {
+		log.Info().Msg("peak demand tracking disabled")
+		return
+	}
+	minutes := demandWindowMinutes()
+	log.Info().Msgf("starting %d minute peak demand tracking", minutes)
+	t := &demandTracker{sink: sink, minutes: minutes, lastAlerted: make(map[string]int64)}
+	go t.run(5 * time.Minute)
+}
+
+func demandAPIHandler(w http.ResponseWriter, r *http.Request) {
+	loc, ok := requestLocation(w, r)
+	if !ok {
+		return
+	}
+	location := loc.ID
+	minutes, err := intParam(r, "window", demandWindowMinutes(), 15, 30)
+	if err == nil && minutes != 15 && minutes != 30 {
+		err = fmt.Errorf("window: must be 15 or 30 minutes, got %d", minutes)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := rowsParam(r, "limit", 12)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	through := time.Now().In(loc.TZ()).Format("2006-01")
+	if t := r.URL.Query().Get("through"); t != "" {
+		if _, err := time.Parse("2006-01", t); err != nil {
+			http.Error(w, fmt.Sprintf("through: %q is not a month like 2006-01", t), http.StatusBadRequest)
+			return
+		}
+		through = t
+	}
+	peaks, err := getDemandPeaks(location, minutes, through, limit)
+	if err != nil {
+		s := fmt.Sprintf("%+v", err)
+		http.Error(w, s, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, peaks)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRollingDemand(t *testing.T) {
+	testInit()
+	start := time.Date(2026, 5, 31, 23, 45, 0, 0, time.Local)
+	site := []float64{1000, 2000, 3000, -500, 4000, 1000}
+	var recs []StatsDisplayRecord
+	for i, v := range site {
+		recs = append(recs, StatsDisplayRecord{DateTime: start.Add(time.Duration(i) * 5 * time.Minute).Unix(), SiteAvg: v, NumSiteSamples: 10})
+	}
+	// a gap breaks the window
+	recs = append(recs, StatsDisplayRecord{DateTime: start.Add(time.Hour).Unix(), SiteAvg: 9000, NumSiteSamples: 10})
+
+	windows := rollingDemand(recs, 15)
+	if len(windows) != 4 {
+		t.Fatalf("got %d windows, want 4: %+v", len(windows), windows)
+	}
+	if windows[0].Demand != 2000 || windows[1].Demand != 5000.0/3 {
+		t.Errorf("unexpected demand: %+v", windows)
+	}
+
+	// the last window's final interval is still open until 00:15
+	if got := closedDemandWindows(windows, start.Add(29*time.Minute)); len(got) != 3 {
+		t.Errorf("got %d closed windows at 00:14, want 3", len(got))
+	}
+	if got := closedDemandWindows(windows, start.Add(30*time.Minute)); len(got) != 4 {
+		t.Errorf("got %d closed windows at 00:15, want 4", len(got))
+	}
+
+	peaks := monthlyPeaks("VT", 15, windows)
+	if len(peaks) != 2 {
+		t.Fatalf("got %d peaks, want 2: %+v", len(peaks), peaks)
+	}
+	if peaks[0].Month != "2026-05" || peaks[0].PeakDT != "2026-05-31 23:55" || peaks[1].Month != "2026-06" {
+		t.Errorf("unexpected peaks: %+v", peaks)
+	}
+}
+
+func TestDemandMonthInLocationTimezone(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no tzdata")
+	}
+	registry.set([]LocationInfo{{ID: "VT", TimeLocation: ny}})
+	defer registry.set(nil)
+
+	// still March 31st in New York
+	start := time.Date(2026, 4, 1, 3, 30, 0, 0, time.UTC).Unix()
+	peaks := monthlyPeaks("VT", 15, []DemandWindow{{Start: start, End: start + 900, Demand: 3000}})
+	if len(peaks) != 1 || peaks[0].Month != "2026-03" || peaks[0].PeakDT != "2026-03-31 23:30" {
+		t.Errorf("unexpected peaks: %+v", peaks)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+var statsCSVHeader = []string{"location", "datetime", "dt",
+	"site_avg", "site_imported", "site_exported", "load_avg", "load_imported",
+	"battery_avg", "battery_imported", "battery_exported", "solar_avg", "solar_exported",
+	"num_site_samples", "num_load_samples", "num_battery_samples", "num_solar_samples"}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// writeStatsCSV writes the headline columns of stats records as CSV.
+func writeStatsCSV(w io.Writer, recs []StatsDisplayRecord) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(statsCSVHeader); err != nil {
+		return err
+	}
+	for _, r := range recs {
+		row := []string{r.Location, strconv.FormatInt(r.DateTime, 10), r.DT,
+			formatFloat(r.SiteAvg), formatFloat(r.SiteImported), formatFloat(r.SiteExported), formatFloat(r.LoadAvg), formatFloat(r.LoadImported),
+			formatFloat(r.BatteryAvg), formatFloat(r.BatteryImported), formatFloat(r.BatteryExported), formatFloat(r.SolarAvg), formatFloat(r.SolarExported),
+			strconv.Itoa(r.NumSiteSamples), strconv.Itoa(r.NumLoadSamples), strconv.Itoa(r.NumBatterySamples), strconv.Itoa(r.NumSolarSamples)}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeBatteryCSV writes battery charge records as CSV.
+func writeBatteryCSV(w io.Writer, recs []BatteryPctDisplayRecord) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"location", "datetime", "dt", "avg_pct", "low_pct", "hi_pct", "num_samples"}); err != nil {
+		return err
+	}
+	for _, r := range recs {
+		row := []string{r.Location, strconv.FormatInt(r.DateTime, 10), r.DT,
+			formatFloat(r.AvgPct), formatFloat(r.LowPct), formatFloat(r.HiPct), strconv.Itoa(r.NumSamples)}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// export writes a location's rollups for p to w. table is day, five-min or battery; format is csv or json.
+func export(w io.Writer, location string, p Period, table string, format string) error {
+	if format != "csv" && format != "json" {
+		return fmt.Errorf("unknown format %q, want csv or json", format)
+	}
+	var recs interface{}
+	var err error
+	switch table {
+	case "day":
+		recs, err = getDayStatsRange(location, p.Begin.Unix(), p.End.Unix())
+	case "five-min":
+		recs, err = getFiveMinStats(location, p.Begin.Unix(), p.End.Unix()-1)
+	case "battery":
+		recs, err = getFiveMinBattery(location, p.Begin.Unix(), p.End.Unix()-1)
+	default:
+		return fmt.Errorf("unknown table %q, want day, five-min or battery", table)
+	}
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(recs)
+	}
+	switch recs := recs.(type) {
+	case []StatsDisplayRecord:
+		return writeStatsCSV(w, recs)
+	case []BatteryPctDisplayRecord:
+		return writeBatteryCSV(w, recs)
+	}
+	return nil
+}
+
+// writeReport prints a plain text summary of a location over p.
+func writeReport(w io.Writer, loc LocationInfo, p Period) error {
+	daily, err := getDayStatsRange(loc.ID, p.Begin.Unix(), p.End.Unix())
+	if err != nil {
+		return err
+	}
+	t := periodTotals(p, daily)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s (%s)\t%s - %s, %d days\n", loc.Name, loc.ID, t.Begin, t.End, t.Days)
+	fmt.Fprintf(tw, "Production\t%.1f kWh\n", t.Production/1000)
+	fmt.Fprintf(tw, "Consumption\t%.1f kWh\n", t.Consumption/1000)
+	fmt.Fprintf(tw, "Grid import\t%.1f kWh\n", t.GridImport/1000)
+	fmt.Fprintf(tw, "Grid export\t%.1f kWh\n", t.GridExport/1000)
+	fmt.Fprintf(tw, "Battery throughput\t%.1f kWh\n", t.BatteryThroughput/1000)
+	if t.Consumption > 0 {
+		fmt.Fprintf(tw, "Self-sufficiency\t%.0f%%\n", 100*(1-t.GridImport/t.Consumption))
+	}
+	fmt.Fprintf(tw, "Grid cost\t%.2f (at %.3f/kWh)\n", t.GridImport/1000*loc.Price(), loc.Price())
+
+	minutes := demandWindowMinutes()
+	first := time.Date(p.Begin.Year(), p.Begin.Month(), 1, 0, 0, 0, 0, p.Begin.Location())
+	for m := first; m.Before(p.End); m = m.AddDate(0, 1, 0) {
+		peak, err := getDemandPeak(loc.ID, m.Format("2006-01"), minutes)
+		if err != nil {
+			return err
+		}
+		if peak.Peak > 0 {
+			fmt.Fprintf(tw, "Peak demand %s\t%.0fw (%d min) at %s\n", peak.Month, peak.Peak, minutes,
+				localTime(loc.ID, peak.PeakTime).Format("2006-01-02 15:04"))
+		}
+	}
+
+	if profile := carbonProfile(); profile != nil {
+		hourly, err := getHourlyEnergy(loc.ID, p.Begin.Unix(), p.End.Unix()-1)
+		if err != nil {
+			return err
+		}
+		if c := carbonByPeriod(hourly, profile, loc.TZ(), ""); len(c) > 0 {
+			fmt.Fprintf(tw, "Grid CO2\t%.1f kg\n", c[0].GridKg)
+			fmt.Fprintf(tw, "Avoided CO2\t%.1f kg\n", c[0].AvoidedSelfKg+c[0].AvoidedExportKg)
+		}
+	}
+	return tw.Flush()
+}
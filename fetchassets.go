@@ -0,0 +1,77 @@
+//go:build ignore
+
+// fetchassets downloads the pinned Highcharts build into assets/vendor, which go:embed builds
+// into the binary. Run it with go generate after changing the version or the modules and commit
+// what it writes. Files that are already there are kept unless -f is given, so the Docker
+// build's go generate only fetches what isn't checked in.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const highchartsVersion = "11.4.8"
+
+// vendored are the Highcharts files the pages use, by path under assets/vendor/highcharts.
+var vendored = []string{
+	"highstock.js",
+	"highcharts-more.js",
+	"modules/annotations-advanced.js",
+	"modules/boost.js",
+	"modules/data.js",
+	"modules/drag-panes.js",
+	"modules/draggable-points.js",
+	"modules/export-data.js",
+	"modules/exporting.js",
+	"modules/full-screen.js",
+	"modules/offline-exporting.js",
+	"modules/price-indicator.js",
+}
+
+func main() {
+	force := flag.Bool("f", false, "download files that are already vendored")
+	flag.Parse()
+	for _, path := range vendored {
+		dest := filepath.Join("assets", "vendor", "highcharts", filepath.FromSlash(path))
+		if _, err := os.Stat(dest); err == nil && !*force {
+			continue
+		}
+		url := fmt.Sprintf("https://code.highcharts.com/%s/%s", highchartsVersion, path)
+		if path == "highstock.js" {
+			url = fmt.Sprintf("https://code.highcharts.com/stock/%s/%s", highchartsVersion, path)
+		}
+		if err := fetch(url, dest); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(dest)
+	}
+}
+
+func fetch(url string, dest string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
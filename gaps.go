@@ -0,0 +1,173 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const maxChartFill = 24 * time.Hour // longer gaps are always left empty
+
+// chartFills are the ways a chart can fill gaps; "" leaves them empty.
+var chartFills = map[string]bool{"": true, "linear": true, "profile": true}
+
+// chartPoint is one point of a chart series, x in ms. Null points break the line; Filled
+// points were interpolated into a gap.
+type chartPoint struct {
+	X      int64
+	Y      float64
+	Null   bool
+	Filled bool
+}
+
+// chartGaps is how chart series treat missing data: points more than Gap ms apart have a gap
+// between them, which is broken with a null point or, with Fill, interpolated.
+type chartGaps struct {
+	Gap  int64
+	Fill string
+}
+
+// requestChartGaps is the configured gap handling, with the fill overridden by a fill param
+// of none, linear or profile.
+func requestChartGaps(r *http.Request) chartGaps {
+	g := chartGaps{Gap: int64(config().ChartGap) * 60 * 1000, Fill: config().ChartFill}
+	if fill := r.URL.Query().Get("fill"); fill == "none" {
+		g.Fill = ""
+	} else if chartFills[fill] && fill != "" {
+		g.Fill = fill
+	}
+	return g
+}
+
+// FillNote describes how the charts' dotted stretches were filled in, or is empty.
+func (g chartGaps) FillNote() string {
+	switch g.Fill {
+	case "linear":
+		return "dotted lines are interpolated across gaps in the data"
+	case "profile":
+		return "dotted lines fill gaps in the data with the day before"
+	}
+	return ""
+}
+
+// chartStep is the usual spacing of points, so a few gaps don't skew it.
+func chartStep(points []chartPoint) int64 {
+	steps := make([]int64, 0, len(points))
+	for i := 1; i < len(points); i++ {
+		steps = append(steps, points[i].X-points[i-1].X)
+	}
+	if len(steps) == 0 {
+		return 0
+	}
+	sort.Slice(steps, func(i, j int) bool { return steps[i] < steps[j] })
+	return steps[len(steps)/2]
+}
+
+// valueAt finds the y of the point within tolerance of x in points sorted by x.
+func valueAt(points []chartPoint, x int64, tolerance int64) (float64, bool) {
+	i := sort.Search(len(points), func(i int) bool { return points[i].X >= x-tolerance })
+	if i < len(points) && points[i].X <= x+tolerance && !points[i].Null {
+		return points[i].Y, true
+	}
+	return 0, false
+}
+
+// fillGaps breaks or fills the gaps in points, which are sorted by x.
+func fillGaps(points []chartPoint, g chartGaps) []chartPoint {
+	if g.Gap <= 0 || len(points) < 2 {
+		return points
+	}
+	step := chartStep(points)
+	out := make([]chartPoint, 0, len(points))
+	day := int64(24 * time.Hour / time.Millisecond)
+	for i, p := range points {
+		if i == 0 {
+			out = append(out, p)
+			continue
+		}
+		prev := points[i-1]
+		span := p.X - prev.X
+		if span <= g.Gap {
+			out = append(out, p)
+			continue
+		}
+		if g.Fill == "" || step <= 0 || span > int64(maxChartFill/time.Millisecond) {
+			out = append(out, chartPoint{X: prev.X + span/2, Null: true}, p)
+			continue
+		}
+		for x := prev.X + step; x < p.X; x += step {
+			y, ok := 0.0, false
+			if g.Fill == "profile" {
+				y, ok = valueAt(points, x-day, step/2)
+			}
+			if !ok {
+				y = prev.Y + (p.Y-prev.Y)*float64(x-prev.X)/float64(span)
+			}
+			out = append(out, chartPoint{X: x, Y: y, Filled: true})
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// MarshalJSON encodes the point as a Highcharts [x, y] pair, with a null y for breaks and
+// for values that aren't numbers, such as the average of no samples.
+func (p chartPoint) MarshalJSON() ([]byte, error) {
+	b := append(strconv.AppendInt([]byte("["), p.X, 10), ',')
+	if p.Null {
+		return append(b, "null]"...), nil
+	}
+	return append(appendChartNumber(b, p.Y), ']'), nil
+}
+
+// chartXY is a point of a scatter series, where x isn't a time.
+type chartXY struct {
+	X float64
+	Y float64
+}
+
+// MarshalJSON encodes the point as a Highcharts [x, y] pair, with null for values that aren't
+// numbers.
+func (p chartXY) MarshalJSON() ([]byte, error) {
+	b := appendChartNumber([]byte("["), p.X)
+	return append(appendChartNumber(append(b, ','), p.Y), ']'), nil
+}
+
+func appendChartNumber(b []byte, f float64) []byte {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return append(b, "null"...)
+	}
+	return strconv.AppendFloat(b, f, 'f', -1, 64)
+}
+
+// chartZone is a Highcharts series zone: the style of the series up to Value, or after the
+// last zone when Value is 0.
+type chartZone struct {
+	Value     int64  `json:"value,omitempty"`
+	DashStyle string `json:"dashStyle,omitempty"`
+}
+
+// fillZones is the x axis zones that draw the filled stretches of points dotted.
+func fillZones(points []chartPoint) []chartZone {
+	zones := make([]chartZone, 0)
+	for i := 0; i < len(points); i++ {
+		if !points[i].Filled {
+			continue
+		}
+		begin := points[i].X
+		if i > 0 {
+			begin = points[i-1].X
+		}
+		for i < len(points) && points[i].Filled {
+			i++
+		}
+		end := points[len(points)-1].X
+		if i < len(points) {
+			end = points[i].X
+		}
+		zones = append(zones, chartZone{Value: begin}, chartZone{Value: end, DashStyle: "ShortDot"})
+	}
+	return append(zones, chartZone{})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func fiveMinPoints(ys ...float64) []chartPoint {
+	points := make([]chartPoint, 0, len(ys))
+	for i, y := range ys {
+		if y < 0 {
+			continue // missing
+		}
+		points = append(points, chartPoint{X: int64(i) * 300000, Y: y})
+	}
+	return points
+}
+
+func TestFillGapsBreaks(t *testing.T) {
+	points := fiveMinPoints(1, 2, -1, -1, -1, -1, 7, 8)
+	got := fillGaps(points, chartGaps{Gap: 15 * 60000})
+	if len(got) != len(points)+1 || !got[2].Null || got[2].X != 300000+750000 {
+		t.Fatalf("got %+v", got)
+	}
+	if b, _ := json.Marshal(got); !strings.Contains(string(b), "[1050000,null],") {
+		t.Errorf("series data %s has no null", b)
+	}
+	// a short dropout is drawn straight through
+	if got := fillGaps(fiveMinPoints(1, -1, 3), chartGaps{Gap: 15 * 60000}); len(got) != 2 {
+		t.Errorf("got %+v", got)
+	}
+	if got := fillGaps(points, chartGaps{}); len(got) != len(points) {
+		t.Errorf("gap 0 should leave the points alone, got %+v", got)
+	}
+}
+
+func TestFillGapsLinear(t *testing.T) {
+	points := fiveMinPoints(1, 2, -1, -1, -1, -1, 7, 8)
+	got := fillGaps(points, chartGaps{Gap: 15 * 60000, Fill: "linear"})
+	if len(got) != 8 {
+		t.Fatalf("got %+v", got)
+	}
+	for i := 2; i < 6; i++ {
+		if !got[i].Filled || got[i].Y != float64(i+1) {
+			t.Errorf("point %d = %+v, want filled %d", i, got[i], i+1)
+		}
+	}
+	if got[6].Filled || got[6].Y != 7 {
+		t.Errorf("point 6 = %+v", got[6])
+	}
+	if z, _ := json.Marshal(fillZones(got)); string(z) != `[{"value":300000},{"value":1800000,"dashStyle":"ShortDot"},{}]` {
+		t.Errorf("zones = %s", z)
+	}
+}
+
+func TestFillGapsProfile(t *testing.T) {
+	ys := make([]float64, 288+10)
+	for i := range ys {
+		ys[i] = float64(i % 288)
+	}
+	for i := 288 + 3; i < 288+7; i++ {
+		ys[i] = -1
+	}
+	got := fillGaps(fiveMinPoints(ys...), chartGaps{Gap: 15 * 60000, Fill: "profile"})
+	for _, p := range got {
+		i := p.X / 300000
+		if i >= 288+3 && i < 288+7 && (!p.Filled || p.Y != float64(i-288)) {
+			t.Errorf("point %d = %+v, want the day before", i, p)
+		}
+	}
+	// with nothing the day before it falls back to linear
+	got = fillGaps(fiveMinPoints(1, 2, -1, -1, -1, -1, 7, 8), chartGaps{Gap: 15 * 60000, Fill: "profile"})
+	if got[3].Y != 4 {
+		t.Errorf("got %+v", got)
+	}
+}
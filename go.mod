@@ -3,8 +3,17 @@ module hello-run
 go 1.19
 
 require (
+	github.com/andybalholm/brotli v1.0.5
+	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/go-sql-driver/mysql v1.6.0
 	github.com/rs/zerolog v1.26.1
+	golang.org/x/crypto v0.0.0-20211215165025-cf75a172585e
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require github.com/pkg/errors v0.9.1 // indirect
+require (
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	golang.org/x/net v0.8.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+)
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// assetURL is an asset URL in a page, with its hash if the asset is built in.
+var assetURL = regexp.MustCompile(`(/assets/[^"?]+)(\?v=[0-9a-f]{12})?"`)
+
+// golden compares got with testdata/name, or rewrites it with -update. Asset hashes in pages are
+// replaced with a placeholder, so the pages don't change with every asset update; TestAsset
+// checks the hashes.
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	if filepath.Ext(name) == ".html" {
+		got = assetURL.ReplaceAll(got, []byte(`$1?v=hash"`))
+	}
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v; run go test -update to create it", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden file; run go test -update and check the diff\n%s", name, got)
+	}
+}
+
+// goldenStats is an hour of five minute stats with a gap and a bucket with no battery samples.
+func goldenStats() []StatsDisplayRecord {
+	start := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC).Unix()
+	recs := make([]StatsDisplayRecord, 0)
+	for i := int64(0); i < 12; i++ {
+		if i >= 4 && i < 8 {
+			continue
+		}
+		r := StatsDisplayRecord{Location: "T", DateTime: start + i*300, SolarAvg: 1000 + float64(i)*10.25, LoadAvg: 600, SiteAvg: -400 - float64(i)*10.25, BatteryAvg: 0}
+		if i == 9 {
+			r.BatteryAvg = math.NaN()
+		}
+		recs = append(recs, r)
+	}
+	return recs
+}
+
+func TestChartDataGolden(t *testing.T) {
+	gaps := chartGaps{Gap: 15 * 60000}
+	data := ChartData{Location: "T", Tier: "five-min", From: 1710072000000, To: 1710075600000}
+	data.Solar, data.Load, data.Grid, data.Battery, data.Zones = statsChartData(goldenStats(), gaps)
+	pct := []BatteryPctDisplayRecord{{DateTime: 1710072000, AvgPct: 80}, {DateTime: 1710072300, AvgPct: math.Inf(1)}, {DateTime: 1710072600, AvgPct: 79.5},
+		{DateTime: 1710073600, AvgPct: 78.5}, {DateTime: 1710073900, AvgPct: 78}}
+	data.BatteryPct, data.BatteryPctZones = batteryChartData(pct, chartGaps{Gap: gaps.Gap, Fill: "linear"})
+	got, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "chart.json", append(got, '\n'))
+}
+
+func TestDashboardGolden(t *testing.T) {
+	tmpl := parseTemplate("dashboard.html")
+	stats := TopStats{
+		Location: "T",
+		Info:     LocationInfo{ID: "T", Name: "Test <Home>", TimeLocation: time.UTC, PVSize: 7.5},
+		Gaps:     chartGaps{Gap: 15 * 60000, Fill: "linear"},
+		Limit:    7,
+		Range:    newDateRange(time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 12, 0, 0, 0, 0, time.UTC)),
+	}
+	stats.ViewBegin, stats.ViewEnd = 1710028800000, 1710115200000
+	stats.ProducedGraphData, stats.ConsumedGraphData, stats.SiteGraphData, stats.BatteryGraphData, stats.FillZones = statsChartData(goldenStats(), stats.Gaps)
+	stats.BatteryPctGraphData, stats.BatteryPctFillZones = batteryChartData([]BatteryPctDisplayRecord{{DateTime: 1710072000, AvgPct: 80}}, stats.Gaps)
+	stats.AnomalyAnnotations = anomalyAnnotations([]LoadAnomaly{{DateTime: 1710072900, LoadAvg: 1600, Expected: 425}})
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, stats); err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "dashboard.html", b.Bytes())
+}
+
+func TestLiveGolden(t *testing.T) {
+	tmpl := parseTemplate("live.html")
+	data := templateData{
+		Service:      "live service",
+		Revision:     "0.1",
+		MQTTSubTopic: "home/T/#",
+		LiveLimit:    2000,
+		MQTT:         MQTTConfig{Broker: "msg.example.com", Port: 8083, Path: "/mqtt", UseSSL: true},
+		Location:     "T",
+		Info:         LocationInfo{ID: "T", Name: "Test", TimeLocation: time.UTC},
+		Gaps:         chartGaps{Gap: 15 * 60000},
+	}
+	recs := make([]EnergyDisplayRecord, 0)
+	for i := 0; i < 5; i++ {
+		recs = append(recs, EnergyDisplayRecord{AsOf: time.UnixMilli(1710072000000 + int64(i)*3000), Site: -400.5, Load: 600, Battery: 0, Solar: 1000.5})
+	}
+	data.SolarData, data.LoadData, data.SiteData, data.BatteryData, data.FillZones = liveChartData(recs, data.Gaps)
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "live.html", b.Bytes())
+}
@@ -0,0 +1,674 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// historyFormats are the import kinds for energy history exports, with the power unit their
+// columns use when the header doesn't say.
+var historyFormats = map[string]string{
+	"tesla":       "kw", // Tesla app "Download My Data": Date time,Home (kW),Powerwall (kW),Solar (kW),Grid (kW)
+	"pypowerwall": "w",  // pypowerwall / TEG logs: timestamp,grid,home,solar,battery,batterylevel
+}
+
+// historyMeters maps export column names onto meters.
+var historyMeters = map[string]int{
+	"grid": meterSite, "site": meterSite,
+	"home": meterLoad, "load": meterLoad,
+	"powerwall": meterBattery, "battery": meterBattery,
+	"solar": meterSolar, "solar energy": meterSolar, "solar generation": meterSolar,
+}
+
+// historyFlows maps the Tesla app's directional energy columns onto a meter counter.
+var historyFlows = map[string]struct {
+	meter    int
+	imported bool
+}{
+	"from grid": {meterSite, true}, "grid import": {meterSite, true},
+	"to grid": {meterSite, false}, "grid export": {meterSite, false},
+	"to powerwall": {meterBattery, true}, "battery charge": {meterBattery, true},
+	"from powerwall": {meterBattery, false}, "battery discharge": {meterBattery, false},
+}
+
+var historyPercentColumns = map[string]bool{
+	"state of charge": true, "soe": true, "percentage": true, "batterylevel": true, "battery level": true, "battery_level": true,
+}
+
+var historyTimeColumns = map[string]bool{"date time": true, "datetime": true, "timestamp": true, "time": true, "date": true}
+
+// historyColumn is what one export column holds.
+type historyColumn struct {
+	kind     string // time, percent, power, energy or flow
+	meter    int
+	imported bool
+	scale    float64 // to W or Wh
+}
+
+// parseHistoryColumn works out a header cell like "Solar (kW)" or "batterylevel"; ok is false for
+// columns the import doesn't use, like the app's Vehicle column.
+func parseHistoryColumn(header string, powerUnit string) (historyColumn, bool) {
+	name := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(header, "\ufeff")))
+	unit := ""
+	if i := strings.Index(name, "("); i >= 0 && strings.HasSuffix(name, ")") {
+		name, unit = strings.TrimSpace(name[:i]), strings.TrimSpace(name[i+1:len(name)-1])
+	}
+	if unit == "" {
+		unit = powerUnit
+	}
+	scale := 1.0
+	if strings.HasPrefix(unit, "k") {
+		scale = 1000
+	}
+	switch {
+	case historyTimeColumns[name]:
+		return historyColumn{kind: "time"}, true
+	case historyPercentColumns[name] || (unit == "%" && historyMeters[name] == meterBattery):
+		return historyColumn{kind: "percent"}, true
+	}
+	if f, ok := historyFlows[name]; ok {
+		return historyColumn{kind: "flow", meter: f.meter, imported: f.imported, scale: scale}, true
+	}
+	m, ok := historyMeters[name]
+	if !ok {
+		return historyColumn{}, false
+	}
+	switch unit {
+	case "kwh", "wh":
+		return historyColumn{kind: "energy", meter: m, scale: scale}, true
+	case "kw", "w":
+		return historyColumn{kind: "power", meter: m, scale: scale}, true
+	}
+	return historyColumn{}, false
+}
+
+// splitEnergy divides a meter's net energy into its imported and exported counters, with the
+// collector's signs: the site and load import when positive, the battery and solar export.
+func splitEnergy(meter int, wh float64) (imported float64, exported float64) {
+	if meter == meterBattery || meter == meterSolar {
+		wh = -wh
+	}
+	if wh >= 0 {
+		return wh, 0
+	}
+	return 0, -wh
+}
+
+// historyRow is one row of an export. Power rows carry instant or average power; energy rows
+// carry the energy of the interval ending with the row.
+type historyRow struct {
+	DateTime   int64
+	Power      [4]float64
+	Imported   [4]float64
+	Exported   [4]float64
+	Percent    float64
+	HasPercent bool
+}
+
+// HistorySeries is a parsed export, oldest row first.
+type HistorySeries struct {
+	Energy     bool  // rows are energy per interval rather than power
+	HasPower   bool  // there is at least one power or energy column
+	Interval   int64 // seconds between rows
+	Rows       []historyRow
+	Duplicates int        // rows dropped because an earlier one had the same time
+	Gaps       [][2]int64 // missing stretches, as the rows either side
+}
+
+// parseHistoryCSV reads a Tesla app or pypowerwall export. Times without a zone are in tz.
+func parseHistoryCSV(in io.Reader, tz *time.Location, powerUnit string) (HistorySeries, error) {
+	var series HistorySeries
+	r := csv.NewReader(in)
+	r.TrimLeadingSpace = true
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return series, fmt.Errorf("reading header: %w", err)
+	}
+	cols := make([]historyColumn, len(header))
+	used := make([]bool, len(header))
+	timeCol := -1
+	var flows [4]bool
+	for i, h := range header {
+		cols[i], used[i] = parseHistoryColumn(h, powerUnit)
+		switch cols[i].kind {
+		case "time":
+			timeCol = i
+		case "energy", "flow":
+			series.Energy = true
+			series.HasPower = true
+			if cols[i].kind == "flow" {
+				flows[cols[i].meter] = true
+			}
+		case "power":
+			series.HasPower = true
+		}
+	}
+	if timeCol < 0 {
+		return series, fmt.Errorf("no time column in %q", strings.Join(header, ","))
+	}
+
+	rows := make([]historyRow, 0)
+	for line := 2; ; line++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return series, fmt.Errorf("line %d: %w", line, err)
+		}
+		if timeCol >= len(rec) || strings.TrimSpace(rec[timeCol]) == "" {
+			continue
+		}
+		var row historyRow
+		if row.DateTime, err = parseTimestamp(rec[timeCol], tz); err != nil {
+			return series, fmt.Errorf("line %d: %w", line, err)
+		}
+		for i, v := range rec {
+			v = strings.TrimSpace(v)
+			if i >= len(cols) || !used[i] || i == timeCol || v == "" {
+				continue
+			}
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return series, fmt.Errorf("line %d: %s: %w", line, header[i], err)
+			}
+			c := cols[i]
+			switch c.kind {
+			case "percent":
+				row.Percent, row.HasPercent = f, true
+			case "power":
+				row.Power[c.meter] = f * c.scale
+			case "flow":
+				if c.imported {
+					row.Imported[c.meter] += f * c.scale
+				} else {
+					row.Exported[c.meter] += f * c.scale
+				}
+			case "energy":
+				// a net column only counts when the app doesn't also give the flows
+				if !flows[c.meter] {
+					imp, exp := splitEnergy(c.meter, f*c.scale)
+					row.Imported[c.meter] += imp
+					row.Exported[c.meter] += exp
+				}
+			}
+		}
+		rows = append(rows, row)
+	}
+	series.add(rows)
+	return series, nil
+}
+
+// add merges more rows into the series, e.g. from the next file, keeping the first row for any
+// time already seen, and recomputes the interval and gaps.
+func (s *HistorySeries) add(rows []historyRow) {
+	all := append(s.Rows, rows...)
+	sort.SliceStable(all, func(i, j int) bool { return all[i].DateTime < all[j].DateTime })
+	s.Rows = all[:0]
+	for _, r := range all {
+		if len(s.Rows) > 0 && s.Rows[len(s.Rows)-1].DateTime == r.DateTime {
+			s.Duplicates++
+			continue
+		}
+		s.Rows = append(s.Rows, r)
+	}
+
+	// the interval is the usual spacing, so a few gaps don't skew it
+	steps := make([]int64, 0, len(s.Rows))
+	for i := 1; i < len(s.Rows); i++ {
+		steps = append(steps, s.Rows[i].DateTime-s.Rows[i-1].DateTime)
+	}
+	sort.Slice(steps, func(i, j int) bool { return steps[i] < steps[j] })
+	s.Interval = 300
+	if len(steps) > 0 {
+		s.Interval = steps[len(steps)/2]
+	}
+	s.Gaps = nil
+	for i := 1; i < len(s.Rows); i++ {
+		if s.Rows[i].DateTime-s.Rows[i-1].DateTime > s.maxStep() {
+			s.Gaps = append(s.Gaps, [2]int64{s.Rows[i-1].DateTime, s.Rows[i].DateTime})
+		}
+	}
+}
+
+// maxStep is the longest spacing between rows that isn't a gap. Daily rows vary by an hour
+// across DST changes.
+func (s *HistorySeries) maxStep() int64 {
+	if s.Interval >= 86400 {
+		return s.Interval + 3600
+	}
+	return s.Interval * 3 / 2
+}
+
+// daily is whether the rows are a day or more apart, too coarse for five minute rollups.
+func (s *HistorySeries) daily() bool {
+	return s.Interval >= 82800
+}
+
+// fiveMinute spreads rows further apart than five minutes, like the Tesla app's 15 minute ones,
+// across the five minute steps of the interval before each, so every bucket they cover gets a
+// rollup and the baseload and demand windows see consecutive buckets. Power rows repeat their
+// power, energy rows split their energy evenly and state of charge stays on the row it was read at.
+func (s *HistorySeries) fiveMinute() HistorySeries {
+	steps := s.Interval / 300
+	if s.daily() || steps < 2 {
+		return *s
+	}
+	spread := *s
+	spread.Interval = 300
+	spread.Rows = make([]historyRow, 0, len(s.Rows)*int(steps))
+	for i, r := range s.Rows {
+		n := steps
+		// a row closer to the one before than the usual interval covers less
+		if i > 0 && (r.DateTime-s.Rows[i-1].DateTime)/300 < n {
+			n = (r.DateTime - s.Rows[i-1].DateTime) / 300
+		}
+		if n < 1 {
+			n = 1
+		}
+		for k := n - 1; k >= 0; k-- {
+			sub := r
+			sub.DateTime = r.DateTime - k*300
+			for m := range sub.Imported {
+				sub.Imported[m] /= float64(n)
+				sub.Exported[m] /= float64(n)
+			}
+			sub.HasPercent = r.HasPercent && k == 0
+			spread.Rows = append(spread.Rows, sub)
+		}
+	}
+	return spread
+}
+
+// powerSamples turns the rows into collector style samples whose lifetime counters start at
+// zero. Power rows are integrated over the interval before them, but not across gaps; energy
+// rows give their average power over the interval.
+func (s *HistorySeries) powerSamples() []PowerSample {
+	samples := make([]PowerSample, 0, len(s.Rows))
+	var imported, exported [4]float64
+	for i, r := range s.Rows {
+		step := s.Interval
+		if i > 0 && r.DateTime-s.Rows[i-1].DateTime < step {
+			step = r.DateTime - s.Rows[i-1].DateTime
+		}
+		hours := float64(step) / 3600
+		p := PowerSample{DateTime: r.DateTime, Power: r.Power}
+		for m := meterSite; m <= meterSolar; m++ {
+			if s.Energy {
+				imported[m] += r.Imported[m]
+				exported[m] += r.Exported[m]
+				imp, exp := r.Imported[m], r.Exported[m]
+				if m == meterBattery || m == meterSolar {
+					imp, exp = exp, imp
+				}
+				p.Power[m] = (imp - exp) / (float64(s.Interval) / 3600)
+				continue
+			}
+			imp, exp := splitEnergy(m, r.Power[m]*hours)
+			imported[m] += imp
+			exported[m] += exp
+		}
+		p.Imported, p.Exported = imported, exported
+		samples = append(samples, p)
+	}
+	return samples
+}
+
+// percentSamples is the battery state of charge rows.
+func (s *HistorySeries) percentSamples() []PercentSample {
+	samples := make([]PercentSample, 0)
+	for _, r := range s.Rows {
+		if r.HasPercent {
+			samples = append(samples, PercentSample{DateTime: r.DateTime, Percent: r.Percent})
+		}
+	}
+	return samples
+}
+
+// HistoryImport reports what an import did.
+type HistoryImport struct {
+	Rows       int
+	First      int64
+	Last       int64
+	Interval   int64
+	Duplicates int
+	Gaps       [][2]int64
+	Covered    int // five minute buckets or days skipped because the collector has samples for them
+	Replaced   int // buckets an earlier import had already written
+	FiveMin    int
+	Days       int
+	Samples    int
+}
+
+// historyTopic marks energy and battery rows written by an import, so they can be told apart
+// from the collector's and replaced by the next import.
+func historyTopic(location string, format string) string {
+	return "import/" + format + "/" + strings.ToLower(location)
+}
+
+// collectorBuckets is the five minute buckets from begin up to end that have collector samples.
+func collectorBuckets(location string, begin int64, end int64) (map[int64]bool, error) {
+	rows, err := db.Query(`select distinct floor(unix_timestamp(dt) / 300) * 300 from energy
+			where location = ? and dt >= from_unixtime(?) and dt < from_unixtime(?) and topic not like 'import/%'
+		union select distinct floor(unix_timestamp(dt) / 300) * 300 from battery
+			where location = ? and dt >= from_unixtime(?) and dt < from_unixtime(?) and topic not like 'import/%'`,
+		location, begin, end, location, begin, end)
+	if err != nil {
+		log.Error().Err(err).Msgf("collectorBuckets(%s): %+v", location, err)
+		return nil, err
+	}
+	defer rows.Close()
+	buckets := make(map[int64]bool)
+	for rows.Next() {
+		var b float64
+		if err := rows.Scan(&b); err != nil {
+			return buckets, err
+		}
+		buckets[int64(b)] = true
+	}
+	return buckets, rows.Err()
+}
+
+// existingBuckets is the datetimes table already has for location from begin up to end.
+func existingBuckets(table string, location string, begin int64, end int64) (map[int64]bool, error) {
+	rows, err := db.Query("select datetime from "+table+" where location = ? and datetime >= ? and datetime < ?", location, begin, end)
+	if err != nil {
+		log.Error().Err(err).Msgf("existingBuckets(%s, %s): %+v", table, location, err)
+		return nil, err
+	}
+	defer rows.Close()
+	buckets := make(map[int64]bool)
+	for rows.Next() {
+		var b int64
+		if err := rows.Scan(&b); err != nil {
+			return buckets, err
+		}
+		buckets[b] = true
+	}
+	return buckets, rows.Err()
+}
+
+// importHistory stores a parsed export for location, either as energy and battery samples for
+// the rollup to process or straight into the rollups. Anything the collector already has
+// samples for is kept and reported as covered; anything an earlier import wrote is replaced,
+// so importing the same file twice changes nothing.
+func importHistory(location string, format string, s HistorySeries, intoSamples bool) (HistoryImport, error) {
+	res := HistoryImport{Rows: len(s.Rows), Interval: s.Interval, Duplicates: s.Duplicates, Gaps: s.Gaps}
+	if len(s.Rows) == 0 {
+		return res, nil
+	}
+	s = s.fiveMinute()
+	res.First, res.Last = s.Rows[0].DateTime, s.Rows[len(s.Rows)-1].DateTime
+	dbConnect()
+	days := dayBucket(location)
+	begin, end := days(res.First), dayStart(localTime(location, res.Last).AddDate(0, 0, 1)).Unix()
+	covered, err := collectorBuckets(location, begin, end)
+	if err != nil {
+		return res, err
+	}
+	coveredDays := make(map[int64]bool)
+	for b := range covered {
+		coveredDays[days(b)] = true
+	}
+	if intoSamples {
+		if s.daily() {
+			return res, fmt.Errorf("%s rows are too far apart to store as samples; import them into the rollups", time.Duration(s.Interval)*time.Second)
+		}
+		return res, importHistorySamples(location, format, s, coveredDays, &res)
+	}
+
+	if s.HasPower {
+		samples := s.powerSamples()
+		// the counters start at zero just before the first row, so it gets its own energy
+		prev := &PowerSample{DateTime: res.First - s.Interval}
+		if s.daily() {
+			recs := keepStats(rollupStats(location, prev, samples, days), coveredDays, &res.Covered)
+			if err := countReplaced("day_top_stats", location, recs, begin, end, &res.Replaced); err != nil {
+				return res, err
+			}
+			if err := saveStats("day_top_stats", recs); err != nil {
+				return res, err
+			}
+			res.Days = len(recs)
+		} else {
+			recs := keepStats(rollupStats(location, prev, samples, fiveMinBucket), covered, &res.Covered)
+			if err := countReplaced("five_min_top_stats", location, recs, begin, end, &res.Replaced); err != nil {
+				return res, err
+			}
+			if err := saveStats("five_min_top_stats", recs); err != nil {
+				return res, err
+			}
+			res.FiveMin = len(recs)
+			// rebuild the days the import wrote to from all their five minute rows, imported or
+			// not, leaving the days the collector rolls up alone
+			wrote := make([]int64, len(recs))
+			for i, r := range recs {
+				wrote[i] = r.DateTime
+			}
+			skip := untouchedDays(location, wrote, coveredDays, begin, end)
+			fiveMin, err := getFiveMinStats(location, begin, end-1)
+			if err != nil {
+				return res, err
+			}
+			var skipped int
+			daily := keepStats(mergeStats(location, fiveMin, days), skip, &skipped)
+			if err := saveStats("day_top_stats", daily); err != nil {
+				return res, err
+			}
+			res.Days = len(daily)
+		}
+	}
+
+	pct := s.percentSamples()
+	if len(pct) == 0 {
+		return res, nil
+	}
+	if s.daily() {
+		return res, savePercent("day_battery_pct", keepPercent(rollupPercent(location, pct, days), coveredDays))
+	}
+	pctRecs := keepPercent(rollupPercent(location, pct, fiveMinBucket), covered)
+	if err := savePercent("five_min_battery_pct", pctRecs); err != nil {
+		return res, err
+	}
+	wrote := make([]int64, len(pctRecs))
+	for i, r := range pctRecs {
+		wrote[i] = r.DateTime
+	}
+	fiveMin, err := getFiveMinBattery(location, begin, end-1)
+	if err != nil {
+		return res, err
+	}
+	return res, savePercent("day_battery_pct", keepPercent(mergePercent(location, fiveMin, days), untouchedDays(location, wrote, coveredDays, begin, end)))
+}
+
+// untouchedDays is the days from begin up to end whose daily rollups an import leaves alone:
+// the ones it wrote none of the buckets in, and the ones the collector has samples for, whose
+// rows come from its own rollup.
+func untouchedDays(location string, wrote []int64, coveredDays map[int64]bool, begin int64, end int64) map[int64]bool {
+	days := dayBucket(location)
+	touched := make(map[int64]bool)
+	for _, b := range wrote {
+		touched[days(b)] = true
+	}
+	skip := make(map[int64]bool)
+	for d := localTime(location, begin); d.Unix() < end; d = dayStart(d.AddDate(0, 0, 1)) {
+		if !touched[d.Unix()] || coveredDays[d.Unix()] {
+			skip[d.Unix()] = true
+		}
+	}
+	return skip
+}
+
+// keepStats drops the records for covered buckets, counting them.
+func keepStats(recs []StatsDisplayRecord, covered map[int64]bool, skipped *int) []StatsDisplayRecord {
+	kept := recs[:0]
+	for _, r := range recs {
+		if covered[r.DateTime] {
+			*skipped++
+			continue
+		}
+		kept = append(kept, r)
+	}
+	return kept
+}
+
+func keepPercent(recs []BatteryPctDisplayRecord, covered map[int64]bool) []BatteryPctDisplayRecord {
+	kept := recs[:0]
+	for _, r := range recs {
+		if !covered[r.DateTime] {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// countReplaced counts the records that table already has a row for.
+func countReplaced(table string, location string, recs []StatsDisplayRecord, begin int64, end int64, replaced *int) error {
+	existing, err := existingBuckets(table, location, begin, end)
+	if err != nil {
+		return err
+	}
+	for _, r := range recs {
+		if existing[r.DateTime] {
+			*replaced++
+		}
+	}
+	return nil
+}
+
+// mergePercent combines battery records, oldest first, into one record per coarser bucket.
+func mergePercent(location string, recs []BatteryPctDisplayRecord, bucket func(int64) int64) []BatteryPctDisplayRecord {
+	merged := make([]BatteryPctDisplayRecord, 0)
+	for _, r := range recs {
+		b := bucket(r.DateTime)
+		if len(merged) == 0 || merged[len(merged)-1].DateTime != b {
+			merged = append(merged, BatteryPctDisplayRecord{Location: location, DateTime: b, HiPct: r.HiPct, HiPctTime: r.HiPctTime, LowPct: r.LowPct, LowPctTime: r.LowPctTime})
+		}
+		m := &merged[len(merged)-1]
+		if r.HiPct > m.HiPct {
+			m.HiPct, m.HiPctTime = r.HiPct, r.HiPctTime
+		}
+		if r.LowPct < m.LowPct {
+			m.LowPct, m.LowPctTime = r.LowPct, r.LowPctTime
+		}
+		m.NumSamples += r.NumSamples
+		m.TotalSamples += r.TotalSamples
+	}
+	return merged
+}
+
+// importHistorySamples replaces the samples earlier imports wrote for the series' days with
+// aggregates payloads like the collector's, skipping days the collector has samples for.
+func importHistorySamples(location string, format string, s HistorySeries, coveredDays map[int64]bool, res *HistoryImport) error {
+	topic := historyTopic(location, format)
+	days := dayBucket(location)
+	begin, end := days(res.First), dayStart(localTime(location, res.Last).AddDate(0, 0, 1))
+	for _, table := range []string{"energy", "battery"} {
+		r, err := db.Exec("delete from "+table+" where location = ? and topic = ? and dt >= from_unixtime(?) and dt < from_unixtime(?)",
+			location, topic, begin, end.Unix())
+		if err != nil {
+			log.Error().Err(err).Msgf("importHistorySamples(%s): deleting from %s", location, table)
+			return err
+		}
+		if n, err := r.RowsAffected(); err == nil && table == "energy" {
+			res.Replaced = int(n)
+		}
+	}
+	samples := s.powerSamples()
+	for i, r := range s.Rows {
+		if coveredDays[days(r.DateTime)] {
+			res.Covered++
+			continue
+		}
+		dt := time.Unix(r.DateTime, 0)
+		if s.HasPower {
+			p := samples[i]
+			agg := meterAggregates{}
+			for m, reading := range []*meterReading{&agg.Site, &agg.Load, &agg.Battery, &agg.Solar} {
+				*reading = meterReading{LastCommunicationTime: dt, InstantPower: p.Power[m], EnergyImported: p.Imported[m], EnergyExported: p.Exported[m]}
+			}
+			payload, err := json.Marshal(agg)
+			if err != nil {
+				return err
+			}
+			if err := saveEnergySample(location, topic, dt, payload); err != nil {
+				return err
+			}
+		}
+		if r.HasPercent {
+			if err := saveBatterySample(location, topic, dt, r.Percent); err != nil {
+				return err
+			}
+		}
+		res.Samples++
+	}
+	return touchDataVersion(location)
+}
+
+// importHistoryFiles parses each export file and imports them together, so overlapping files
+// are reported as duplicates rather than imported twice.
+func importHistoryFiles(paths []string, location string, format string, intoSamples bool) (HistoryImport, error) {
+	unit, ok := historyFormats[format]
+	if !ok {
+		return HistoryImport{}, fmt.Errorf("unknown history format %q", format)
+	}
+	var series HistorySeries
+	for _, path := range paths {
+		log.Info().Msgf("importing %s history from %s", format, path)
+		f, err := os.Open(path)
+		if err != nil {
+			return HistoryImport{}, err
+		}
+		s, err := parseHistoryCSV(f, locationTZ(location), unit)
+		f.Close()
+		if err != nil {
+			return HistoryImport{}, fmt.Errorf("%s: %w", path, err)
+		}
+		if len(series.Rows) > 0 && s.Energy != series.Energy {
+			return HistoryImport{}, fmt.Errorf("%s: can't import power and energy exports together", path)
+		}
+		series.Energy = s.Energy
+		series.HasPower = series.HasPower || s.HasPower
+		series.Duplicates += s.Duplicates
+		series.add(s.Rows)
+	}
+	return importHistory(location, format, series, intoSamples)
+}
+
+// writeHistoryReport prints what an import did, including its gaps.
+func writeHistoryReport(w io.Writer, location string, res HistoryImport) {
+	if res.Rows == 0 {
+		fmt.Fprintf(w, "%s: no rows\n", location)
+		return
+	}
+	format := func(dt int64) string { return localTime(location, dt).Format("2006-01-02 15:04") }
+	fmt.Fprintf(w, "%s: %d rows from %s to %s every %s\n", location, res.Rows, format(res.First), format(res.Last), time.Duration(res.Interval)*time.Second)
+	if res.Samples > 0 {
+		fmt.Fprintf(w, "stored %d samples; run rollup for %s to %s\n", res.Samples,
+			localTime(location, res.First).Format("2006-01-02"), localTime(location, res.Last).Format("2006-01-02"))
+	} else {
+		fmt.Fprintf(w, "wrote %d five minute and %d daily rollups\n", res.FiveMin, res.Days)
+	}
+	if res.Duplicates > 0 {
+		fmt.Fprintf(w, "overlap: %d rows repeated a time already imported\n", res.Duplicates)
+	}
+	if res.Covered > 0 {
+		fmt.Fprintf(w, "overlap: kept the collector's data for %d buckets\n", res.Covered)
+	}
+	if res.Replaced > 0 {
+		fmt.Fprintf(w, "overlap: replaced %d rows from an earlier import\n", res.Replaced)
+	}
+	for _, g := range res.Gaps {
+		fmt.Fprintf(w, "gap: %s to %s (%s)\n", format(g[0]), format(g[1]), (time.Duration(g[1]-g[0]) * time.Second).String())
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHistoryCSVTeslaPower(t *testing.T) {
+	in := "\ufeffDate time,Home (kW),Vehicle (kW),Powerwall (kW),Solar (kW),Grid (kW)\n" +
+		"2023-06-01T12:00:00-04:00,1.5,0,-2,4,-0.5\n" +
+		"2023-06-01T12:05:00-04:00,1.5,0,-2,4,-0.5\n" +
+		"2023-06-01T12:10:00-04:00,2,0,0,2,0\n" +
+		"2023-06-01T12:05:00-04:00,9,0,9,9,9\n" + // overlapping export
+		"2023-06-01T12:30:00-04:00,1,0,0,0,1\n"
+	s, err := parseHistoryCSV(strings.NewReader(in), time.UTC, historyFormats["tesla"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Energy || !s.HasPower || len(s.Rows) != 4 || s.Duplicates != 1 || s.Interval != 300 {
+		t.Fatalf("got %+v", s)
+	}
+	if r := s.Rows[1]; r.Power != [4]float64{-500, 1500, -2000, 4000} {
+		t.Errorf("row 1 power = %v", r.Power)
+	}
+	if len(s.Gaps) != 1 || s.Gaps[0] != [2]int64{s.Rows[2].DateTime, s.Rows[3].DateTime} {
+		t.Errorf("gaps = %v", s.Gaps)
+	}
+
+	samples := s.powerSamples()
+	last := samples[len(samples)-1]
+	// 5 minutes each at 1.5, 1.5, 2 and 1kW; the gap doesn't count
+	if got := last.Imported[meterLoad]; math.Abs(got-500) > 1e-9 {
+		t.Errorf("load imported %.2fWh, want 500", got)
+	}
+	if got := last.Imported[meterBattery]; math.Abs(got-2000.0/12*2) > 1e-9 {
+		t.Errorf("battery charged %.2fWh", got)
+	}
+	if got := last.Exported[meterSite]; math.Abs(got-500.0/12*2) > 1e-9 {
+		t.Errorf("site exported %.2fWh", got)
+	}
+	recs := rollupStats("X", &PowerSample{DateTime: samples[0].DateTime - 300}, samples, fiveMinBucket)
+	if len(recs) != 4 || math.Abs(recs[0].SolarExported-4000.0/12) > 1e-9 {
+		t.Errorf("first bucket = %+v", recs[0])
+	}
+}
+
+func TestHistoryFiveMinuteBaseload(t *testing.T) {
+	// the Tesla app's 15 minute rows: 400W overnight, 250W for an hour from 1:00
+	in := "Date time,Home (kW),Powerwall (kW),Solar (kW),Grid (kW)\n"
+	day := time.Date(2026, 1, 10, 0, 0, 0, 0, time.Local)
+	for i := 1; i <= 24; i++ {
+		load := 0.4
+		if i > 4 && i <= 8 {
+			load = 0.25
+		}
+		in += fmt.Sprintf("%s,%g,0,0,%g\n", day.Add(time.Duration(i)*15*time.Minute).Format(time.RFC3339), load, load)
+	}
+	s, err := parseHistoryCSV(strings.NewReader(in), time.Local, historyFormats["tesla"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	spread := s.fiveMinute()
+	if len(spread.Rows) != 72 || spread.Interval != 300 || spread.Rows[0].DateTime != day.Add(5*time.Minute).Unix() {
+		t.Fatalf("spread into %d rows %ds apart from %d", len(spread.Rows), spread.Interval, spread.Rows[0].DateTime)
+	}
+	samples := spread.powerSamples()
+	if got := samples[len(samples)-1].Imported[meterLoad]; math.Abs(got-(0.4*5+0.25)*1000) > 1e-9 {
+		t.Errorf("load imported %.2fWh, want 2250", got)
+	}
+
+	fiveMin := rollupStats("X", &PowerSample{DateTime: day.Unix()}, samples, fiveMinBucket)
+	for i := range fiveMin {
+		fiveMin[i].LoadAvg = fiveMin[i].TotalLoadSamples / float64(fiveMin[i].NumLoadSamples) // as read back
+	}
+	dayStats := []StatsDisplayRecord{{Location: "X", DateTime: day.Unix(), DT: day.Format("2006-01-02")}}
+	recs := dailyBaseload(dayStats, fiveMin, 0.2)
+	if len(recs) != 1 || recs[0].Baseload != 250 || recs[0].BaseloadDT != "01:05" {
+		t.Errorf("got baseload %+v, want 250W from 01:05", recs)
+	}
+}
+
+func TestParseHistoryCSVTeslaEnergy(t *testing.T) {
+	in := "Date time,Home (kWh),Vehicle (kWh),Powerwall (kWh),Solar Energy (kWh),From Grid (kWh),To Grid (kWh),Grid (kWh)\n" +
+		"2023-06-01T00:00:00-04:00,20,0,1,30,5,14,-9\n" +
+		"2023-06-02T00:00:00-04:00,24,0,-1,10,16,2,14\n"
+	tz, _ := time.LoadLocation("America/New_York")
+	s, err := parseHistoryCSV(strings.NewReader(in), tz, historyFormats["tesla"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Energy || !s.daily() {
+		t.Fatalf("got %+v", s)
+	}
+	r := s.Rows[0]
+	if r.Imported[meterSite] != 5000 || r.Exported[meterSite] != 14000 {
+		t.Errorf("grid %v/%v; the net column should be ignored when the flows are given", r.Imported[meterSite], r.Exported[meterSite])
+	}
+	if r.Imported[meterLoad] != 20000 || r.Exported[meterSolar] != 30000 || r.Exported[meterBattery] != 1000 || s.Rows[1].Imported[meterBattery] != 1000 {
+		t.Errorf("row = %+v", r)
+	}
+	samples := s.powerSamples()
+	days := rollupStats("X", &PowerSample{DateTime: samples[0].DateTime - s.Interval}, samples, func(dt int64) int64 {
+		return dayStart(time.Unix(dt, 0).In(tz)).Unix()
+	})
+	if len(days) != 2 || days[1].LoadImported != 24000 || days[1].SiteImported != 16000 || math.Abs(days[1].HiLoad-1000) > 1e-9 {
+		t.Errorf("days = %+v", days)
+	}
+}
+
+func TestParseHistoryCSVPypowerwall(t *testing.T) {
+	in := "timestamp,grid,home,solar,battery,batterylevel\n" +
+		"1685620800,100,1100,0,1000,55.5\n" +
+		"1685620860,100,1100,0,1000,55.4\n"
+	s, err := parseHistoryCSV(strings.NewReader(in), time.UTC, historyFormats["pypowerwall"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Interval != 60 || s.Rows[0].Power != [4]float64{100, 1100, 1000, 0} || !s.Rows[1].HasPercent || s.Rows[1].Percent != 55.4 {
+		t.Errorf("got %+v", s)
+	}
+	if pct := s.percentSamples(); len(pct) != 2 {
+		t.Errorf("percent samples = %v", pct)
+	}
+	if _, err := parseHistoryCSV(strings.NewReader("grid,home\n1,2\n"), time.UTC, "w"); err == nil {
+		t.Error("expected an error for a file without times")
+	}
+}
+
+func TestMergeStats(t *testing.T) {
+	hour := func(dt int64) int64 { return dt - dt%3600 }
+	recs := []StatsDisplayRecord{
+		{DateTime: 0, HiLoad: 500, HiLoadTime: 10, LowLoad: 200, LowLoadTime: 20, LoadImported: 30, NumLoadSamples: 10, TotalLoadSamples: 3000},
+		{DateTime: 300, HiLoad: 900, HiLoadTime: 310, LowLoad: 300, LowLoadTime: 320, LoadImported: 50, NumLoadSamples: 10, TotalLoadSamples: 6000},
+		{DateTime: 3600, HiLoad: 100, HiLoadTime: 3610, LowLoad: 100, LowLoadTime: 3610, LoadImported: 8, NumLoadSamples: 1, TotalLoadSamples: 100},
+	}
+	got := mergeStats("X", recs, hour)
+	if len(got) != 2 {
+		t.Fatalf("got %d records", len(got))
+	}
+	r := got[0]
+	if r.HiLoad != 900 || r.HiLoadTime != 310 || r.LowLoad != 200 || r.LowLoadTime != 20 || r.LoadImported != 80 || r.NumLoadSamples != 20 || r.TotalLoadSamples != 9000 {
+		t.Errorf("first hour = %+v", r)
+	}
+	if got[1].DateTime != 3600 || got[1].LoadImported != 8 {
+		t.Errorf("second hour = %+v", got[1])
+	}
+}
+
+func TestUntouchedDays(t *testing.T) {
+	days := dayBucket("X")
+	d0 := dayStart(localTime("X", 1767225600)) // 2026-01-01
+	d1, d2 := dayStart(d0.AddDate(0, 0, 1)), dayStart(d0.AddDate(0, 0, 2))
+	end := dayStart(d0.AddDate(0, 0, 3)).Unix()
+	// the import wrote buckets on the first two days, and the collector has samples on the second
+	wrote := []int64{d0.Unix() + 300, d1.Unix() + 600}
+	skip := untouchedDays("X", wrote, map[int64]bool{days(d1.Unix()): true}, d0.Unix(), end)
+	if skip[d0.Unix()] || !skip[d1.Unix()] || !skip[d2.Unix()] || len(skip) != 2 {
+		t.Errorf("got %v for days %d %d %d", skip, d0.Unix(), d1.Unix(), d2.Unix())
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var homeTmpl *template.Template
+
+// HomePage is the landing page: each location's current state with links to its pages.
+type HomePage struct {
+	Service   string
+	Revision  string
+	User      string // signed in user, empty when sign in is off
+	Locations []LocationOverview
+}
+
+func homePage(r *http.Request, now time.Time) HomePage {
+	h := HomePage{Service: liveData.Service, Revision: liveData.Revision}
+	if u := requestUser(r); u != nil {
+		h.User = u.Name
+	}
+	for _, loc := range visibleLocations(r) {
+		h.Locations = append(h.Locations, locationOverview(loc, now))
+	}
+	return h
+}
+
+// indexHandler renders the home page at / and is the not found page for everything else.
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if err := homeTmpl.Execute(w, homePage(r, time.Now())); err != nil {
+		msg := http.StatusText(http.StatusInternalServerError)
+		log.Error().Err(err).Msg(msg)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHomePage(t *testing.T) {
+	tmpl := parseTemplate("index.html")
+	h := HomePage{Service: "live service", Revision: "0.1", Locations: []LocationOverview{
+		{Location: "VT", Name: "Vermont", PVSize: 7.5, AsOf: time.Now(), Age: "12s", SolarInstantPower: 3200, BatteryCharge: 87.5},
+		{Location: "NH", Name: "New Hampshire", Error: "sql: no rows in result set", Stale: true},
+	}}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, h); err != nil {
+		t.Fatal(err)
+	}
+	page := b.String()
+	for _, want := range []string{"energy?location=VT", "live?location=NH", "compare?location=VT", "3200 W", "87.5%", `class="stale"`, "live service 0.1"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("home page is missing %q", want)
+		}
+	}
+	if strings.Contains(page, "sql:") {
+		t.Error("home page shows the query error")
+	}
+}
+
+func TestIndexHandlerNotFound(t *testing.T) {
+	w := httptest.NewRecorder()
+	indexHandler(w, httptest.NewRequest("GET", "/nope", nil))
+	if w.Code != 404 {
+		t.Errorf("got %d, want 404", w.Code)
+	}
+}
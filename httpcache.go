@@ -0,0 +1,297 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/rs/zerolog/log"
+)
+
+// dataVersion is what a location's pages and API are built from: its latest raw samples and
+// rollups, when any process last wrote its rollups, weather, anomalies or demand peaks, and the
+// version of the rollups this process rebuilt.
+type dataVersion struct {
+	Energy   int64 // ms
+	Battery  int64 // ms
+	FiveMin  int64 // unix seconds, the latest five minute rollup
+	Updated  int64 // µs, the latest write recorded in data_versions
+	Rollups  uint64
+	Day      string // the location's local date, which ranges like today and the default ones move with
+	Modified time.Time
+}
+
+// createDataVersionsTable records when each location's derived data was last written, by this
+// process or another one like an import, so validators can tell without scanning the tables.
+const createDataVersionsTable = `create table if not exists data_versions (
+	location varchar(16) not null primary key,
+	updated datetime(6) not null
+)`
+
+func ensureDataVersionsTable() error {
+	dbConnect()
+	_, err := db.Exec(createDataVersionsTable)
+	if err != nil {
+		log.Error().Err(err).Msg("ensureDataVersionsTable()")
+	}
+	return err
+}
+
+// touchDataVersion records that the location's rollups, weather, anomalies or demand peaks changed.
+func touchDataVersion(location string) error {
+	_, err := db.Exec("insert into data_versions (location, updated) values (?, now(6)) on duplicate key update updated = now(6)", location)
+	if err != nil {
+		log.Error().Err(err).Msgf("touchDataVersion(%s): %+v", location, err)
+	}
+	return err
+}
+
+// conditionalPath says whether responses for the path get validators: the pages and API of
+// one location, whose content only changes with its data version. The ones covering every
+// location, and the cache stats, don't.
+func conditionalPath(path string) bool {
+	switch path {
+	case "/energy", "/live":
+		return true
+	case "/api/cache", "/api/locations", "/api/overview":
+		return false
+	}
+	return strings.HasPrefix(path, "/api/")
+}
+
+// getDataVersion is the data version of a location. Every query is on the location's index.
+func getDataVersion(location string) (dataVersion, error) {
+	dbConnect()
+	var energy, battery, updated sql.NullFloat64
+	var fiveMin sql.NullInt64
+	err := db.QueryRow("select (select round(unix_timestamp(max(dt)) * 1000) from energy where location = ?), "+
+		"(select round(unix_timestamp(max(dt)) * 1000) from battery where location = ?), "+
+		"(select max(datetime) from five_min_top_stats where location = ?), "+
+		"(select round(unix_timestamp(updated) * 1000000) from data_versions where location = ?)",
+		location, location, location, location).Scan(&energy, &battery, &fiveMin, &updated)
+	if err != nil {
+		log.Error().Err(err).Msgf("getDataVersion(%s): %+v", location, err)
+		return dataVersion{}, err
+	}
+	v := dataVersion{Energy: int64(energy.Float64), Battery: int64(battery.Float64), FiveMin: fiveMin.Int64, Updated: int64(updated.Float64)}
+	v.Rollups, v.Modified = rollupsCache.Version()
+	for _, t := range []time.Time{time.UnixMilli(v.Energy), time.UnixMilli(v.Battery), time.Unix(v.FiveMin, 0), time.UnixMicro(v.Updated)} {
+		if t.After(v.Modified) {
+			v.Modified = t
+		}
+	}
+	return v, nil
+}
+
+// requestDataVersion is the data version of the request's location, or the default one. ok is
+// false for locations that don't exist or the user can't see, which are left to the handler.
+func requestDataVersion(r *http.Request) (dataVersion, bool) {
+	id := r.URL.Query().Get("location")
+	if id == "" {
+		id = defaultLocationID(r)
+	}
+	l, ok := registry.lookup(id)
+	if !ok || !requestUser(r).canSee(l.ID) {
+		return dataVersion{}, false
+	}
+	v, err := getDataVersion(l.ID)
+	if err != nil {
+		return v, false
+	}
+	v.setDay(time.Now().In(l.TZ()))
+	return v, true
+}
+
+// setDay sets the version's local date to now's, which also makes it modified at midnight at
+// the latest.
+func (v *dataVersion) setDay(now time.Time) {
+	v.Day = now.Format("2006-01-02")
+	if midnight := dayStart(now); midnight.After(v.Modified) {
+		v.Modified = midnight
+	}
+}
+
+// etag is a weak entity tag for the response to r when the data is at v. It's weak as the same
+// data can be sent with different compression.
+func (v dataVersion) etag(r *http.Request) string {
+	h := fnv.New64a()
+	var name string // pages listing locations differ by user
+	if u := requestUser(r); u != nil {
+		name = u.Name
+	}
+	fmt.Fprintf(h, "%s?%s %s %d %d %d %d %d %s", r.URL.Path, r.URL.RawQuery, name, v.Energy, v.Battery, v.FiveMin, v.Updated, v.Rollups, v.Day)
+	return fmt.Sprintf(`W/"%x"`, h.Sum64())
+}
+
+// notModified says whether the client's copy, described by r's conditional headers, is
+// current. If-None-Match wins over If-Modified-Since.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.Truncate(time.Second).After(since)
+}
+
+// validatorWriter drops the validators from error responses, which mustn't be cached.
+type validatorWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (v *validatorWriter) WriteHeader(code int) {
+	if !v.wrote && code >= 300 && code != http.StatusNotModified {
+		v.Header().Del("ETag")
+		v.Header().Del("Last-Modified")
+	}
+	v.wrote = true
+	v.ResponseWriter.WriteHeader(code)
+}
+
+func (v *validatorWriter) Write(p []byte) (int, error) {
+	v.wrote = true
+	return v.ResponseWriter.Write(p)
+}
+
+// conditional adds an ETag and Last-Modified from the data version to GET and HEAD responses
+// for conditionalPath, and answers requests for a copy that's still current with 304 Not
+// Modified instead of running next.
+func conditional(next http.Handler, version func(*http.Request) (dataVersion, bool)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || !conditionalPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		v, ok := version(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		etag := v.etag(r)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", v.Modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("Cache-Control", "no-cache") // keep it, but check it's current each time
+		if notModified(r, etag, v.Modified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		next.ServeHTTP(&validatorWriter{ResponseWriter: w}, r)
+	})
+}
+
+// acceptEncoding is the compression the Accept-Encoding header prefers: br or gzip, whichever
+// has the higher q-value, br on a tie, or "" for neither.
+func acceptEncoding(header string) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		weight := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			if f, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err == nil {
+				weight = f
+			}
+		}
+		q[strings.ToLower(strings.TrimSpace(name))] = weight
+	}
+	best, bestQ := "", 0.0
+	for _, enc := range []string{"br", "gzip"} {
+		w, ok := q[enc]
+		if !ok {
+			w = q["*"]
+		}
+		if w > bestQ {
+			best, bestQ = enc, w
+		}
+	}
+	return best
+}
+
+// compressible says whether a content type is text, which is worth compressing.
+func compressible(contentType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(t, "text/") || t == "application/json" || t == "application/javascript" || t == "image/svg+xml"
+}
+
+// compressWriter compresses a successful text response as it's written.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	enc      io.WriteCloser
+	wrote    bool
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wrote {
+		return
+	}
+	cw.wrote = true
+	h := cw.Header()
+	if code == http.StatusOK && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", cw.encoding)
+		if cw.encoding == "br" {
+			cw.enc = brotli.NewWriterLevel(cw.ResponseWriter, brotli.DefaultCompression)
+		} else {
+			cw.enc, _ = gzip.NewWriterLevel(cw.ResponseWriter, gzip.DefaultCompression)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wrote {
+		// the content type has to be known before deciding to compress, and can't be sniffed after
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Close finishes the compressed stream.
+func (cw *compressWriter) Close() error {
+	if cw.enc != nil {
+		return cw.enc.Close()
+	}
+	return nil
+}
+
+// compress compresses text responses with brotli or gzip, whichever the client prefers.
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := acceptEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer func() {
+			if err := cw.Close(); err != nil {
+				log.Error().Err(err).Msg("compress()")
+			}
+		}()
+		next.ServeHTTP(cw, r)
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestConditional(t *testing.T) {
+	modified := time.Date(2024, 3, 10, 12, 30, 15, 500e6, time.UTC)
+	v := dataVersion{Energy: modified.UnixMilli(), Battery: modified.UnixMilli(), FiveMin: 1710073500, Rollups: 1, Modified: modified}
+	calls := 0
+	h := conditional(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Query().Get("fail") != "" {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, "data")
+	}), func(*http.Request) (dataVersion, bool) { return v, true })
+
+	get := func(url string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", url, nil)
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/api/chart?location=VT")
+	etag := w.Header().Get("ETag")
+	if w.Code != 200 || !strings.HasPrefix(etag, `W/"`) || w.Header().Get("Last-Modified") != "Sun, 10 Mar 2024 12:30:15 GMT" {
+		t.Fatalf("got %d %v", w.Code, w.Header())
+	}
+	if w := get("/api/chart?location=VT", "If-None-Match", `"abc", `+strings.TrimPrefix(etag, "W/")); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("matching etag got %d %q", w.Code, w.Body.String())
+	}
+	if w := get("/api/chart?location=VT", "If-Modified-Since", "Sun, 10 Mar 2024 12:30:15 GMT"); w.Code != http.StatusNotModified {
+		t.Errorf("current If-Modified-Since got %d", w.Code)
+	}
+	if w := get("/api/chart?location=VT", "If-Modified-Since", "Sun, 10 Mar 2024 12:30:14 GMT"); w.Code != 200 {
+		t.Errorf("stale If-Modified-Since got %d", w.Code)
+	}
+	// If-None-Match wins
+	if w := get("/api/chart?location=VT", "If-None-Match", `W/"abc"`, "If-Modified-Since", "Sun, 10 Mar 2024 12:30:15 GMT"); w.Code != 200 {
+		t.Errorf("stale etag got %d", w.Code)
+	}
+	if w := get("/api/chart?location=UK", "If-None-Match", etag); w.Code != 200 {
+		t.Errorf("another location's etag got %d", w.Code)
+	}
+
+	v.Rollups++
+	if w := get("/api/chart?location=VT", "If-None-Match", etag); w.Code != 200 {
+		t.Errorf("after a rollup got %d", w.Code)
+	}
+	// relative ranges move at midnight even if no data came in
+	etag = get("/api/chart?location=VT").Header().Get("ETag")
+	v.setDay(modified.Add(12 * time.Hour))
+	if w := get("/api/chart?location=VT", "If-None-Match", etag); w.Code != 200 {
+		t.Errorf("the next day got %d", w.Code)
+	}
+	if w := get("/api/chart?location=VT", "If-Modified-Since", "Sun, 10 Mar 2024 12:30:15 GMT"); w.Code != 200 || w.Header().Get("Last-Modified") != "Mon, 11 Mar 2024 00:00:00 GMT" {
+		t.Errorf("If-Modified-Since the day before got %d %v", w.Code, w.Header())
+	}
+	if w := get("/api/chart?location=VT&fail=1"); w.Code != 500 || w.Header().Get("ETag") != "" {
+		t.Errorf("error got %d %v", w.Code, w.Header())
+	}
+	calls = 0
+	if w := get("/weather", "If-None-Match", etag); w.Header().Get("ETag") != "" || calls != 1 {
+		t.Errorf("weather got %v", w.Header())
+	}
+}
+
+func TestConditionalPath(t *testing.T) {
+	for path, want := range map[string]bool{
+		"/energy": true, "/live": true, "/api/chart": true, "/api/anomalies": true,
+		"/api/cache": false, "/api/locations": false, "/api/overview": false, "/overview": false, "/": false,
+	} {
+		if got := conditionalPath(path); got != want {
+			t.Errorf("conditionalPath(%q) = %v", path, got)
+		}
+	}
+}
+
+func TestAcceptEncoding(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                         "",
+		"gzip, deflate, br":        "br",
+		"gzip":                     "gzip",
+		"br;q=0, gzip;q=0.5":       "gzip",
+		"*":                        "br",
+		"br;q=0, *":                "gzip",
+		"identity, deflate":        "",
+		"GZIP;q=1.0, identity;q=0": "gzip",
+		"gzip;q=1, br;q=0.5":       "gzip",
+		"br;q=0.5, gzip;q=0.5":     "br",
+		"*;q=0.5, gzip":            "gzip",
+	} {
+		if got := acceptEncoding(header); got != want {
+			t.Errorf("acceptEncoding(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	body := strings.Repeat(`[1710073500000,1234.500000],`, 1000)
+	h := compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/image.png" {
+			w.Header().Set("Content-Type", "image/png")
+		}
+		io.WriteString(w, body)
+	}))
+	get := func(path string, encoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept-Encoding", encoding)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for encoding, reader := range map[string]func(io.Reader) (io.Reader, error){
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"br":   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+	} {
+		w := get("/api/chart", encoding)
+		if w.Header().Get("Content-Encoding") != encoding || w.Header().Get("Vary") != "Accept-Encoding" || w.Body.Len() >= len(body)/10 {
+			t.Errorf("%s: got %v and %d bytes", encoding, w.Header(), w.Body.Len())
+			continue
+		}
+		r, err := reader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := io.ReadAll(r); err != nil || string(got) != body {
+			t.Errorf("%s: decompressed %d bytes, %v", encoding, len(got), err)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Errorf("%s: content type %q", encoding, ct)
+		}
+	}
+
+	if w := get("/image.png", "gzip"); w.Header().Get("Content-Encoding") != "" || w.Body.String() != body {
+		t.Errorf("png got %v", w.Header())
+	}
+	if w := get("/api/chart", ""); w.Header().Get("Content-Encoding") != "" || w.Body.String() != body {
+		t.Errorf("no Accept-Encoding got %v", w.Header())
+	}
+}
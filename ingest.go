@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog/log"
+)
+
+// ingestTopics are the collector topics; the second level is the location.
+var ingestTopics = map[string]byte{"energy/+/energy": 1, "energy/+/battery": 1}
+
+// URL is the broker address for Go clients, over the same websocket the live page uses.
+func (m MQTTConfig) URL() string {
+	scheme := "ws"
+	if m.UseSSL {
+		scheme = "wss"
+	}
+	return fmt.Sprintf("%s://%s:%d%s", scheme, m.Broker, m.Port, m.Path)
+}
+
+// aggregatesTime is when the Powerwall took an aggregates payload, from the site meter's
+// last_communication_time, or ok is false if it doesn't have one.
+func aggregatesTime(payload []byte) (time.Time, bool) {
+	var agg struct {
+		Site struct {
+			LastCommunicationTime time.Time `json:"last_communication_time"`
+		} `json:"site"`
+	}
+	if err := json.Unmarshal(payload, &agg); err != nil || agg.Site.LastCommunicationTime.IsZero() {
+		return time.Time{}, false
+	}
+	return agg.Site.LastCommunicationTime, true
+}
+
+func saveEnergySample(location string, topic string, dt time.Time, payload []byte) error {
+	_, err := db.Exec("insert into energy (location, topic, dt, payload) values (?, ?, ?, ?)",
+		strings.ToUpper(location), topic, dt.UTC(), string(payload))
+	if err != nil {
+		log.Error().Err(err).Msgf("saveEnergySample(%s, %s)", location, dt)
+	}
+	return err
+}
+
+func saveBatterySample(location string, topic string, dt time.Time, percent float64) error {
+	_, err := db.Exec("insert into battery (location, topic, dt, percent_charged) values (?, ?, ?, ?)",
+		strings.ToUpper(location), topic, dt.UTC(), percent)
+	if err != nil {
+		log.Error().Err(err).Msgf("saveBatterySample(%s, %s)", location, dt)
+	}
+	return err
+}
+
+// topicLocation is the location a collector topic belongs to.
+func topicLocation(topic string) (location string, kind string, err error) {
+	parts := strings.Split(topic, "/")
+	if len(parts) != 3 || parts[0] != "energy" || parts[1] == "" {
+		return "", "", fmt.Errorf("unexpected topic %q", topic)
+	}
+	return strings.ToUpper(parts[1]), parts[2], nil
+}
+
+// ingestMessage stores one collector message: Powerwall aggregates on energy/<loc>/energy and
+// {"percentage": n} state of charge on energy/<loc>/battery. now is used if the payload has no time.
+func ingestMessage(topic string, payload []byte, now time.Time) error {
+	location, kind, err := topicLocation(topic)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case "energy":
+		if !json.Valid(payload) {
+			return fmt.Errorf("%s: payload is not JSON", topic)
+		}
+		dt, ok := aggregatesTime(payload)
+		if !ok {
+			dt = now
+		}
+		return saveEnergySample(location, topic, dt, payload)
+	case "battery":
+		var soe struct {
+			Percentage *float64 `json:"percentage"`
+		}
+		if err := json.Unmarshal(payload, &soe); err != nil || soe.Percentage == nil {
+			return fmt.Errorf("%s: payload has no percentage", topic)
+		}
+		return saveBatterySample(location, topic, now, *soe.Percentage)
+	}
+	return fmt.Errorf("unexpected topic %q", topic)
+}
+
+// ingestReader stores newline delimited aggregates payloads for location, e.g. saved with
+// mosquitto_sub, and returns how many it stored.
+func ingestReader(in io.Reader, location string) (int, error) {
+	topic := "energy/" + strings.ToLower(location) + "/energy"
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	n := 0
+	for line := 1; scanner.Scan(); line++ {
+		payload := strings.TrimSpace(scanner.Text())
+		if payload == "" {
+			continue
+		}
+		if _, ok := aggregatesTime([]byte(payload)); !ok {
+			return n, fmt.Errorf("line %d: no site.last_communication_time", line)
+		}
+		if err := ingestMessage(topic, []byte(payload), time.Now()); err != nil {
+			return n, fmt.Errorf("line %d: %w", line, err)
+		}
+		n++
+	}
+	return n, scanner.Err()
+}
+
+// ingestMQTT subscribes to the collector topics and stores every message until interrupted.
+func ingestMQTT(clientID string) error {
+	url := config().MQTT.URL()
+	opts := mqtt.NewClientOptions().AddBroker(url).SetClientID(clientID).
+		SetAutoReconnect(true).SetCleanSession(false)
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		log.Info().Msgf("connected to %s", url)
+		token := c.SubscribeMultiple(ingestTopics, func(_ mqtt.Client, m mqtt.Message) {
+			if err := ingestMessage(m.Topic(), m.Payload(), time.Now()); err != nil {
+				log.Warn().Err(err).Msg("ingestMessage()")
+			}
+		})
+		if token.Wait() && token.Error() != nil {
+			log.Error().Err(token.Error()).Msg("subscribing")
+		}
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		log.Warn().Err(err).Msgf("lost connection to %s", url)
+	})
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("connecting to %s: %w", url, token.Error())
+	}
+	defer client.Disconnect(1000)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Info().Msg("ingest stopping")
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// LimitsConfig bounds what a client or a single request can ask of the database.
+type LimitsConfig struct {
+	RatePerMinute     int  `yaml:"rate_per_minute"`     // requests per client, 0 for no limit
+	Burst             int  `yaml:"burst"`               // requests a client can make at once
+	MaxRows           int  `yaml:"max_rows"`            // most rows or chart points a request can ask for
+	MaxDays           int  `yaml:"max_days"`            // longest range a request can cover
+	TrustForwardedFor bool `yaml:"trust_forwarded_for"` // tell clients apart by X-Forwarded-For, behind a proxy like Cloud Run's
+}
+
+func (l *LimitsConfig) validate() []string {
+	var problems []string
+	for _, n := range []struct {
+		name  string
+		value int
+		min   int
+	}{{"rate_per_minute", l.RatePerMinute, 0}, {"burst", l.Burst, 1}, {"max_rows", l.MaxRows, 1}, {"max_days", l.MaxDays, 1}} {
+		if n.value < n.min {
+			problems = append(problems, fmt.Sprintf("limits.%s: must be at least %d, got %d", n.name, n.min, n.value))
+		}
+	}
+	return problems
+}
+
+// rowsParam is a limit on rows, at most the max_rows budget.
+func rowsParam(r *http.Request, name string, def int) (int, error) {
+	max := config().Limits.MaxRows
+	if def > max {
+		def = max
+	}
+	return intParam(r, name, def, 1, max)
+}
+
+// daysParam is a number of days, at most the max_days budget.
+func daysParam(r *http.Request, name string, def int) (int, error) {
+	max := config().Limits.MaxDays
+	if def > max {
+		def = max
+	}
+	return intParam(r, name, def, 1, max)
+}
+
+// checkSpan returns an error if the range from begin to end is longer than the max_days budget.
+func checkSpan(name string, begin time.Time, end time.Time) error {
+	max := config().Limits.MaxDays
+	if days := math.Ceil(end.Sub(begin).Hours() / 24); days > float64(max) {
+		return fmt.Errorf("%s: covers %.0f days, more than the %d a request can ask for", name, days, max)
+	}
+	return nil
+}
+
+// chartBudget is the start of a chart range from begin to end that fits the budgets: at most
+// max_days long, with at most max_rows points of the tier it's drawn from. Charts zoomed out
+// further than that show the end of the range rather than failing.
+func chartBudget(begin time.Time, end time.Time) time.Time {
+	l := config().Limits
+	if min := end.AddDate(0, 0, -l.MaxDays); begin.Before(min) {
+		begin = min
+	}
+	// a shorter range can fall into a finer tier, so check again until it fits
+	for range chartTiers {
+		min := end.Add(-time.Duration(l.MaxRows) * tierFor(end.Sub(begin)).Step)
+		if !begin.Before(min) {
+			break
+		}
+		begin = min
+	}
+	return begin
+}
+
+// tokenBucket is a client's allowance: tokens refill at the limiter's rate up to its burst,
+// and each request takes one.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the requests of each client.
+type rateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu        sync.Mutex
+	clients   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(perMinute int, burst int) *rateLimiter {
+	return &rateLimiter{rate: float64(perMinute) / 60, burst: float64(burst), clients: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token for client, or returns how long until there's one.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.clients[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.clients[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets clients whose buckets have refilled, once a minute.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for client, b := range l.clients {
+		if now.Sub(b.last) >= full {
+			delete(l.clients, client)
+		}
+	}
+}
+
+var currentLimiter atomic.Pointer[rateLimiter]
+
+// applyLimits replaces the rate limiter if its settings changed, or removes it if the rate is 0.
+func applyLimits(c LimitsConfig) {
+	if c.RatePerMinute == 0 {
+		currentLimiter.Store(nil)
+		return
+	}
+	if l := currentLimiter.Load(); l != nil && l.rate == float64(c.RatePerMinute)/60 && l.burst == float64(c.Burst) {
+		return
+	}
+	currentLimiter.Store(newRateLimiter(c.RatePerMinute, c.Burst))
+}
+
+// clientAddr is the IP address the request came from. Behind a proxy that's the last
+// X-Forwarded-For entry, the one the proxy added; clients can fake the ones before it.
+func clientAddr(r *http.Request, trustForwardedFor bool) string {
+	if fwd := r.Header.Values("X-Forwarded-For"); trustForwardedFor && len(fwd) > 0 {
+		hops := strings.Split(fwd[len(fwd)-1], ",")
+		if addr := strings.TrimSpace(hops[len(hops)-1]); addr != "" {
+			return addr
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimit answers clients that make requests faster than the configured rate with a 429.
+// Assets aren't counted.
+func rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := currentLimiter.Load()
+		if l == nil || strings.HasPrefix(r.URL.Path, "/assets/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := clientAddr(r, config().Limits.TrustForwardedFor)
+		if ok, wait := l.allow(client, time.Now()); !ok {
+			secs := int(math.Ceil(wait.Seconds()))
+			log.Warn().Msgf("rate limiting %s", client)
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			http.Error(w, fmt.Sprintf("too many requests; try again in %d seconds", secs), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
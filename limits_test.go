@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIntParam(t *testing.T) {
+	for query, want := range map[string]string{
+		"":                  "7",
+		"limit=":            "7",
+		"limit=25":          "25",
+		"limit=10000":       "10000",
+		"limit=10001":       "limit: must be a whole number from 1 to 10000, got \"10001\"",
+		"limit=10000000":    "limit: must be a whole number from 1 to 10000, got \"10000000\"",
+		"limit=0":           "limit: must be a whole number from 1 to 10000, got \"0\"",
+		"limit=-5":          "limit: must be a whole number from 1 to 10000, got \"-5\"",
+		"limit=ten":         "limit: must be a whole number from 1 to 10000, got \"ten\"",
+		"limit=1&limit=999": "limit: give it once",
+	} {
+		r := httptest.NewRequest("GET", "/energy?"+query, nil)
+		got, err := rowsParam(r, "limit", 7)
+		if err != nil {
+			if err.Error() != want {
+				t.Errorf("%s: got error %q, want %s", query, err, want)
+			}
+		} else if want != strconv.Itoa(got) {
+			t.Errorf("%s: got %d, want %s", query, got, want)
+		}
+	}
+}
+
+func TestCheckSpan(t *testing.T) {
+	begin := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := checkSpan("the range", begin, begin.AddDate(10, 0, 0)); err != nil {
+		t.Errorf("10 years: %v", err)
+	}
+	if err := checkSpan("the range", begin, begin.AddDate(11, 0, 0)); err == nil || !strings.Contains(err.Error(), "more than the 3660") {
+		t.Errorf("11 years: %v", err)
+	}
+	r := httptest.NewRequest("GET", "/energy?from=1900-01-01", nil)
+	if _, err := requestRange(r, time.UTC, begin, 7); err == nil {
+		t.Error("a range from 1900 was allowed")
+	}
+}
+
+func TestChartAPIBudget(t *testing.T) {
+	registry.set([]LocationInfo{{ID: "VT", TimeLocation: time.UTC}})
+	defer registry.set(nil)
+	for query, want := range map[string]string{
+		"from=-1&to=1710072000000":            "not a time",
+		"from=1e300&to=1710072000000":         "not a time",
+		"from=1710072000000&to=NaN":           "not a time",
+		"from=1710072000000&to=1710000000000": "ends before",
+	} {
+		w := httptest.NewRecorder()
+		chartAPIHandler(w, httptest.NewRequest("GET", "/api/chart?location=VT&"+query, nil))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%s: got %d %q, want 400 %q", query, w.Code, w.Body.String(), want)
+		}
+	}
+}
+
+func TestChartBudget(t *testing.T) {
+	end := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	if got := chartBudget(time.Unix(0, 0), end); !got.Equal(end.AddDate(0, 0, -3660)) {
+		t.Errorf("all history starts %v, want max_days back", got)
+	}
+	c := defaultConfig()
+	c.Limits.MaxRows = 500
+	currentConfig.Store(&c)
+	defer currentConfig.Store(nil)
+	if got := chartBudget(time.Unix(0, 0), end); !got.Equal(end.AddDate(0, 0, -500)) {
+		t.Errorf("days start %v, want 500 days back", got)
+	}
+	// 30 days of hours is 720 points, cut to the last 500 hours
+	if got := chartBudget(end.AddDate(0, 0, -30), end); !got.Equal(end.Add(-500 * time.Hour)) {
+		t.Errorf("hours start %v, want 500 hours back", got)
+	}
+	if begin := end.AddDate(0, 0, -1); !chartBudget(begin, end).Equal(begin) {
+		t.Error("a day was cut")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(60, 3) // a request a second, 3 at once
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("request %d of the burst was limited", i+1)
+		}
+	}
+	if ok, wait := l.allow("a", now); ok || wait != time.Second {
+		t.Errorf("after the burst got %v %s", ok, wait)
+	}
+	if ok, _ := l.allow("b", now); !ok {
+		t.Error("another client was limited")
+	}
+	if ok, _ := l.allow("a", now.Add(time.Second)); !ok {
+		t.Error("a second later was limited")
+	}
+	l.allow("b", now.Add(2*time.Minute))
+	if _, ok := l.clients["a"]; ok {
+		t.Error("an idle client wasn't swept")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	applyLimits(LimitsConfig{RatePerMinute: 1, Burst: 2})
+	defer applyLimits(LimitsConfig{})
+	h := rateLimit(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	get := func(path string, addr string, forwarded string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = addr
+		if forwarded != "" {
+			r.Header.Set("X-Forwarded-For", forwarded)
+		}
+		return serveRequest(h, r)
+	}
+	get("/energy", "192.0.2.1:1234", "")
+	get("/energy", "192.0.2.1:1235", "")
+	if w := get("/energy", "192.0.2.1:1236", ""); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" || !strings.Contains(w.Body.String(), "try again in 60 seconds") {
+		t.Errorf("third request got %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+	if w := get("/assets/paho-mqtt.js", "192.0.2.1:1237", ""); w.Code != 200 {
+		t.Errorf("asset got %d", w.Code)
+	}
+	if w := get("/energy", "192.0.2.2:1234", ""); w.Code != 200 {
+		t.Errorf("another client got %d", w.Code)
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "169.254.1.1:5000"
+	r.Header.Add("X-Forwarded-For", "203.0.113.9, 198.51.100.7")
+	if got := clientAddr(r, false); got != "169.254.1.1" {
+		t.Errorf("untrusted got %s", got)
+	}
+	if got := clientAddr(r, true); got != "198.51.100.7" {
+		t.Errorf("trusted got %s, want the hop the proxy added", got)
+	}
+}
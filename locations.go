@@ -0,0 +1,300 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// LocationInfo is a registered location and its metadata.
+type LocationInfo struct {
+	ID              string         `json:"id" yaml:"id"`
+	Name            string         `json:"name" yaml:"name"`
+	Timezone        string         `json:"timezone" yaml:"timezone"`
+	Latitude        float64        `json:"latitude" yaml:"latitude"`
+	Longitude       float64        `json:"longitude" yaml:"longitude"`
+	BatteryCapacity float64        `json:"batteryCapacity" yaml:"battery_capacity"` // kWh
+	PVSize          float64        `json:"pvSize" yaml:"pv_size"`                   // kW
+	Tariff          float64        `json:"tariff" yaml:"tariff"`                    // price per kWh, 0 to use energy_price
+	MQTTTopic       string         `json:"mqttTopic" yaml:"mqtt_topic"`
+	TimeLocation    *time.Location `json:"-" yaml:"-"`
+}
+
+// Price is the location's tariff, falling back to the configured energy price.
+func (l LocationInfo) Price() float64 {
+	if l.Tariff > 0 {
+		return l.Tariff
+	}
+	return energyPrice()
+}
+
+// TZ is the location's timezone, falling back to the server's.
+func (l LocationInfo) TZ() *time.Location {
+	if l.TimeLocation != nil {
+		return l.TimeLocation
+	}
+	return time.Local
+}
+
+// ChartTimezone is the IANA name of the location's timezone for Highcharts, which has no "Local".
+func (l LocationInfo) ChartTimezone() string {
+	if name := l.TZ().String(); name != "Local" {
+		return name
+	}
+	return localZoneName()
+}
+
+// localZoneName works out the IANA name of the server's timezone from TZ or /etc/localtime.
+func localZoneName() string {
+	if tz := strings.TrimPrefix(os.Getenv("TZ"), ":"); tz != "" {
+		if _, err := time.LoadLocation(tz); err == nil {
+			return tz
+		}
+	}
+	if target, err := os.Readlink("/etc/localtime"); err == nil {
+		if _, name, ok := strings.Cut(target, "zoneinfo/"); ok {
+			return name
+		}
+	}
+	return "UTC"
+}
+
+// locationTZ is the timezone of a registered location, or the server's for unknown ones.
+func locationTZ(id string) *time.Location {
+	l, _ := registry.lookup(id)
+	return l.TZ()
+}
+
+// localTime converts unix seconds to the location's wall clock time.
+func localTime(id string, dt int64) time.Time {
+	return time.Unix(dt, 0).In(locationTZ(id))
+}
+
+// dayStart is local midnight of t's day. Days are 23 or 25 hours long across DST changes,
+// so day boundaries have to come from here rather than from adding 86400 seconds.
+func dayStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// locationRegistry holds the known locations, keyed by upper-case ID.
+type locationRegistry struct {
+	mu        sync.RWMutex
+	locations map[string]LocationInfo
+}
+
+var registry = &locationRegistry{locations: make(map[string]LocationInfo)}
+
+// lookup returns the location with the given ID.
+func (reg *locationRegistry) lookup(id string) (LocationInfo, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	l, ok := reg.locations[strings.ToUpper(id)]
+	return l, ok
+}
+
+// list returns every location, sorted by ID.
+func (reg *locationRegistry) list() []LocationInfo {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	all := make([]LocationInfo, 0, len(reg.locations))
+	for _, l := range reg.locations {
+		all = append(all, l)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+	return all
+}
+
+// ids returns every location ID, sorted.
+func (reg *locationRegistry) ids() []string {
+	all := reg.list()
+	ids := make([]string, len(all))
+	for i, l := range all {
+		ids[i] = l.ID
+	}
+	return ids
+}
+
+// set replaces the registry contents.
+func (reg *locationRegistry) set(all []LocationInfo) {
+	m := make(map[string]LocationInfo, len(all))
+	for _, l := range all {
+		m[l.ID] = l
+	}
+	reg.mu.Lock()
+	reg.locations = m
+	reg.mu.Unlock()
+}
+
+// defaultID is the configured default location, VT unless set, if it is registered, otherwise the
+// first registered location.
+func (reg *locationRegistry) defaultID() string {
+	if id := strings.ToUpper(config().DefaultLocation); id != "" {
+		if _, ok := reg.lookup(id); ok {
+			return id
+		}
+	}
+	if ids := reg.ids(); len(ids) > 0 {
+		return ids[0]
+	}
+	return ""
+}
+
+// normalizeLocation fills in defaults and checks the metadata.
+func normalizeLocation(l LocationInfo) (LocationInfo, error) {
+	l.ID = strings.ToUpper(strings.TrimSpace(l.ID))
+	if l.ID == "" {
+		return l, fmt.Errorf("location has no id")
+	}
+	if l.Name == "" {
+		l.Name = l.ID
+	}
+	if l.MQTTTopic == "" {
+		l.MQTTTopic = "energy/" + strings.ToLower(l.ID) + "/energy"
+	}
+	if l.Timezone == "" {
+		l.Timezone = "Local"
+	}
+	tz, err := time.LoadLocation(l.Timezone)
+	if err != nil {
+		return l, fmt.Errorf("location %s: %w", l.ID, err)
+	}
+	l.TimeLocation = tz
+	if l.Latitude < -90 || l.Latitude > 90 || l.Longitude < -180 || l.Longitude > 180 {
+		return l, fmt.Errorf("location %s: bad coordinates %f,%f", l.ID, l.Latitude, l.Longitude)
+	}
+	return l, nil
+}
+
+const createLocationsTable = `create table if not exists locations (
+	id varchar(16) not null primary key,
+	name varchar(64) not null,
+	timezone varchar(64) not null,
+	latitude double not null default 0,
+	longitude double not null default 0,
+	battery_capacity double not null default 0,
+	pv_size double not null default 0,
+	tariff double not null default 0,
+	mqtt_topic varchar(128) not null default ''
+)`
+
+func getRegisteredLocations() ([]LocationInfo, error) {
+	log.Debug().Msg("getRegisteredLocations()")
+	rows, err := db.Query("select id, name, timezone, latitude, longitude, battery_capacity, pv_size, tariff, mqtt_topic from locations order by id")
+	if err != nil {
+		log.Error().Err(err).Msgf("getRegisteredLocations(): %+v", err)
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			log.Error().Err(err).Stack().Msg("error closing rows")
+		}
+	}(rows)
+	all := make([]LocationInfo, 0)
+	for rows.Next() {
+		var l LocationInfo
+		if err := rows.Scan(&l.ID, &l.Name, &l.Timezone, &l.Latitude, &l.Longitude, &l.BatteryCapacity, &l.PVSize, &l.Tariff, &l.MQTTTopic); err != nil {
+			log.Error().Err(err).Msgf("getRegisteredLocations(): %+v", err)
+			return all, err
+		}
+		if l, err = normalizeLocation(l); err != nil {
+			return all, err
+		}
+		all = append(all, l)
+	}
+	return all, rows.Err()
+}
+
+// loadLocationRegistry reads the locations table, first registering any location that
+// already has data so existing installs keep working.
+func loadLocationRegistry() error {
+	dbConnect()
+	if _, err := db.Exec(createLocationsTable); err != nil {
+		log.Error().Err(err).Msg("creating locations")
+		return err
+	}
+	known, err := getLocations()
+	if err != nil {
+		return err
+	}
+	for _, id := range known {
+		_, err := db.Exec("insert ignore into locations (id, name, timezone, mqtt_topic) values (?, ?, ?, ?)",
+			strings.ToUpper(id), strings.ToUpper(id), "Local", "energy/"+strings.ToLower(id)+"/energy")
+		if err != nil {
+			log.Error().Err(err).Msgf("registering location %s", id)
+			return err
+		}
+	}
+	all, err := getRegisteredLocations()
+	if err != nil {
+		return err
+	}
+	merged := mergeLocations(all, config().Locations)
+	for _, l := range merged {
+		if l.Timezone == "Local" {
+			log.Warn().Msgf("location %s has no timezone, so its days follow the server's (%s); set its timezone in the config or the locations table", l.ID, localZoneName())
+		}
+	}
+	registry.set(merged)
+	log.Info().Msgf("loaded %d locations", len(all))
+	return nil
+}
+
+// mergeLocations overlays the locations from the config file on the ones in the database.
+func mergeLocations(stored []LocationInfo, configured []LocationInfo) []LocationInfo {
+	byID := make(map[string]int, len(stored))
+	merged := append([]LocationInfo(nil), stored...)
+	for i, l := range merged {
+		byID[l.ID] = i
+	}
+	for _, l := range configured {
+		if i, ok := byID[l.ID]; ok {
+			merged[i] = l
+		} else {
+			merged = append(merged, l)
+		}
+	}
+	return merged
+}
+
+// defaultLocationID is the default location, or the user's first location if they can't see it.
+func defaultLocationID(r *http.Request) string {
+	id := registry.defaultID()
+	if visible := visibleLocations(r); !requestUser(r).canSee(id) && len(visible) > 0 {
+		id = visible[0].ID
+	}
+	return id
+}
+
+// requestLocation returns the location named by the location query parameter, or the default
+// location if there is none, or the user's first location if they can't see the default.
+// Unknown locations and locations the user can't see get the same 404, so a user can't tell
+// which other locations exist, and ok is false.
+func requestLocation(w http.ResponseWriter, r *http.Request) (LocationInfo, bool) {
+	u := requestUser(r)
+	id := defaultLocationID(r)
+	if keys, ok := r.URL.Query()["location"]; ok && len(keys) == 1 && keys[0] != "" {
+		id = keys[0]
+	}
+	l, ok := registry.lookup(id)
+	if !ok {
+		log.Debug().Msgf("unknown location [%s]", id)
+	} else if !u.canSee(l.ID) {
+		log.Warn().Msgf("%s can't see location %s", u.Name, l.ID)
+		ok = false
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown location %q", id), http.StatusNotFound)
+	}
+	return l, ok
+}
+
+func locationsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, visibleLocations(r))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNormalizeLocation(t *testing.T) {
+	l, err := normalizeLocation(LocationInfo{ID: " vt ", Timezone: "America/New_York"})
+	if err != nil {
+		t.Fatalf("normalizeLocation: %v", err)
+	}
+	if l.ID != "VT" || l.Name != "VT" || l.MQTTTopic != "energy/vt/energy" || l.TimeLocation.String() != "America/New_York" {
+		t.Errorf("unexpected location: %+v", l)
+	}
+	if _, err := normalizeLocation(LocationInfo{ID: "VT", Timezone: "Mars/Olympus_Mons"}); err == nil {
+		t.Error("expected an error for an unknown timezone")
+	}
+	if _, err := normalizeLocation(LocationInfo{ID: "VT", Latitude: 91}); err == nil {
+		t.Error("expected an error for a bad latitude")
+	}
+}
+
+func TestUnknownLocationIs404(t *testing.T) {
+	testInit()
+	registry.set([]LocationInfo{{ID: "VT", Name: "Vermont"}})
+	defer registry.set(nil)
+
+	handlers := map[string]http.HandlerFunc{
+		"/energy":        energyHandler,
+		"/live":          liveHandler,
+		"/baseload":      baseloadHandler,
+		"/compare":       compareHandler,
+		"/weather":       weatherHandler,
+		"/api/anomalies": anomalyAPIHandler,
+		"/api/demand":    demandAPIHandler,
+	}
+	for path, h := range handlers {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", path+"?location=nowhere", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want 404", path, w.Code)
+		}
+	}
+
+	l, ok := registry.lookup("vt")
+	if !ok || l.Name != "Vermont" {
+		t.Errorf("lookup is not case insensitive: %+v %v", l, ok)
+	}
+	if id := registry.defaultID(); id != "VT" {
+		t.Errorf("got default %q, want VT", id)
+	}
+	// VT stays the default when other locations sort before it
+	registry.set([]LocationInfo{{ID: "MA"}, {ID: "VT"}})
+	if id := registry.defaultID(); id != "VT" {
+		t.Errorf("got default %q with MA registered, want VT", id)
+	}
+	registry.set([]LocationInfo{{ID: "NH"}, {ID: "MA"}})
+	if id := registry.defaultID(); id != "MA" {
+		t.Errorf("got default %q without VT, want the first location", id)
+	}
+}
+
+func TestDayStartAcrossDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no tzdata")
+	}
+	tests := []struct {
+		day   time.Time
+		hours float64
+	}{
+		{time.Date(2026, 3, 8, 12, 0, 0, 0, ny), 23},  // spring forward
+		{time.Date(2026, 11, 1, 12, 0, 0, 0, ny), 25}, // fall back
+		{time.Date(2026, 6, 14, 12, 0, 0, 0, ny), 24},
+	}
+	for _, tc := range tests {
+		begin := dayStart(tc.day)
+		end := dayStart(begin.AddDate(0, 0, 1))
+		if begin.Hour() != 0 || begin.Day() != tc.day.Day() {
+			t.Errorf("dayStart(%s) = %s", tc.day, begin)
+		}
+		if got := end.Sub(begin).Hours(); got != tc.hours {
+			t.Errorf("%s is %v hours long, want %v", tc.day.Format("2006-01-02"), got, tc.hours)
+		}
+	}
+}
+
+func TestLocalTime(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no tzdata")
+	}
+	registry.set([]LocationInfo{{ID: "VT", TimeLocation: ny}, {ID: "UK", TimeLocation: time.UTC}})
+	defer registry.set(nil)
+
+	// 2026-11-01 06:30 UTC is the second 01:30 in New York
+	dt := time.Date(2026, 11, 1, 6, 30, 0, 0, time.UTC).Unix()
+	if got := localTime("vt", dt).Format("2006-01-02 15:04 MST"); got != "2026-11-01 01:30 EST" {
+		t.Errorf("VT: got %s", got)
+	}
+	if got := localTime("UK", dt).Format("2006-01-02 15:04"); got != "2026-11-01 06:30" {
+		t.Errorf("UK: got %s", got)
+	}
+	if tz := locationTZ("nowhere"); tz != time.Local {
+		t.Errorf("unknown location: got %s, want Local", tz)
+	}
+
+	l, _ := registry.lookup("VT")
+	if tz := l.ChartTimezone(); tz != "America/New_York" {
+		t.Errorf("got chart timezone %q", tz)
+	}
+}
@@ -3,11 +3,10 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"html/template"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
-	"text/template"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -23,13 +22,17 @@ type templateData struct {
 	Service      string
 	Revision     string
 	Stats        TopStats
-	LoadData     string
-	SiteData     string
-	BatteryData  string
-	SolarData    string
+	LoadData     []chartPoint
+	SiteData     []chartPoint
+	BatteryData  []chartPoint
+	SolarData    []chartPoint
 	MQTTSubTopic string
 	LiveLimit    int
+	MQTT         MQTTConfig
 	Location     string
+	Info         LocationInfo
+	FillZones    []chartZone
+	Gaps         chartGaps
 }
 
 type PctDisplayRecord struct {
@@ -41,6 +44,7 @@ type PctDisplayRecord struct {
 
 type TopStats struct {
 	Location              string
+	Info                  LocationInfo
 	AsOf                  time.Time
 	SiteInstantPower      int
 	LoadInstantPower      int
@@ -53,11 +57,25 @@ type TopStats struct {
 	FiveMinBatteryHistory []BatteryPctDisplayRecord
 	StatsHistory          []StatsDisplayRecord
 	EnergyHistory         []StatsDisplayRecord
-	ConsumedGraphData     string
-	ProducedGraphData     string
-	BatteryGraphData      string
-	SiteGraphData         string
-	BatteryPctGraphData   string
+	ConsumedGraphData     []chartPoint
+	ProducedGraphData     []chartPoint
+	BatteryGraphData      []chartPoint
+	SiteGraphData         []chartPoint
+	BatteryPctGraphData   []chartPoint
+	FillZones             []chartZone
+	BatteryPctFillZones   []chartZone
+	Gaps                  chartGaps
+	ViewBegin             int64 // ms, the range the charts first show
+	ViewEnd               int64
+	Range                 DateRange
+	Limit                 int
+	Anomalies             []LoadAnomaly
+	AnomalyAnnotations    []chartAnnotation
+	DemandMinutes         int
+	CurrentDemand         DemandWindow
+	DemandPeaks           []DemandPeak
+	CarbonEnabled         bool
+	Carbon                CarbonReport
 }
 
 type BatteryPctDisplayRecord struct {
@@ -136,6 +154,8 @@ type StatsDisplayRecord struct {
 	NumSolarSamples     int
 	TotalSolarSamples   float64
 	SolarAvg            float64
+	GridCO2             float64
+	AvoidedCO2          float64
 }
 
 // Variables used to generate the HTML page.
@@ -158,14 +178,14 @@ func initLogs() {
 	zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 
-	if os.Getenv("CONSOLE") != "" {
+	if config().Console {
 		log.Info().Msg("logging to console")
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	} else {
 		log.Output(os.Stdout)
 	}
 
-	if os.Getenv("DEBUG") != "" {
+	if config().Debug {
 		zerolog.SetGlobalLevel(zerolog.TraceLevel)
 		log.Info().Msg("enabling Trace level logging")
 	} else {
@@ -174,15 +194,12 @@ func initLogs() {
 }
 
 func dbConnect() {
-	dbName := os.Getenv("DB_NAME")
-	user := os.Getenv("DB_USER")
-	passwd := os.Getenv("DB_PASS")
-	instanceConnectionName := os.Getenv("INSTANCE_CONNECTION_NAME")
-	socketDir, socketIsSet := os.LookupEnv("DB_SOCKET_DIR")
-	// log.Debug("env", "DB_NAME", dbName).Msg("")
-	if !socketIsSet {
-		socketDir = "/cloudsql"
-	}
+	c := config().DB
+	dbName := c.Name
+	user := c.User
+	passwd := c.Password
+	instanceConnectionName := c.InstanceConnectionName
+	socketDir := c.SocketDir
 
 	dbURI := fmt.Sprintf("%s:%s@unix(%s/%s)/%s?parseTime=true",
 		user, passwd, socketDir, instanceConnectionName, dbName)
@@ -215,74 +232,83 @@ func dbConnect() {
 	log.Fatal().Err(err).Msgf("Could not connect to database: %s", err)
 }
 
-func statsChartData(in []StatsDisplayRecord) (production string, consumption string, grid string, battery string) {
+// statsChartData is the stats records' averages as Highcharts series, with the zones that mark
+// filled gaps.
+func statsChartData(in []StatsDisplayRecord, g chartGaps) (production []chartPoint, consumption []chartPoint, grid []chartPoint, battery []chartPoint, zones []chartZone) {
 	log.Debug().Msg("statsChartData()")
-	var prod, cons, site, batt strings.Builder
-
-	prod.WriteString("[")
-	cons.WriteString("[")
-	site.WriteString("[")
-	batt.WriteString("[")
-	n := 0
+	prod, cons, site, batt := make([]chartPoint, 0, len(in)), make([]chartPoint, 0, len(in)), make([]chartPoint, 0, len(in)), make([]chartPoint, 0, len(in))
 	for _, v := range in {
 		dt := v.DateTime * 1000
-		prod.WriteString(fmt.Sprintf("[%d,%f],", dt, v.SolarAvg))
-		cons.WriteString(fmt.Sprintf("[%d,%f],", dt, v.LoadAvg))
-		site.WriteString(fmt.Sprintf("[%d,%f],", dt, v.SiteAvg))
-		batt.WriteString(fmt.Sprintf("[%d,%f],", dt, v.BatteryAvg))
-		n++
-	}
-	prod.WriteString("]")
-	cons.WriteString("]")
-	site.WriteString("]")
-	batt.WriteString("]")
-
-	log.Debug().Msgf("statsChartData() done: %d rows processed", n)
-	return prod.String(), cons.String(), site.String(), batt.String()
+		prod = append(prod, chartPoint{X: dt, Y: v.SolarAvg})
+		cons = append(cons, chartPoint{X: dt, Y: v.LoadAvg})
+		site = append(site, chartPoint{X: dt, Y: v.SiteAvg})
+		batt = append(batt, chartPoint{X: dt, Y: v.BatteryAvg})
+	}
+	prod = fillGaps(prod, g)
+
+	log.Debug().Msgf("statsChartData() done: %d rows processed", len(in))
+	return prod, fillGaps(cons, g), fillGaps(site, g), fillGaps(batt, g), fillZones(prod)
 }
 
-func liveChartData(in []EnergyDisplayRecord) (p string, c string, s string, b string) {
-	var prod, cons, site, batt strings.Builder
+// liveChartData is the recent samples as Highcharts series, with the zones that mark filled gaps.
+func liveChartData(in []EnergyDisplayRecord, g chartGaps) (p []chartPoint, c []chartPoint, s []chartPoint, b []chartPoint, zones []chartZone) {
+	prod, cons, site, batt := make([]chartPoint, 0, len(in)), make([]chartPoint, 0, len(in)), make([]chartPoint, 0, len(in)), make([]chartPoint, 0, len(in))
+	for _, v := range in {
+		dt := v.AsOf.UnixMilli()
+		cons = append(cons, chartPoint{X: dt, Y: v.Load})
+		site = append(site, chartPoint{X: dt, Y: v.Site})
+		batt = append(batt, chartPoint{X: dt, Y: v.Battery})
+		prod = append(prod, chartPoint{X: dt, Y: v.Solar})
+	}
+	prod = fillGaps(prod, g)
 
-	prod.WriteString("[")
-	cons.WriteString("[")
-	site.WriteString("[")
-	batt.WriteString("[")
+	log.Debug().Msgf("liveChartData() done: %d rows processed", len(in))
+	return prod, fillGaps(cons, g), fillGaps(site, g), fillGaps(batt, g), fillZones(prod)
+}
 
-	n := 0
+// batteryChartData is the average charge as a Highcharts series, with the zones that mark
+// filled gaps.
+func batteryChartData(in []BatteryPctDisplayRecord, g chartGaps) (p []chartPoint, zones []chartZone) {
+	pct := make([]chartPoint, 0, len(in))
 	for _, v := range in {
-		dt := v.AsOf.Local().Unix() * 1000
-		cons.WriteString(fmt.Sprintf("[%d,%f],", dt, v.Load))
-		site.WriteString(fmt.Sprintf("[%d,%f],", dt, v.Site))
-		batt.WriteString(fmt.Sprintf("[%d,%f],", dt, v.Battery))
-		prod.WriteString(fmt.Sprintf("[%d,%f],", dt, v.Solar))
+		pct = append(pct, chartPoint{X: v.DateTime * 1000, Y: v.AvgPct})
 	}
+	pct = fillGaps(pct, g)
+	return pct, fillZones(pct)
+}
 
-	prod.WriteString("]")
-	cons.WriteString("]")
-	site.WriteString("]")
-	batt.WriteString("]")
+// statsByLocation queries for the summary information for a site, with the last limit days of
+// history before endDate.
+func statsByLocation(location string, beginDate int64, endDate int64, limit int) (TopStats, error) {
+	log.Debug().Msgf("statsByLocation(%s, %d, %d, %d)", location, beginDate, endDate, limit)
+	start := time.Now()
+	stats, err := currentStats(location)
+	if err != nil {
+		return stats, err
+	}
 
-	log.Debug().Msgf("liveChartData() done: %d rows processed", n)
-	return prod.String(), cons.String(), site.String(), batt.String()
-}
+	// Battery percent history
+	battHistory, err := getDayBatteryPct(location, beginDate, endDate, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("getDayBatteryPct()")
+	}
+	stats.DayBatteryHistory = battHistory
 
-func batteryChartData(in []BatteryPctDisplayRecord) (p string) {
-	var pct strings.Builder
-	pct.WriteString("[")
-	for _, v := range in {
-		dt := v.DateTime * 1000
-		pct.WriteString(fmt.Sprintf("[%d,%f],", dt, v.AvgPct))
+	// Stats history
+	statsHistory, err := getDayStats(location, beginDate, endDate, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("getDayStats()")
 	}
-	pct.WriteString("]")
-	return pct.String()
+	stats.StatsHistory = statsHistory
+
+	stats.QueryTime = time.Since(start)
+	return stats, nil
 }
 
-// statsByLocation queries for the summary information for a site.
-func statsByLocation(location string, limit int) (TopStats, error) {
-	log.Debug().Msgf("statsByLocation(%s, %d)", location, limit)
+// currentStats queries for the latest power flows and battery charge for a site.
+func currentStats(location string) (TopStats, error) {
+	log.Debug().Msgf("currentStats(%s)", location)
 	dbConnect()
-	start := time.Now()
 	var stats TopStats
 	row := db.QueryRow("SELECT dt asof, payload->>'$.load.instant_power' ld, payload->>'$.battery.instant_power' battery, payload->>'$.site.instant_power' site, payload->>'$.solar.instant_power' solar FROM energy where location = ? order by asOf desc limit 1;", location)
 	var load, battery, site, solar float64
@@ -304,7 +330,7 @@ func statsByLocation(location string, limit int) (TopStats, error) {
 		return stats, err
 	}
 
-	timeLoc, _ := time.LoadLocation("Local")
+	timeLoc := locationTZ(location)
 	stats.Location = strings.ToUpper(location)
 	stats.AsOf = stats.AsOf.In(timeLoc)
 	stats.LoadInstantPower = int(load)
@@ -312,22 +338,6 @@ func statsByLocation(location string, limit int) (TopStats, error) {
 	stats.SiteInstantPower = int(site)
 	stats.SolarInstantPower = int(solar)
 	stats.BatteryChargeAsOf = stats.BatteryChargeAsOf.In(timeLoc)
-
-	// Battery percent history
-	battHistory, err := getDayBatteryPct(location, limit)
-	if err != nil {
-		log.Error().Err(err).Msg("getDayBatteryPct()")
-	}
-	stats.DayBatteryHistory = battHistory
-
-	// Stats history
-	statsHistory, err := getDayStats(location, limit)
-	if err != nil {
-		log.Error().Err(err).Msg("getDayBatteryPct()")
-	}
-	stats.StatsHistory = statsHistory
-
-	stats.QueryTime = time.Since(start)
 	return stats, nil
 }
 
@@ -354,101 +364,169 @@ func currentEnergyByLocation(location string, limit int) ([]EnergyDisplayRecord,
 			return energyList, err
 		}
 		energy.Location = location
-		timeLoc, _ := time.LoadLocation("Local")
-		energy.AsOf = energy.AsOf.In(timeLoc)
+		energy.AsOf = energy.AsOf.In(locationTZ(location))
 		energyList = append(energyList, energy)
 	}
 	return energyList, nil
 }
 
 func main() {
-	initLogs()
-	log.Debug().Msg("about to call dbConnect()")
-	dbConnect()
-	log.Debug().Msg("done calling dbConnect()")
+	os.Exit(runCLI(os.Args[1:]))
+}
 
+// serve registers the pages and APIs, starts the background detectors and serves HTTP until it fails.
+func serve(configFile string) error {
+	if err := checkAssets(); err != nil {
+		return err
+	}
+	homeTmpl = parseTemplate("index.html")
 	http.HandleFunc("/", indexHandler)
 
+	loginTmpl = parseTemplate("login.html")
+	http.HandleFunc("/login", loginHandler)
+	http.HandleFunc("/logout", logoutHandler)
+	http.HandleFunc(oidcCallbackPath, oidcCallbackHandler)
+
 	// Prepare template for execution.
-	liveTmpl = template.Must(template.ParseFiles("live.html"))
+	liveTmpl = parseTemplate("live.html")
 	liveData = templateData{
 		Service:  "live service",
 		Revision: "0.1",
 	}
 	http.HandleFunc("/live", liveHandler)
-	dashboardTmpl = template.Must(template.ParseFiles("dashboard.html"))
+	dashboardTmpl = parseTemplate("dashboard.html")
 
 	http.HandleFunc("/energy", energyHandler)
+	http.HandleFunc("/api/chart", chartAPIHandler)
+	http.HandleFunc("/api/locations", locationsAPIHandler)
+	http.HandleFunc("/api/cache", cacheAPIHandler)
+
+	weatherTmpl = parseTemplate("weather.html")
+	http.HandleFunc("/weather", weatherHandler)
+	http.HandleFunc("/api/weather", weatherAPIHandler)
+	http.HandleFunc("/api/anomalies", anomalyAPIHandler)
+
+	baseloadTmpl = parseTemplate("baseload.html")
+	http.HandleFunc("/baseload", baseloadHandler)
+	http.HandleFunc("/api/baseload", baseloadAPIHandler)
+
+	http.HandleFunc("/api/demand", demandAPIHandler)
 
-	fs := http.FileServer(http.Dir("./assets"))
-	http.Handle("/assets/", http.StripPrefix("/assets/", fs))
+	compareTmpl = parseTemplate("compare.html")
+	http.HandleFunc("/compare", compareHandler)
+	http.HandleFunc("/api/compare", compareAPIHandler)
 
-	// PORT environment variable is provided by Cloud Run.
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	overviewTmpl = parseTemplate("overview.html")
+	http.HandleFunc("/overview", overviewHandler)
+	http.HandleFunc("/api/overview", overviewAPIHandler)
+
+	http.HandleFunc("/api/carbon", carbonAPIHandler)
+
+	qualityTmpl = parseTemplate("quality.html")
+	http.HandleFunc("/quality", qualityHandler)
+	http.HandleFunc("/api/quality", qualityAPIHandler)
+
+	if configFile != "" {
+		watchConfig(configFile)
 	}
+	alerts := configuredAlertSink{}
+	startAnomalyDetector(alerts)
+	startDemandTracker(alerts)
+
+	http.Handle("/assets/", assetHandler())
+
+	// PORT environment variable is provided by Cloud Run and overrides the config file.
+	port := config().Port
 
 	log.Info().Msgf("Listening on port %s", port)
-	err := http.ListenAndServe(":"+port, nil)
-	if err != nil {
-		log.Fatal().Err(err).Msg("http.ListenAndServe()")
-	}
+	return http.ListenAndServe(":"+port, compress(rateLimit(authenticate(conditional(http.DefaultServeMux, requestDataVersion)))))
 }
 
 func energyHandler(w http.ResponseWriter, r *http.Request) {
-	var stats TopStats
-	var location string
-	keys, ok := r.URL.Query()["location"]
-	if !ok || len(keys) != 1 {
-		location = "VT"
-	} else {
-		location = strings.ToUpper(keys[0])
+	loc, ok := requestLocation(w, r)
+	if !ok {
+		return
 	}
+	location := loc.ID
 	log.Debug().Msgf(`location: %s`, location)
 
-	defaultLimit, err := strconv.Atoi(os.Getenv("DEFAULT_LIMIT"))
+	limit, err := rowsParam(r, "limit", config().DefaultLimit)
 	if err != nil {
-		log.Error().Err(err).Msg("DEFAULT_LIMIT failed strconv.Atoi()")
-		defaultLimit = 7
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	var limit int
 
-	limits, ok := r.URL.Query()["limit"]
-	if !ok || len(limits[0]) < 1 {
-		limit = defaultLimit
-	} else {
-		l, err := strconv.Atoi(limits[0])
-		if err != nil {
-			log.Warn().Msgf("limit [%s] not an integer - using %d", keys[0], defaultLimit)
-			limit = defaultLimit
-		} else {
-			limit = l
-		}
+	rng, err := requestRange(r, loc.TZ(), time.Now(), config().GraphDays)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	beginDate, endDate := rng.Begin.Unix(), rng.End.Unix()
 
-	stats, err = statsByLocation(location, limit)
+	stats, err := statsByLocation(location, beginDate, endDate, limit)
+	if err != nil {
+		s := fmt.Sprintf("%+v", err)
+		http.Error(w, s, http.StatusInternalServerError)
+		return
+	}
+	stats.Info = loc
+	stats.Range = rng
+	stats.Limit = limit
+
+	// the charts start with a daily overview of as much history as the budgets allow, and fetch
+	// the rollups for the range they show from /api/chart, starting with the range's last day
+	now := time.Now()
+	stats.Gaps = requestChartGaps(r)
+	overviewEnd := dayStart(now.In(loc.TZ())).AddDate(0, 0, 1)
+	overview, err := chartData(loc, chartBudget(time.Unix(0, 0), overviewEnd), overviewEnd, stats.Gaps)
 	if err != nil {
 		s := fmt.Sprintf("%+v", err)
 		http.Error(w, s, http.StatusInternalServerError)
+		return
 	}
+	stats.ProducedGraphData, stats.ConsumedGraphData, stats.SiteGraphData, stats.BatteryGraphData = overview.Solar, overview.Load, overview.Grid, overview.Battery
+	stats.FillZones, stats.BatteryPctGraphData, stats.BatteryPctFillZones = overview.Zones, overview.BatteryPct, overview.BatteryPctZones
+	viewEnd := rng.End
+	if now.Before(viewEnd) {
+		viewEnd = now
+	}
+	viewBegin := viewEnd.Add(-24 * time.Hour)
+	if viewBegin.Before(rng.Begin) {
+		viewBegin = rng.Begin
+	}
+	stats.ViewBegin, stats.ViewEnd = viewBegin.UnixMilli(), viewEnd.UnixMilli()
 
-	const graphDays = 60
-	beginDate := time.Now().Local().AddDate(0, 0, -1*graphDays).Unix()
-	endDate := time.Now().Local().Unix()
-	fiveMinStatRecs, err := getFiveMinStats(location, beginDate, endDate)
+	// enough five minute stats for the current demand window
+	fiveMinStatRecs, err := getFiveMinStats(location, viewBegin.Unix(), viewEnd.Unix()-1)
 	if err != nil {
 		log.Error().Err(err).Msg("getFiveMinStats()")
 	}
 	stats.EnergyHistory = fiveMinStatRecs
-	stats.ProducedGraphData, stats.ConsumedGraphData, stats.SiteGraphData, stats.BatteryGraphData = statsChartData(fiveMinStatRecs)
 
-	fiveMinBatteryRecs, err := getFiveMinBattery(location, beginDate, endDate)
+	anomalies, err := getLoadAnomalies(location, beginDate, endDate-1)
+	if err != nil {
+		log.Error().Err(err).Msg("getLoadAnomalies()")
+	}
+	stats.Anomalies = anomalies
+	stats.AnomalyAnnotations = anomalyAnnotations(anomalies)
+
+	stats.DemandMinutes = demandWindowMinutes()
+	if windows := rollingDemand(fiveMinStatRecs, stats.DemandMinutes); len(windows) > 0 {
+		stats.CurrentDemand = windows[len(windows)-1]
+	}
+	stats.DemandPeaks, err = getDemandPeaks(location, stats.DemandMinutes, rng.To[:7], 12)
 	if err != nil {
-		log.Error().Stack().Err(err).Msg("getFiveMinBattery()")
+		log.Error().Err(err).Msg("getDemandPeaks()")
+	}
+
+	if p := carbonProfile(); p != nil {
+		stats.CarbonEnabled = true
+		stats.Carbon, err = carbonReport(location, p, beginDate, endDate)
+		if err != nil {
+			log.Error().Err(err).Msg("carbonReport()")
+		}
+		addDailyCarbon(stats.StatsHistory, stats.Carbon.Daily)
 	}
-	stats.FiveMinBatteryHistory = fiveMinBatteryRecs
-	stats.BatteryPctGraphData = batteryChartData(fiveMinBatteryRecs)
 
 	if err := dashboardTmpl.Execute(w, stats); err != nil {
 		msg := http.StatusText(http.StatusInternalServerError)
@@ -456,60 +534,106 @@ func energyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// indexHandler responds by redirecting to Google search.
-func indexHandler(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, "https://www.google.com", 301)
-}
-
 func liveHandler(w http.ResponseWriter, r *http.Request) {
-	var location string
-	keys, ok := r.URL.Query()["location"]
-	if !ok || len(keys) != 1 {
-		log.Debug().Msgf(`no location specified in location url parameter. using VT`)
-		location = "VT"
-	} else {
-		location = strings.ToUpper(keys[0])
+	loc, ok := requestLocation(w, r)
+	if !ok {
+		return
 	}
+	location := loc.ID
 	log.Debug().Msgf(`location: %s`, location)
 
-	limit, ok := r.URL.Query()["limit"]
-	if !ok || len(limit) != 1 {
-		log.Debug().Msgf(`no limit specified in limit url parameter. using 2000`)
-		liveData.LiveLimit = 2000
-	} else {
-		var err error
-		if liveData.LiveLimit, err = strconv.Atoi(limit[0]); err != nil {
-			liveData.LiveLimit = 2000
-			log.Warn().Msgf("limit [%s] not an integer - using %d", limit[0], liveData.LiveLimit)
-		}
+	limit, err := rowsParam(r, "limit", config().LiveLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	log.Debug().Msgf(`LiveLimit: %d`, liveData.LiveLimit)
+	// liveData only holds what every page shares; each request gets its own copy
+	data := liveData
+	data.LiveLimit = limit
+	log.Debug().Msgf(`LiveLimit: %d`, data.LiveLimit)
 
-	recs, err := currentEnergyByLocation(location, liveData.LiveLimit)
+	recs, err := currentEnergyByLocation(location, data.LiveLimit)
 	if err != nil {
 		s := fmt.Sprintf("%+v", err)
 		http.Error(w, s, http.StatusInternalServerError)
+		return
 	}
 	log.Debug().Msgf("live recs: %+v", len(recs))
-	liveData.MQTTSubTopic = "energy/" + strings.ToLower(location) + "/energy" // works with wildcard # and + topics dynamically now
-	log.Debug().Msgf(`liveData.MQTTSubTopic: %s`, liveData.MQTTSubTopic)
-
-	liveData.Location = location
-	liveData.SolarData, liveData.LoadData, liveData.SiteData, liveData.BatteryData = liveChartData(recs)
-	if err := liveTmpl.Execute(w, liveData); err != nil {
+	data.MQTTSubTopic = loc.MQTTTopic // works with wildcard # and + topics dynamically now
+	log.Debug().Msgf(`data.MQTTSubTopic: %s`, data.MQTTSubTopic)
+
+	data.Location = location
+	data.Info = loc
+	data.MQTT = config().MQTT
+	data.Gaps = requestChartGaps(r)
+	data.SolarData, data.LoadData, data.SiteData, data.BatteryData, data.FillZones = liveChartData(recs, data.Gaps)
+	if err := liveTmpl.Execute(w, data); err != nil {
 		msg := http.StatusText(http.StatusInternalServerError)
 		log.Error().Err(err).Stack().Msg(msg)
 	}
 }
 
-func getDayStats(location string, limit int) ([]StatsDisplayRecord, error) {
-	log.Debug().Msgf("getDayStats(%s, %d)", location, limit)
-	rows, err := db.Query(`select location, datetime,
+// getLocations returns every location that has daily stats.
+func getLocations() ([]string, error) {
+	log.Debug().Msg("getLocations()")
+	dbConnect()
+	rows, err := db.Query("select distinct location from day_top_stats order by location")
+	if err != nil {
+		log.Error().Err(err).Msgf("getLocations(): %+v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	locations := make([]string, 0)
+	for rows.Next() {
+		var location string
+		if err := rows.Scan(&location); err != nil {
+			log.Error().Err(err).Msgf("getLocations(): %+v", err)
+			return locations, err
+		}
+		locations = append(locations, location)
+	}
+	return locations, rows.Err()
+}
+
+// statsColumns are the columns of day_top_stats and five_min_top_stats read by scanStats.
+const statsColumns = `location, datetime,
        hi_site, hi_site_dt, low_site, low_site_dt, site_energy_imported, site_energy_exported, num_site_samples, total_site_samples,
 		   hi_load, hi_load_dt, low_load, low_load_dt, load_energy_imported, load_energy_exported, num_load_samples, total_load_samples,
 		   hi_battery, hi_battery_dt, low_battery, low_battery_dt, battery_energy_imported, battery_energy_exported, num_battery_samples, total_battery_samples,
-		   hi_solar, hi_solar_dt, low_solar, low_solar_dt, solar_energy_imported, solar_energy_exported, num_solar_samples, total_solar_samples
-			from day_top_stats where location = ? order by datetime desc limit ?`, location, limit)
+		   hi_solar, hi_solar_dt, low_solar, low_solar_dt, solar_energy_imported, solar_energy_exported, num_solar_samples, total_solar_samples`
+
+// scanStats reads a row of statsColumns and fills in the display fields.
+func scanStats(rows *sql.Rows) (StatsDisplayRecord, error) {
+	var dbStats StatsDisplayRecord
+	err := rows.Scan(&dbStats.Location, &dbStats.DateTime,
+		&dbStats.HiSite, &dbStats.HiSiteTime, &dbStats.LowSite, &dbStats.LowSiteTime, &dbStats.SiteImported, &dbStats.SiteExported, &dbStats.NumSiteSamples, &dbStats.TotalSiteSamples,
+		&dbStats.HiLoad, &dbStats.HiLoadTime, &dbStats.LowLoad, &dbStats.LowLoadTime, &dbStats.LoadImported, &dbStats.LoadExported, &dbStats.NumLoadSamples, &dbStats.TotalLoadSamples,
+		&dbStats.HiBattery, &dbStats.HiBatteryTime, &dbStats.LowBattery, &dbStats.LowBatteryTime, &dbStats.BatteryImported, &dbStats.BatteryExported, &dbStats.NumBatterySamples, &dbStats.TotalBatterySamples,
+		&dbStats.HiSolar, &dbStats.HiSolarTime, &dbStats.LowSolar, &dbStats.LowSolarTime, &dbStats.SolarImported, &dbStats.SolarExported, &dbStats.NumSolarSamples, &dbStats.TotalSolarSamples)
+	if err != nil {
+		return dbStats, err
+	}
+	dbStats.DT = localTime(dbStats.Location, dbStats.DateTime).Format("2006-01-02")
+	dbStats.LowSiteDT = localTime(dbStats.Location, dbStats.LowSiteTime).Format("15:04")
+	dbStats.HiSiteDT = localTime(dbStats.Location, dbStats.HiSiteTime).Format("15:04")
+	dbStats.SiteAvg = dbStats.TotalSiteSamples / float64(dbStats.NumSiteSamples)
+	dbStats.LowBatteryDT = localTime(dbStats.Location, dbStats.LowBatteryTime).Format("15:04")
+	dbStats.HiBatteryDT = localTime(dbStats.Location, dbStats.HiBatteryTime).Format("15:04")
+	dbStats.BatteryAvg = dbStats.TotalBatterySamples / float64(dbStats.NumBatterySamples)
+	dbStats.LowLoadDT = localTime(dbStats.Location, dbStats.LowLoadTime).Format("15:04")
+	dbStats.HiLoadDT = localTime(dbStats.Location, dbStats.HiLoadTime).Format("15:04")
+	dbStats.LoadAvg = dbStats.TotalLoadSamples / float64(dbStats.NumLoadSamples)
+	dbStats.LowSolarDT = localTime(dbStats.Location, dbStats.LowSolarTime).Format("15:04")
+	dbStats.HiSolarDT = localTime(dbStats.Location, dbStats.HiSolarTime).Format("15:04")
+	dbStats.SolarAvg = dbStats.TotalSolarSamples / float64(dbStats.NumSolarSamples)
+	return dbStats, nil
+}
+
+// getDayStats returns the last limit days with beginDate <= datetime < endDate, newest first.
+func getDayStats(location string, beginDate int64, endDate int64, limit int) ([]StatsDisplayRecord, error) {
+	log.Debug().Msgf("getDayStats(%s, %d, %d, %d)", location, beginDate, endDate, limit)
+	rows, err := db.Query(`select `+statsColumns+`
+			from day_top_stats where location = ? and datetime >= ? and datetime < ? order by datetime desc limit ?`, location, beginDate, endDate, limit)
 	if err != nil {
 		log.Error().Err(err).Msgf("getDayStats(): %+v", err)
 		return nil, err
@@ -523,42 +647,58 @@ func getDayStats(location string, limit int) ([]StatsDisplayRecord, error) {
 	recs := make([]StatsDisplayRecord, 0)
 
 	for i := 0; i < limit && rows.Next(); i++ {
-		var dbStats StatsDisplayRecord
-		err = rows.Scan(&dbStats.Location, &dbStats.DateTime,
-			&dbStats.HiSite, &dbStats.HiSiteTime, &dbStats.LowSite, &dbStats.LowSiteTime, &dbStats.SiteImported, &dbStats.SiteExported, &dbStats.NumSiteSamples, &dbStats.TotalSiteSamples,
-			&dbStats.HiLoad, &dbStats.HiLoadTime, &dbStats.LowLoad, &dbStats.LowLoadTime, &dbStats.LoadImported, &dbStats.LoadExported, &dbStats.NumLoadSamples, &dbStats.TotalLoadSamples,
-			&dbStats.HiBattery, &dbStats.HiBatteryTime, &dbStats.LowBattery, &dbStats.LowBatteryTime, &dbStats.BatteryImported, &dbStats.BatteryExported, &dbStats.NumBatterySamples, &dbStats.TotalBatterySamples,
-			&dbStats.HiSolar, &dbStats.HiSolarTime, &dbStats.LowSolar, &dbStats.LowSolarTime, &dbStats.SolarImported, &dbStats.SolarExported, &dbStats.NumSolarSamples, &dbStats.TotalSolarSamples)
+		dbStats, err := scanStats(rows)
 		if err != nil {
 			log.Error().Err(err).Msgf("getDayStats(): %+v", err)
 			return nil, err
 		}
-		dbStats.DT = time.Unix(dbStats.DateTime, 0).Format("2006-01-02")
-		dbStats.LowSiteDT = time.Unix(dbStats.LowSiteTime, 0).Format("15:04")
-		dbStats.HiSiteDT = time.Unix(dbStats.HiSiteTime, 0).Format("15:04")
-		dbStats.SiteAvg = dbStats.TotalSiteSamples / float64(dbStats.NumSiteSamples)
-		dbStats.LowBatteryDT = time.Unix(dbStats.LowBatteryTime, 0).Format("15:04")
-		dbStats.HiBatteryDT = time.Unix(dbStats.HiBatteryTime, 0).Format("15:04")
-		dbStats.BatteryAvg = dbStats.TotalBatterySamples / float64(dbStats.NumBatterySamples)
-		dbStats.LowLoadDT = time.Unix(dbStats.LowLoadTime, 0).Format("15:04")
-		dbStats.HiLoadDT = time.Unix(dbStats.HiLoadTime, 0).Format("15:04")
-		dbStats.LoadAvg = dbStats.TotalLoadSamples / float64(dbStats.NumLoadSamples)
-		dbStats.LowSolarDT = time.Unix(dbStats.LowSolarTime, 0).Format("15:04")
-		dbStats.HiSolarDT = time.Unix(dbStats.HiSolarTime, 0).Format("15:04")
-		dbStats.SolarAvg = dbStats.TotalSolarSamples / float64(dbStats.NumSolarSamples)
 		recs = append(recs, dbStats)
 	}
 	log.Debug().Msgf("end getDayStats()")
 	return recs, nil
 }
 
+// getDayStatsRange returns the daily stats with beginDate <= datetime < endDate, oldest first.
+func getDayStatsRange(location string, beginDate int64, endDate int64) ([]StatsDisplayRecord, error) {
+	dbConnect()
+	return cachedRange(rollupsCache, "day_top_stats", location, beginDate, endDate, time.Now(), func(b int64, e int64) ([]StatsDisplayRecord, error) {
+		return queryDayStatsRange(location, b, e)
+	}, statsTime)
+}
+
+func queryDayStatsRange(location string, beginDate int64, endDate int64) ([]StatsDisplayRecord, error) {
+	log.Debug().Msgf("getDayStatsRange(%s, %d, %d)", location, beginDate, endDate)
+	dbConnect()
+	rows, err := db.Query(`select `+statsColumns+`
+			from day_top_stats where location = ? and datetime >= ? and datetime < ? order by datetime`, location, beginDate, endDate)
+	if err != nil {
+		log.Error().Err(err).Msgf("getDayStatsRange(): %+v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	recs := make([]StatsDisplayRecord, 0)
+	for rows.Next() {
+		dbStats, err := scanStats(rows)
+		if err != nil {
+			log.Error().Err(err).Msgf("getDayStatsRange(): %+v", err)
+			return nil, err
+		}
+		recs = append(recs, dbStats)
+	}
+	log.Debug().Msgf("end getDayStatsRange()")
+	return recs, rows.Err()
+}
+
+// getFiveMinStats returns the five minute stats with beginDate <= datetime <= endDate, oldest first.
 func getFiveMinStats(location string, beginDate int64, endDate int64) ([]StatsDisplayRecord, error) {
+	return cachedRange(rollupsCache, "five_min_top_stats", location, beginDate, endDate+1, time.Now(), func(b int64, e int64) ([]StatsDisplayRecord, error) {
+		return queryFiveMinStats(location, b, e-1)
+	}, statsTime)
+}
+
+func queryFiveMinStats(location string, beginDate int64, endDate int64) ([]StatsDisplayRecord, error) {
 	log.Debug().Msgf("getFiveMinStats(%s, %d  %d)", location, beginDate, endDate)
-	rows, err := db.Query(`select location, datetime,
-       hi_site, hi_site_dt, low_site, low_site_dt, site_energy_imported, site_energy_exported, num_site_samples, total_site_samples,
-		   hi_load, hi_load_dt, low_load, low_load_dt, load_energy_imported, load_energy_exported, num_load_samples, total_load_samples,
-		   hi_battery, hi_battery_dt, low_battery, low_battery_dt, battery_energy_imported, battery_energy_exported, num_battery_samples, total_battery_samples,
-		   hi_solar, hi_solar_dt, low_solar, low_solar_dt, solar_energy_imported, solar_energy_exported, num_solar_samples, total_solar_samples
+	rows, err := db.Query(`select `+statsColumns+`
 			from five_min_top_stats where location = ? and datetime >= ? and datetime <= ? order by datetime`, location, beginDate, endDate)
 	if err != nil {
 		log.Error().Err(err).Msgf("getFiveMinStats(): %+v", err)
@@ -573,36 +713,25 @@ func getFiveMinStats(location string, beginDate int64, endDate int64) ([]StatsDi
 	recs := make([]StatsDisplayRecord, 0)
 
 	for i := 0; rows.Next(); i++ {
-		var dbStats StatsDisplayRecord
-		err = rows.Scan(&dbStats.Location, &dbStats.DateTime,
-			&dbStats.HiSite, &dbStats.HiSiteTime, &dbStats.LowSite, &dbStats.LowSiteTime, &dbStats.SiteImported, &dbStats.SiteExported, &dbStats.NumSiteSamples, &dbStats.TotalSiteSamples,
-			&dbStats.HiLoad, &dbStats.HiLoadTime, &dbStats.LowLoad, &dbStats.LowLoadTime, &dbStats.LoadImported, &dbStats.LoadExported, &dbStats.NumLoadSamples, &dbStats.TotalLoadSamples,
-			&dbStats.HiBattery, &dbStats.HiBatteryTime, &dbStats.LowBattery, &dbStats.LowBatteryTime, &dbStats.BatteryImported, &dbStats.BatteryExported, &dbStats.NumBatterySamples, &dbStats.TotalBatterySamples,
-			&dbStats.HiSolar, &dbStats.HiSolarTime, &dbStats.LowSolar, &dbStats.LowSolarTime, &dbStats.SolarImported, &dbStats.SolarExported, &dbStats.NumSolarSamples, &dbStats.TotalSolarSamples)
+		dbStats, err := scanStats(rows)
 		if err != nil {
 			log.Error().Err(err).Msgf("getFiveMinStats(): %+v", err)
 			return nil, err
 		}
-		dbStats.DT = time.Unix(dbStats.DateTime, 0).Format("2006-01-02")
-		dbStats.LowSiteDT = time.Unix(dbStats.LowSiteTime, 0).Format("15:04")
-		dbStats.HiSiteDT = time.Unix(dbStats.HiSiteTime, 0).Format("15:04")
-		dbStats.SiteAvg = dbStats.TotalSiteSamples / float64(dbStats.NumSiteSamples)
-		dbStats.LowBatteryDT = time.Unix(dbStats.LowBatteryTime, 0).Format("15:04")
-		dbStats.HiBatteryDT = time.Unix(dbStats.HiBatteryTime, 0).Format("15:04")
-		dbStats.BatteryAvg = dbStats.TotalBatterySamples / float64(dbStats.NumBatterySamples)
-		dbStats.LowLoadDT = time.Unix(dbStats.LowLoadTime, 0).Format("15:04")
-		dbStats.HiLoadDT = time.Unix(dbStats.HiLoadTime, 0).Format("15:04")
-		dbStats.LoadAvg = dbStats.TotalLoadSamples / float64(dbStats.NumLoadSamples)
-		dbStats.LowSolarDT = time.Unix(dbStats.LowSolarTime, 0).Format("15:04")
-		dbStats.HiSolarDT = time.Unix(dbStats.HiSolarTime, 0).Format("15:04")
-		dbStats.SolarAvg = dbStats.TotalSolarSamples / float64(dbStats.NumSolarSamples)
 		recs = append(recs, dbStats)
 	}
 	log.Debug().Msgf("end getFiveMinStats()")
 	return recs, nil
 }
 
+// getFiveMinBattery returns the five minute charge with beginDate <= datetime <= endDate, oldest first.
 func getFiveMinBattery(location string, beginDate int64, endDate int64) ([]BatteryPctDisplayRecord, error) {
+	return cachedRange(rollupsCache, "five_min_battery_pct", location, beginDate, endDate+1, time.Now(), func(b int64, e int64) ([]BatteryPctDisplayRecord, error) {
+		return queryFiveMinBattery(location, b, e-1)
+	}, percentTime)
+}
+
+func queryFiveMinBattery(location string, beginDate int64, endDate int64) ([]BatteryPctDisplayRecord, error) {
 	log.Debug().Msgf("getFiveMinBattery(%s, %+v, %+v)", location, time.Unix(beginDate, 0).String(), time.Unix(endDate, 0).String())
 	rows, err := db.Query("select location, datetime, hi_pct, hi_pct_dt, low_pct, low_pct_dt, "+
 		"num_samples, total_samples from five_min_battery_pct where location = ? "+
@@ -625,9 +754,9 @@ func getFiveMinBattery(location string, beginDate int64, endDate int64) ([]Batte
 			log.Error().Err(err).Stack().Msg("error getting day pct summaries")
 			return recs, err
 		}
-		pctRecord.DT = time.Unix(pctRecord.DateTime, 0).Format("2006-01-02")
-		pctRecord.LowDT = time.Unix(pctRecord.LowPctTime, 0).Format("15:04")
-		pctRecord.HiDT = time.Unix(pctRecord.HiPctTime, 0).Format("15:04")
+		pctRecord.DT = localTime(pctRecord.Location, pctRecord.DateTime).Format("2006-01-02")
+		pctRecord.LowDT = localTime(pctRecord.Location, pctRecord.LowPctTime).Format("15:04")
+		pctRecord.HiDT = localTime(pctRecord.Location, pctRecord.HiPctTime).Format("15:04")
 		pctRecord.AvgPct = pctRecord.TotalSamples / float64(pctRecord.NumSamples)
 		//		log.Debug().Msgf("pctRecord: %+v", pctRecord)
 		recs = append(recs, pctRecord)
@@ -636,12 +765,13 @@ func getFiveMinBattery(location string, beginDate int64, endDate int64) ([]Batte
 	return recs, nil
 }
 
-func getDayBatteryPct(location string, limit int) ([]BatteryPctDisplayRecord, error) {
-	log.Debug().Msgf("getDayBatteryPct(%s, %d)", location, limit)
+// getDayBatteryPct returns the last limit days with beginDate <= datetime < endDate, newest first.
+func getDayBatteryPct(location string, beginDate int64, endDate int64, limit int) ([]BatteryPctDisplayRecord, error) {
+	log.Debug().Msgf("getDayBatteryPct(%s, %d, %d, %d)", location, beginDate, endDate, limit)
 	rows, err := db.Query(
 		"select location, datetime, hi_pct, hi_pct_dt, low_pct, low_pct_dt, "+
-			"num_samples, total_samples from day_battery_pct where location = ? order by datetime desc limit ?",
-		location, limit)
+			"num_samples, total_samples from day_battery_pct where location = ? and datetime >= ? and datetime < ? order by datetime desc limit ?",
+		location, beginDate, endDate, limit)
 	if err != nil {
 		log.Error().Err(err).Stack().Msg("error querying db")
 		return nil, err
@@ -660,12 +790,47 @@ func getDayBatteryPct(location string, limit int) ([]BatteryPctDisplayRecord, er
 			log.Error().Err(err).Stack().Msg("error getting day pct summaries")
 			return recs, err
 		}
-		pctRecord.DT = time.Unix(pctRecord.DateTime, 0).Format("2006-01-02")
-		pctRecord.LowDT = time.Unix(pctRecord.LowPctTime, 0).Format("15:04")
-		pctRecord.HiDT = time.Unix(pctRecord.HiPctTime, 0).Format("15:04")
+		pctRecord.DT = localTime(pctRecord.Location, pctRecord.DateTime).Format("2006-01-02")
+		pctRecord.LowDT = localTime(pctRecord.Location, pctRecord.LowPctTime).Format("15:04")
+		pctRecord.HiDT = localTime(pctRecord.Location, pctRecord.HiPctTime).Format("15:04")
 		pctRecord.AvgPct = pctRecord.TotalSamples / float64(pctRecord.NumSamples)
 		recs = append(recs, pctRecord)
 	}
 	log.Debug().Msgf("end getDayBatteryPct(%s, %d)", location, limit)
 	return recs, nil
 }
+
+// getDayBatteryPctRange returns the daily charge with beginDate <= datetime < endDate, oldest first.
+func getDayBatteryPctRange(location string, beginDate int64, endDate int64) ([]BatteryPctDisplayRecord, error) {
+	dbConnect()
+	return cachedRange(rollupsCache, "day_battery_pct", location, beginDate, endDate, time.Now(), func(b int64, e int64) ([]BatteryPctDisplayRecord, error) {
+		return queryDayBatteryPctRange(location, b, e)
+	}, percentTime)
+}
+
+func queryDayBatteryPctRange(location string, beginDate int64, endDate int64) ([]BatteryPctDisplayRecord, error) {
+	log.Debug().Msgf("getDayBatteryPctRange(%s, %d, %d)", location, beginDate, endDate)
+	dbConnect()
+	rows, err := db.Query(
+		"select location, datetime, hi_pct, hi_pct_dt, low_pct, low_pct_dt, "+
+			"num_samples, total_samples from day_battery_pct where location = ? and datetime >= ? and datetime < ? order by datetime",
+		location, beginDate, endDate)
+	if err != nil {
+		log.Error().Err(err).Msgf("getDayBatteryPctRange(): %+v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	recs := make([]BatteryPctDisplayRecord, 0)
+	for rows.Next() {
+		var pctRecord BatteryPctDisplayRecord
+		err = rows.Scan(&pctRecord.Location, &pctRecord.DateTime, &pctRecord.HiPct, &pctRecord.HiPctTime, &pctRecord.LowPct, &pctRecord.LowPctTime, &pctRecord.NumSamples, &pctRecord.TotalSamples)
+		if err != nil {
+			log.Error().Err(err).Msgf("getDayBatteryPctRange(): %+v", err)
+			return recs, err
+		}
+		pctRecord.DT = localTime(pctRecord.Location, pctRecord.DateTime).Format("2006-01-02")
+		pctRecord.AvgPct = pctRecord.TotalSamples / float64(pctRecord.NumSamples)
+		recs = append(recs, pctRecord)
+	}
+	return recs, rows.Err()
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"math/rand"
 	"testing"
-	"text/template"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -15,7 +14,12 @@ func testInit() {
 
 func TestParseLive(t *testing.T) {
 	testInit()
-	liveTmpl = template.Must(template.ParseFiles("live.html"))
+	liveTmpl = parseTemplate("live.html")
+}
+
+func TestParseDashboard(t *testing.T) {
+	testInit()
+	dashboardTmpl = parseTemplate("dashboard.html")
 }
 
 func TestLiveChartData(t *testing.T) {
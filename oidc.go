@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const oidcCallbackPath = "/auth/callback"
+
+// OIDCConfig is an OpenID Connect provider to sign in with, such as Google, Keycloak or Dex.
+type OIDCConfig struct {
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	RedirectURL  string `yaml:"redirect_url"` // this service's /auth/callback, as registered with the provider
+	UserClaim    string `yaml:"user_claim"`   // the ID token claim with the user's name, email by default
+}
+
+func (o *OIDCConfig) validate() []string {
+	var problems []string
+	for _, u := range []struct {
+		name  string
+		value string
+	}{{"issuer", o.Issuer}, {"redirect_url", o.RedirectURL}} {
+		if p, err := url.Parse(u.value); err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+			problems = append(problems, fmt.Sprintf("auth.oidc.%s: %q is not an http(s) URL", u.name, u.value))
+		}
+	}
+	if p, err := url.Parse(o.RedirectURL); err == nil && p.Host != "" && p.Path != oidcCallbackPath {
+		problems = append(problems, fmt.Sprintf("auth.oidc.redirect_url: must end in %s", oidcCallbackPath))
+	}
+	if o.ClientID == "" {
+		problems = append(problems, "auth.oidc.client_id: must be set")
+	}
+	return problems
+}
+
+// oidcMetadata is the part of the provider's discovery document sign in uses.
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider signs users in with the authorization code flow, fetching the provider's
+// endpoints and signing keys when first needed.
+type oidcProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu   sync.Mutex
+	meta *oidcMetadata
+	keys map[string]*rsa.PublicKey
+}
+
+func newOIDCProvider(c OIDCConfig) *oidcProvider {
+	if c.UserClaim == "" {
+		c.UserClaim = "email"
+	}
+	return &oidcProvider{config: c, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// metadata is the provider's discovery document.
+func (p *oidcProvider) metadata(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil {
+		return p.meta, nil
+	}
+	var m oidcMetadata
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration", &m); err != nil {
+		return nil, err
+	}
+	if m.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("the provider's issuer is %q, not %q", m.Issuer, p.config.Issuer)
+	}
+	p.meta = &m
+	return p.meta, nil
+}
+
+// key is the provider's signing key with id kid, refetching the keys if it's new.
+func (p *oidcProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	m, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, m.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("the provider has no key %q", kid)
+}
+
+// verify checks an RS256 ID token's signature, issuer, audience, expiry and nonce, and
+// returns its claims.
+func (p *oidcProvider) verify(ctx context.Context, token string, nonce string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("the ID token is not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("the ID token is signed with %q, not RS256", header.Alg)
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return nil, errors.New("the ID token's signature is wrong")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if claims["iss"] != p.config.Issuer {
+		return nil, fmt.Errorf("the ID token is from %v", claims["iss"])
+	}
+	if !audienceHas(claims["aud"], p.config.ClientID) {
+		return nil, fmt.Errorf("the ID token is for %v", claims["aud"])
+	}
+	if exp, ok := claims["exp"].(float64); !ok || now.Unix() >= int64(exp) {
+		return nil, errors.New("the ID token has expired")
+	}
+	if claims["nonce"] != nonce {
+		return nil, errors.New("the ID token's nonce is wrong")
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// audienceHas says whether the aud claim, a string or a list of them, has id.
+func audienceHas(aud interface{}, id string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == id
+	case []interface{}:
+		for _, a := range aud {
+			if a == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// exchange trades the authorization code for the ID token.
+func (p *oidcProvider) exchange(ctx context.Context, code string) (string, error) {
+	m, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {p.config.RedirectURL}}
+	req, err := http.NewRequestWithContext(ctx, "POST", m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	if tok.IDToken == "" {
+		return "", errors.New("token endpoint: no id_token")
+	}
+	return tok.IDToken, nil
+}
+
+const oidcCookie = "energy_oidc"
+
+// startOIDC sends the browser to the provider to sign in, remembering the state, nonce and
+// page to return to in a short lived cookie.
+func (a *authState) startOIDC(w http.ResponseWriter, r *http.Request, next string) {
+	m, err := a.oidc.metadata(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("OIDC discovery")
+		http.Error(w, "the sign in provider is unavailable", http.StatusBadGateway)
+		return
+	}
+	state := base64.RawURLEncoding.EncodeToString(randomBytes(16))
+	nonce := base64.RawURLEncoding.EncodeToString(randomBytes(16))
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    a.signed(state + "|" + nonce + "|" + next),
+		Path:     oidcCallbackPath,
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {a.oidc.config.ClientID},
+		"redirect_uri":  {a.oidc.config.RedirectURL},
+		"scope":         {"openid email profile"},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	sep := "?"
+	if strings.Contains(m.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, m.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// oidcCallbackHandler finishes OIDC sign in: the provider sends the browser back here with a
+// code, which is exchanged for the ID token naming the user.
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	a := currentAuth.Load()
+	if a == nil || a.oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	c, err := r.Cookie(oidcCookie)
+	if err != nil {
+		http.Error(w, "sign in expired; try again", http.StatusBadRequest)
+		return
+	}
+	v, ok := a.verify(c.Value)
+	parts := strings.SplitN(v, "|", 3)
+	if !ok || len(parts) != 3 || r.FormValue("state") != parts[0] {
+		http.Error(w, "sign in state doesn't match; try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: oidcCallbackPath, MaxAge: -1})
+	if e := r.FormValue("error"); e != "" {
+		http.Error(w, "sign in failed: "+e, http.StatusUnauthorized)
+		return
+	}
+	token, err := a.oidc.exchange(r.Context(), r.FormValue("code"))
+	if err != nil {
+		log.Error().Err(err).Msg("OIDC code exchange")
+		http.Error(w, "sign in failed", http.StatusBadGateway)
+		return
+	}
+	claims, err := a.oidc.verify(r.Context(), token, parts[1], time.Now())
+	if err != nil {
+		log.Warn().Err(err).Msg("OIDC ID token")
+		http.Error(w, "sign in failed", http.StatusUnauthorized)
+		return
+	}
+	name, _ := claims[a.oidc.config.UserClaim].(string)
+	if verified, ok := claims["email_verified"].(bool); ok && !verified && a.oidc.config.UserClaim == "email" {
+		name = ""
+	}
+	u := a.users[name]
+	if u == nil {
+		log.Warn().Msgf("OIDC user %q has no access", name)
+		http.Error(w, fmt.Sprintf("%s has no access", name), http.StatusForbidden)
+		return
+	}
+	a.startSession(w, r, u, time.Now())
+	log.Info().Msgf("%s signed in with OIDC", u.Name)
+	http.Redirect(w, r, localRedirect(parts[2]), http.StatusFound)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testProvider is a local OpenID Connect provider that signs users in without asking, as
+// the user in its login_hint.
+type testProvider struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	codes  map[string]map[string]interface{} // claims by code
+	claims func(map[string]interface{})      // changes the claims of the next token
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProvider{key: key, codes: make(map[string]map[string]interface{})}
+	mux := http.NewServeMux()
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, oidcMetadata{Issuer: p.URL, AuthorizationEndpoint: p.URL + "/authorize", TokenEndpoint: p.URL + "/token", JWKSURI: p.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		e := big.NewInt(int64(key.E)).Bytes()
+		writeJSON(w, map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "k1", "n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()), "e": base64.RawURLEncoding.EncodeToString(e)},
+		}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		code := "code-" + q.Get("state")
+		p.codes[code] = map[string]interface{}{
+			"iss": p.URL, "aud": q.Get("client_id"), "exp": time.Now().Add(time.Hour).Unix(),
+			"nonce": q.Get("nonce"), "email": q.Get("login_hint"), "email_verified": true,
+		}
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, _ := r.BasicAuth(); id != "energy" || secret != "s3cret" {
+			http.Error(w, "bad client", http.StatusUnauthorized)
+			return
+		}
+		claims, ok := p.codes[r.PostFormValue("code")]
+		if !ok || r.PostFormValue("grant_type") != "authorization_code" {
+			http.Error(w, "bad code", http.StatusBadRequest)
+			return
+		}
+		if p.claims != nil {
+			p.claims(claims)
+		}
+		writeJSON(w, map[string]string{"id_token": p.token(t, claims)})
+	})
+	return p
+}
+
+func (p *testProvider) token(t *testing.T, claims map[string]interface{}) string {
+	seg := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := seg(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"}) + "." + seg(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// signIn follows sign in from /login through the provider and back, as a browser does.
+func signIn(t *testing.T, h http.Handler, email string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := serveRequest(h, httptest.NewRequest("GET", "/login?next=%2Fenergy%3Flocation%3DVT", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login got %d %s", w.Code, w.Body.String())
+	}
+	state := w.Result().Cookies()[0]
+	resp, err := (&http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}).
+		Get(w.Header().Get("Location") + "&login_hint=" + url.QueryEscape(email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", callback.RequestURI(), nil)
+	r.AddCookie(state)
+	return serveRequest(h, r)
+}
+
+func TestOIDCSignIn(t *testing.T) {
+	p := newTestProvider(t)
+	testAuth(t, "session") // for the locations and the cleanup
+	c := AuthConfig{
+		Mode:  "oidc",
+		Users: []UserConfig{{Name: "bob@example.com", Locations: []string{"VT"}}},
+		OIDC:  OIDCConfig{Issuer: p.URL, ClientID: "energy", ClientSecret: "s3cret", RedirectURL: "https://energy.example.com/auth/callback"},
+	}
+	if problems := c.validate(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	applyAuth(c)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", loginHandler)
+	mux.HandleFunc(oidcCallbackPath, oidcCallbackHandler)
+	mux.HandleFunc("/energy", func(w http.ResponseWriter, r *http.Request) {
+		if loc, ok := requestLocation(w, r); ok {
+			w.Write([]byte(loc.ID))
+		}
+	})
+	h := authenticate(mux)
+
+	w := signIn(t, h, "bob@example.com")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/energy?location=VT" {
+		t.Fatalf("callback got %d %v %s", w.Code, w.Header(), w.Body.String())
+	}
+	var session *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatal("no session cookie")
+	}
+	r := httptest.NewRequest("GET", "/energy?location=VT", nil)
+	r.AddCookie(session)
+	if w := serveRequest(h, r); w.Code != 200 || w.Body.String() != "VT" {
+		t.Errorf("signed in got %d %q", w.Code, w.Body.String())
+	}
+
+	if w := signIn(t, h, "mallory@example.com"); w.Code != http.StatusForbidden {
+		t.Errorf("unknown user got %d", w.Code)
+	}
+	for name, change := range map[string]func(map[string]interface{}){
+		"wrong nonce":    func(c map[string]interface{}) { c["nonce"] = "replayed" },
+		"wrong audience": func(c map[string]interface{}) { c["aud"] = []string{"another-app"} },
+		"expired":        func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() },
+		"wrong issuer":   func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"unverified":     func(c map[string]interface{}) { c["email_verified"] = false },
+	} {
+		p.claims = change
+		if w := signIn(t, h, "bob@example.com"); w.Code == http.StatusFound {
+			t.Errorf("%s: signed in", name)
+		}
+	}
+	p.claims = nil
+
+	// a callback without the state cookie, as from a link someone else started
+	r = httptest.NewRequest("GET", oidcCallbackPath+"?code=x&state=y", nil)
+	if w := serveRequest(h, r); w.Code != http.StatusBadRequest {
+		t.Errorf("callback without state got %d", w.Code)
+	}
+}
+
+func TestOIDCVerifySignature(t *testing.T) {
+	p := newTestProvider(t)
+	o := newOIDCProvider(OIDCConfig{Issuer: p.URL, ClientID: "energy"})
+	claims := map[string]interface{}{"iss": p.URL, "aud": "energy", "exp": time.Now().Add(time.Hour).Unix(), "nonce": "n"}
+	token := p.token(t, claims)
+	if _, err := o.verify(context.Background(), token, "n", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	claims["aud"] = "another-app"
+	tampered := strings.Split(p.token(t, claims), ".")[1]
+	if _, err := o.verify(context.Background(), parts[0]+"."+tampered+"."+parts[2], "n", time.Now()); err == nil {
+		t.Error("verified a tampered token")
+	}
+}
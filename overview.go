@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var overviewTmpl *template.Template
+
+// overviewStaleAfter is how old the latest energy sample can be before a location is shown as stale.
+const overviewStaleAfter = 10 * time.Minute
+
+// LocationOverview is the current state of one location.
+type LocationOverview struct {
+	Location            string    `json:"location"`
+	Name                string    `json:"name"`
+	PVSize              float64   `json:"pvSize"`
+	BatteryCapacity     float64   `json:"batteryCapacity"`
+	AsOf                time.Time `json:"asOf"`
+	Age                 string    `json:"age"`
+	Stale               bool      `json:"stale"`
+	SiteInstantPower    int       `json:"site"`
+	LoadInstantPower    int       `json:"load"`
+	BatteryInstantPower int       `json:"battery"`
+	SolarInstantPower   int       `json:"solar"`
+	BatteryCharge       float64   `json:"batteryCharge"`
+	BatteryChargeAsOf   time.Time `json:"batteryChargeAsOf"`
+	Error               string    `json:"error,omitempty"`
+}
+
+// FleetTotals sums the daily stats of the selected locations over a period.
+type FleetTotals struct {
+	Period      string         `json:"period"`
+	Begin       string         `json:"begin"`
+	End         string         `json:"end"`
+	Locations   []string       `json:"locations"`
+	Production  float64        `json:"production"`
+	Consumption float64        `json:"consumption"`
+	GridImport  float64        `json:"gridImport"`
+	GridExport  float64        `json:"gridExport"`
+	PerLocation []PeriodTotals `json:"perLocation"`
+}
+
+// Overview is every known location plus the fleet totals for the selected ones.
+type Overview struct {
+	Locations []LocationOverview `json:"locations"`
+	Fleet     FleetTotals        `json:"fleet"`
+	Selected  map[string]bool    `json:"-"`
+}
+
+func locationOverview(loc LocationInfo, now time.Time) LocationOverview {
+	o := LocationOverview{Location: loc.ID, Name: loc.Name, PVSize: loc.PVSize, BatteryCapacity: loc.BatteryCapacity}
+	stats, err := currentStats(loc.ID)
+	if err != nil {
+		o.Error = err.Error()
+		o.Stale = true
+		return o
+	}
+	o.AsOf = stats.AsOf
+	age := now.Sub(stats.AsOf)
+	o.Age = age.Round(time.Second).String()
+	o.Stale = age > overviewStaleAfter
+	o.SiteInstantPower = stats.SiteInstantPower
+	o.LoadInstantPower = stats.LoadInstantPower
+	o.BatteryInstantPower = stats.BatteryInstantPower
+	o.SolarInstantPower = stats.SolarInstantPower
+	o.BatteryCharge = stats.BatteryCharge
+	o.BatteryChargeAsOf = stats.BatteryChargeAsOf
+	return o
+}
+
+// fleetTotals adds up each location's totals for the period.
+func fleetTotals(p Period, perLocation []PeriodTotals, locations []string) FleetTotals {
+	f := FleetTotals{
+		Period:      p.Label,
+		Begin:       p.Begin.Format("2006-01-02"),
+		End:         p.End.AddDate(0, 0, -1).Format("2006-01-02"),
+		Locations:   locations,
+		PerLocation: perLocation,
+	}
+	for _, t := range perLocation {
+		f.Production += t.Production
+		f.Consumption += t.Consumption
+		f.GridImport += t.GridImport
+		f.GridExport += t.GridExport
+	}
+	return f
+}
+
+// selectedLocations reads locations=VT,NH (or repeated locations params), defaulting to all the
+// locations the user can see.
+func selectedLocations(r *http.Request) ([]string, error) {
+	u := requestUser(r)
+	selected := make([]string, 0)
+	for _, v := range r.URL.Query()["locations"] {
+		for _, l := range strings.Split(v, ",") {
+			if l = strings.ToUpper(strings.TrimSpace(l)); l != "" {
+				if _, ok := registry.lookup(l); !ok || !u.canSee(l) {
+					return nil, fmt.Errorf("unknown location %q", l)
+				}
+				selected = append(selected, l)
+			}
+		}
+	}
+	if len(selected) == 0 {
+		for _, l := range visibleLocations(r) {
+			selected = append(selected, l.ID)
+		}
+	}
+	return selected, nil
+}
+
+// overviewPeriod reads the period for the fleet totals, defaulting to today in the default
+// location's timezone. Each location's totals use the period's days in its own timezone.
+func overviewPeriod(r *http.Request) (Period, error) {
+	tz := locationTZ(defaultLocationID(r))
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = time.Now().In(tz).Format("2006-01-02")
+	}
+	p, err := parsePeriod(period, tz)
+	if err != nil {
+		return p, err
+	}
+	return p, checkSpan("period", p.Begin, p.End)
+}
+
+// overview is the current state of the visible locations and the fleet totals of the selected ones.
+func overview(p Period, visible []LocationInfo, selected []string) (Overview, error) {
+	var o Overview
+	now := time.Now()
+	for _, loc := range visible {
+		o.Locations = append(o.Locations, locationOverview(loc, now))
+	}
+
+	o.Selected = make(map[string]bool)
+	perLocation := make([]PeriodTotals, 0, len(selected))
+	for _, location := range selected {
+		o.Selected[location] = true
+		lp, err := parsePeriod(p.Label, locationTZ(location))
+		if err != nil {
+			return o, err
+		}
+		daily, err := getDayStatsRange(location, lp.Begin.Unix(), lp.End.Unix())
+		if err != nil {
+			return o, err
+		}
+		t := periodTotals(lp, daily)
+		t.Label = location
+		if l, ok := registry.lookup(location); ok {
+			t.Label = l.Name
+		}
+		perLocation = append(perLocation, t)
+	}
+	o.Fleet = fleetTotals(p, perLocation, selected)
+	return o, nil
+}
+
+func overviewHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := overviewPeriod(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	selected, err := selectedLocations(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	o, err := overview(p, visibleLocations(r), selected)
+	if err != nil {
+		s := fmt.Sprintf("%+v", err)
+		http.Error(w, s, http.StatusInternalServerError)
+		return
+	}
+	if err := overviewTmpl.Execute(w, o); err != nil {
+		msg := http.StatusText(http.StatusInternalServerError)
+		log.Error().Err(err).Msg(msg)
+	}
+}
+
+func overviewAPIHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := overviewPeriod(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	selected, err := selectedLocations(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	o, err := overview(p, visibleLocations(r), selected)
+	if err != nil {
+		s := fmt.Sprintf("%+v", err)
+		http.Error(w, s, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, o)
+}
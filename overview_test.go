@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseOverview(t *testing.T) {
+	testInit()
+	overviewTmpl = parseTemplate("overview.html")
+}
+
+func TestSelectedLocations(t *testing.T) {
+	registry.set([]LocationInfo{{ID: "MA"}, {ID: "NH"}, {ID: "VT"}})
+	defer registry.set(nil)
+
+	r := httptest.NewRequest("GET", "/overview?locations=vt,%20ma&locations=nh", nil)
+	got, err := selectedLocations(r)
+	if want := []string{"VT", "MA", "NH"}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v %v, want %v", got, err, want)
+	}
+	r = httptest.NewRequest("GET", "/overview", nil)
+	if got, _ := selectedLocations(r); !reflect.DeepEqual(got, []string{"MA", "NH", "VT"}) {
+		t.Errorf("got %v, want all registered locations", got)
+	}
+	r = httptest.NewRequest("GET", "/overview?locations=vt,ct", nil)
+	if _, err := selectedLocations(r); err == nil {
+		t.Error("expected an error for an unregistered location")
+	}
+}
+
+func TestFleetTotals(t *testing.T) {
+	p, _ := parsePeriod("2026-06", time.Local)
+	perLocation := []PeriodTotals{
+		{Label: "VT", Production: 100, Consumption: 80, GridExport: 30},
+		{Label: "NH", Production: 50, Consumption: 70, GridImport: 25},
+	}
+	f := fleetTotals(p, perLocation, []string{"VT", "NH"})
+	if f.Production != 150 || f.Consumption != 150 || f.GridImport != 25 || f.GridExport != 30 {
+		t.Errorf("unexpected fleet totals: %+v", f)
+	}
+	if f.Begin != "2026-06-01" || f.End != "2026-06-30" {
+		t.Errorf("unexpected fleet period: %s - %s", f.Begin, f.End)
+	}
+}
+
+func TestOverviewPeriod(t *testing.T) {
+	tz, err := time.LoadLocation("Pacific/Kiritimati")
+	if err != nil {
+		t.Skip(err)
+	}
+	registry.set([]LocationInfo{{ID: "VT", TimeLocation: tz}})
+	defer registry.set(nil)
+
+	p, err := overviewPeriod(httptest.NewRequest("GET", "/overview", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if today := time.Now().In(tz); p.Label != today.Format("2006-01-02") || !p.Begin.Equal(dayStart(today)) {
+		t.Errorf("got %s from %v, want today in the default location's timezone", p.Label, p.Begin)
+	}
+}
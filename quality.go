@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var qualityTmpl *template.Template
+
+const (
+	qualityMaxGap      = 10 * time.Minute // longer without a sample is a gap
+	qualityPowerSlack  = -100.0           // W; inverters and meters read a little negative at rest
+	qualityIssuesShown = 10               // per location in check's output
+)
+
+// QualityIssue is one problem found in a location's data, covering Begin to End.
+type QualityIssue struct {
+	Kind   string `json:"kind"` // gap, duplicate, out-of-order, impossible, rollup-count or rollup-missing
+	Table  string `json:"table"`
+	Begin  int64  `json:"begin"`
+	End    int64  `json:"end"`
+	Count  int    `json:"count"`
+	Detail string `json:"detail"`
+	When   string `json:"when"`
+}
+
+// QualityReport is the data-quality scan of a location over a period.
+type QualityReport struct {
+	Location       string         `json:"location"`
+	Days           int            `json:"days"`
+	Begin          int64          `json:"begin"`
+	End            int64          `json:"end"`
+	EnergySamples  int            `json:"energySamples"`
+	BatterySamples int            `json:"batterySamples"`
+	Counts         map[string]int `json:"counts"`
+	Issues         []QualityIssue `json:"issues"`
+	Info           LocationInfo   `json:"-"`
+}
+
+// rawRow is the identity of one energy or battery row.
+type rawRow struct {
+	ID       int64
+	DateTime int64
+	Millis   int64 // dt has millisecond precision, so rows in the same second aren't duplicates
+}
+
+// addIssue appends an issue, extending the last one instead if it is the same kind of problem
+// in the same table and starts where it ends.
+func addIssue(issues []QualityIssue, i QualityIssue) []QualityIssue {
+	if n := len(issues); n > 0 {
+		last := &issues[n-1]
+		if last.Kind == i.Kind && last.Table == i.Table && last.Detail == i.Detail && i.Begin <= last.End {
+			if i.End > last.End {
+				last.End = i.End
+			}
+			last.Count += i.Count
+			return issues
+		}
+	}
+	return append(issues, i)
+}
+
+// scanRawRows finds gaps, duplicate timestamps and rows inserted out of order in rows sorted by
+// time then id. A row whose id is lower than an earlier-timed row's was written after it, which
+// a backfill or a collector with a wrong clock does.
+func scanRawRows(table string, rows []rawRow, maxGap int64) []QualityIssue {
+	issues := make([]QualityIssue, 0)
+	// runs of consecutive duplicate or out of order rows are one issue each
+	run := func(kind string, current int, dt int64) int {
+		if current >= 0 {
+			issues[current].End = dt
+			issues[current].Count++
+			return current
+		}
+		issues = append(issues, QualityIssue{Kind: kind, Table: table, Begin: dt, End: dt, Count: 1})
+		return len(issues) - 1
+	}
+	duplicates, outOfOrder := -1, -1
+	var maxID int64
+	for i, r := range rows {
+		if i > 0 && r.Millis == rows[i-1].Millis {
+			duplicates = run("duplicate", duplicates, r.DateTime)
+		} else {
+			duplicates = -1
+		}
+		if i > 0 && r.DateTime-rows[i-1].DateTime > maxGap {
+			step := r.DateTime - rows[i-1].DateTime
+			issues = append(issues, QualityIssue{Kind: "gap", Table: table, Begin: rows[i-1].DateTime, End: r.DateTime, Count: 1,
+				Detail: (time.Duration(step) * time.Second).String()})
+		}
+		if r.ID < maxID {
+			outOfOrder = run("out-of-order", outOfOrder, r.DateTime)
+		} else {
+			outOfOrder = -1
+			maxID = r.ID
+		}
+	}
+	return issues
+}
+
+// rollupCounts is the number of raw rows in each bucket.
+func rollupCounts(rows []rawRow, bucket func(int64) int64) map[int64]int {
+	counts := make(map[int64]int)
+	for _, r := range rows {
+		counts[bucket(r.DateTime)]++
+	}
+	return counts
+}
+
+// checkRollupCounts compares the sample counts rollups recorded with the raw rows in their
+// buckets. Buckets with no raw rows are skipped, as imported history and pruned raw data have
+// none, and so are the last rolled up bucket and any after it, which may have been rolled up
+// before all their samples arrived.
+func checkRollupCounts(table string, step int64, raw map[int64]int, rollups map[int64]int) []QualityIssue {
+	var latest int64
+	for b := range rollups {
+		if b > latest {
+			latest = b
+		}
+	}
+	buckets := make([]int64, 0, len(raw))
+	for b := range raw {
+		if b < latest {
+			buckets = append(buckets, b)
+		}
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	issues := make([]QualityIssue, 0)
+	for _, b := range buckets {
+		n, ok := rollups[b]
+		switch {
+		case !ok:
+			issues = addIssue(issues, QualityIssue{Kind: "rollup-missing", Table: table, Begin: b, End: b + step, Count: 1})
+		case n != raw[b]:
+			issues = addIssue(issues, QualityIssue{Kind: "rollup-count", Table: table, Begin: b, End: b + step, Count: 1,
+				Detail: fmt.Sprintf("%d samples rolled up, %d raw", n, raw[b])})
+		}
+	}
+	return issues
+}
+
+func getRawRows(table string, location string, begin int64, end int64) ([]rawRow, error) {
+	rows, err := db.Query("select id, round(unix_timestamp(dt) * 1000) from "+table+
+		" where location = ? and dt >= from_unixtime(?) and dt < from_unixtime(?) order by dt, id", location, begin, end)
+	if err != nil {
+		log.Error().Err(err).Msgf("getRawRows(%s, %s): %+v", table, location, err)
+		return nil, err
+	}
+	defer rows.Close()
+	raw := make([]rawRow, 0)
+	for rows.Next() {
+		var r rawRow
+		var ms float64
+		if err := rows.Scan(&r.ID, &ms); err != nil {
+			return raw, err
+		}
+		r.Millis = int64(ms)
+		r.DateTime = r.Millis / 1000
+		raw = append(raw, r)
+	}
+	return raw, rows.Err()
+}
+
+// getImpossible counts the rows matching cond, a condition on values that can't happen.
+func getImpossible(table string, cond string, location string, begin int64, end int64) (QualityIssue, error) {
+	i := QualityIssue{Kind: "impossible", Table: table, Detail: cond}
+	var first, last sql.NullFloat64
+	err := db.QueryRow("select count(*), min(unix_timestamp(dt)), max(unix_timestamp(dt)) from "+table+
+		" where location = ? and dt >= from_unixtime(?) and dt < from_unixtime(?) and "+cond, location, begin, end).Scan(&i.Count, &first, &last)
+	if err != nil {
+		log.Error().Err(err).Msgf("getImpossible(%s, %s): %+v", table, location, err)
+	}
+	i.Begin, i.End = int64(first.Float64), int64(last.Float64)
+	return i, err
+}
+
+// getRollupCounts is the sample count column of each rollup row in the period.
+func getRollupCounts(table string, column string, location string, begin int64, end int64) (map[int64]int, error) {
+	rows, err := db.Query("select datetime, "+column+" from "+table+" where location = ? and datetime >= ? and datetime < ?", location, begin, end)
+	if err != nil {
+		log.Error().Err(err).Msgf("getRollupCounts(%s, %s): %+v", table, location, err)
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[int64]int)
+	for rows.Next() {
+		var dt int64
+		var n sql.NullInt64
+		if err := rows.Scan(&dt, &n); err != nil {
+			return counts, err
+		}
+		counts[dt] = int(n.Int64)
+	}
+	return counts, rows.Err()
+}
+
+// qualityReport scans a location's raw and rollup tables for the local days from begin up to end.
+func qualityReport(loc LocationInfo, begin time.Time, end time.Time) (QualityReport, error) {
+	log.Debug().Msgf("qualityReport(%s, %s, %s)", loc.ID, begin, end)
+	dbConnect()
+	report := QualityReport{Location: loc.ID, Info: loc, Begin: begin.Unix(), End: end.Unix(), Counts: make(map[string]int), Issues: make([]QualityIssue, 0)}
+	report.Days = int(end.Sub(begin).Hours()/24 + 0.5)
+	days := dayBucket(loc.ID)
+	maxGap := int64(qualityMaxGap / time.Second)
+
+	energy, err := getRawRows("energy", loc.ID, report.Begin, report.End)
+	if err != nil {
+		return report, err
+	}
+	battery, err := getRawRows("battery", loc.ID, report.Begin, report.End)
+	if err != nil {
+		return report, err
+	}
+	report.EnergySamples, report.BatterySamples = len(energy), len(battery)
+	report.Issues = append(report.Issues, scanRawRows("energy", energy, maxGap)...)
+	report.Issues = append(report.Issues, scanRawRows("battery", battery, maxGap)...)
+
+	for _, c := range []struct{ table, cond string }{
+		{"energy", fmt.Sprintf("solar_instant_power < %g", qualityPowerSlack)},
+		{"energy", fmt.Sprintf("load_instant_power < %g", qualityPowerSlack)},
+		{"battery", "(percent_charged < 0 or percent_charged > 100)"},
+	} {
+		i, err := getImpossible(c.table, c.cond, loc.ID, report.Begin, report.End)
+		if err != nil {
+			return report, err
+		}
+		if i.Count > 0 {
+			report.Issues = append(report.Issues, i)
+		}
+	}
+
+	for _, c := range []struct {
+		table, column string
+		raw           []rawRow
+		bucket        func(int64) int64
+		step          int64
+	}{
+		{"five_min_top_stats", "num_site_samples", energy, fiveMinBucket, 300},
+		{"day_top_stats", "num_site_samples", energy, days, 86400},
+		{"five_min_battery_pct", "num_samples", battery, fiveMinBucket, 300},
+		{"day_battery_pct", "num_samples", battery, days, 86400},
+	} {
+		rollups, err := getRollupCounts(c.table, c.column, loc.ID, report.Begin, report.End)
+		if err != nil {
+			return report, err
+		}
+		report.Issues = append(report.Issues, checkRollupCounts(c.table, c.step, rollupCounts(c.raw, c.bucket), rollups)...)
+	}
+
+	for i := range report.Issues {
+		issue := &report.Issues[i]
+		report.Counts[issue.Kind] += issue.Count
+		issue.When = localTime(loc.ID, issue.Begin).Format("2006-01-02 15:04")
+		if issue.End != issue.Begin {
+			issue.When += " - " + localTime(loc.ID, issue.End).Format("2006-01-02 15:04")
+		}
+	}
+	return report, nil
+}
+
+// String describes the issue on one line.
+func (i QualityIssue) String() string {
+	s := fmt.Sprintf("%s in %s at %s", i.Kind, i.Table, i.When)
+	if i.Count > 1 {
+		s += fmt.Sprintf(" (%d)", i.Count)
+	}
+	if i.Detail != "" {
+		s += ": " + i.Detail
+	}
+	return s
+}
+
+// qualityPeriod is the days param's local days up to now.
+func qualityPeriod(loc LocationInfo, days int, now time.Time) (time.Time, time.Time) {
+	if days < 1 {
+		days = 1
+	}
+	return dayStart(now.In(loc.TZ()).AddDate(0, 0, 1-days)), now
+}
+
+func qualityHandler(w http.ResponseWriter, r *http.Request) {
+	loc, ok := requestLocation(w, r)
+	if !ok {
+		return
+	}
+	days, err := daysParam(r, "days", config().DefaultLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	begin, end := qualityPeriod(loc, days, time.Now())
+	report, err := qualityReport(loc, begin, end)
+	if err != nil {
+		s := fmt.Sprintf("%+v", err)
+		http.Error(w, s, http.StatusInternalServerError)
+		return
+	}
+	if err := qualityTmpl.Execute(w, report); err != nil {
+		msg := http.StatusText(http.StatusInternalServerError)
+		log.Error().Err(err).Msg(msg)
+	}
+}
+
+func qualityAPIHandler(w http.ResponseWriter, r *http.Request) {
+	loc, ok := requestLocation(w, r)
+	if !ok {
+		return
+	}
+	days, err := daysParam(r, "days", config().DefaultLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	begin, end := qualityPeriod(loc, days, time.Now())
+	report, err := qualityReport(loc, begin, end)
+	if err != nil {
+		s := fmt.Sprintf("%+v", err)
+		http.Error(w, s, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, report)
+}
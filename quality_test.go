@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestScanRawRows(t *testing.T) {
+	rows := []rawRow{
+		{ID: 1, DateTime: 1000, Millis: 1000000},
+		{ID: 2, DateTime: 1030, Millis: 1030000},
+		{ID: 3, DateTime: 1030, Millis: 1030000},
+		{ID: 4, DateTime: 1030, Millis: 1030500}, // same second, not a duplicate
+		{ID: 9, DateTime: 1060, Millis: 1060000},
+		{ID: 5, DateTime: 2000, Millis: 2000000}, // backfilled after 9
+		{ID: 6, DateTime: 2030, Millis: 2030000},
+	}
+	issues := scanRawRows("energy", rows, 600)
+	want := []QualityIssue{
+		{Kind: "duplicate", Table: "energy", Begin: 1030, End: 1030, Count: 1},
+		{Kind: "gap", Table: "energy", Begin: 1060, End: 2000, Count: 1, Detail: "15m40s"},
+		{Kind: "out-of-order", Table: "energy", Begin: 2000, End: 2030, Count: 2},
+	}
+	if len(issues) != len(want) {
+		t.Fatalf("got %+v", issues)
+	}
+	for i := range want {
+		if issues[i] != want[i] {
+			t.Errorf("issue %d = %+v, want %+v", i, issues[i], want[i])
+		}
+	}
+}
+
+func TestCheckRollupCounts(t *testing.T) {
+	raw := rollupCounts([]rawRow{{DateTime: 0}, {DateTime: 10}, {DateTime: 310}, {DateTime: 610}, {DateTime: 910}, {DateTime: 1210}}, fiveMinBucket)
+	rollups := map[int64]int{0: 2, 300: 3, 1200: 1, 1500: 4} // 600 and 900 missing, 1500 imported with no raw rows
+	issues := checkRollupCounts("five_min_top_stats", 300, raw, rollups)
+	if len(issues) != 2 {
+		t.Fatalf("got %+v", issues)
+	}
+	if i := issues[0]; i.Kind != "rollup-count" || i.Begin != 300 || i.Detail != "3 samples rolled up, 1 raw" {
+		t.Errorf("got %+v", i)
+	}
+	if i := issues[1]; i.Kind != "rollup-missing" || i.Begin != 600 || i.End != 1200 || i.Count != 2 {
+		t.Errorf("missing rollups should merge into one issue, got %+v", i)
+	}
+}
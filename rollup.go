@@ -0,0 +1,387 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// PowerSample is one collector sample of the four meters. The energy counters are the
+// Powerwall's lifetime Wh totals, indexed by meterSite..meterSolar.
+type PowerSample struct {
+	DateTime int64
+	Power    [4]float64
+	Imported [4]float64
+	Exported [4]float64
+}
+
+const (
+	meterSite = iota
+	meterLoad
+	meterBattery
+	meterSolar
+)
+
+// PercentSample is one battery state of charge sample.
+type PercentSample struct {
+	DateTime int64
+	Percent  float64
+}
+
+// getPowerSamples returns the energy samples with beginDate <= dt < endDate, oldest first.
+func getPowerSamples(location string, beginDate int64, endDate int64) ([]PowerSample, error) {
+	log.Debug().Msgf("getPowerSamples(%s, %d, %d)", location, beginDate, endDate)
+	dbConnect()
+	rows, err := db.Query(`select unix_timestamp(dt),
+			site_instant_power, load_instant_power, battery_instant_power, solar_instant_power,
+			payload->>'$.site.energy_imported', payload->>'$.site.energy_exported',
+			payload->>'$.load.energy_imported', payload->>'$.load.energy_exported',
+			payload->>'$.battery.energy_imported', payload->>'$.battery.energy_exported',
+			payload->>'$.solar.energy_imported', payload->>'$.solar.energy_exported'
+			from energy where location = ? and dt >= from_unixtime(?) and dt < from_unixtime(?) order by dt`,
+		location, beginDate, endDate)
+	if err != nil {
+		log.Error().Err(err).Msgf("getPowerSamples(): %+v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	samples := make([]PowerSample, 0)
+	for rows.Next() {
+		var s PowerSample
+		var dt float64
+		var counters [8]sql.NullFloat64
+		if err := rows.Scan(&dt, &s.Power[meterSite], &s.Power[meterLoad], &s.Power[meterBattery], &s.Power[meterSolar],
+			&counters[0], &counters[1], &counters[2], &counters[3], &counters[4], &counters[5], &counters[6], &counters[7]); err != nil {
+			log.Error().Err(err).Msgf("getPowerSamples(): %+v", err)
+			return samples, err
+		}
+		s.DateTime = int64(dt)
+		for m := meterSite; m <= meterSolar; m++ {
+			s.Imported[m] = counters[2*m].Float64
+			s.Exported[m] = counters[2*m+1].Float64
+		}
+		samples = append(samples, s)
+	}
+	return samples, rows.Err()
+}
+
+// getPercentSamples returns the battery samples with beginDate <= dt < endDate, oldest first.
+func getPercentSamples(location string, beginDate int64, endDate int64) ([]PercentSample, error) {
+	log.Debug().Msgf("getPercentSamples(%s, %d, %d)", location, beginDate, endDate)
+	dbConnect()
+	rows, err := db.Query("select unix_timestamp(dt), percent_charged from battery "+
+		"where location = ? and dt >= from_unixtime(?) and dt < from_unixtime(?) order by dt", location, beginDate, endDate)
+	if err != nil {
+		log.Error().Err(err).Msgf("getPercentSamples(): %+v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	samples := make([]PercentSample, 0)
+	for rows.Next() {
+		var s PercentSample
+		var dt float64
+		if err := rows.Scan(&dt, &s.Percent); err != nil {
+			log.Error().Err(err).Msgf("getPercentSamples(): %+v", err)
+			return samples, err
+		}
+		s.DateTime = int64(dt)
+		samples = append(samples, s)
+	}
+	return samples, rows.Err()
+}
+
+// fiveMinBucket is the start of the five minute interval containing dt.
+func fiveMinBucket(dt int64) int64 {
+	return dt - dt%300
+}
+
+// lastClosedFiveMin is the start of the last five minute interval that has ended by now; the
+// one holding now is still collecting samples.
+func lastClosedFiveMin(now time.Time) int64 {
+	return fiveMinBucket(now.Unix()) - 300
+}
+
+// dayBucket returns a function giving the start of the location's local day containing dt.
+func dayBucket(location string) func(int64) int64 {
+	return func(dt int64) int64 {
+		return dayStart(localTime(location, dt)).Unix()
+	}
+}
+
+// hourBucket returns a function giving the start of the location's local hour containing dt,
+// which isn't on the UTC hour in half hour timezones.
+func hourBucket(location string) func(int64) int64 {
+	return func(dt int64) int64 {
+		t := localTime(location, dt)
+		return dt - int64(t.Minute()*60+t.Second())
+	}
+}
+
+// meterStats accumulates one meter's part of a stats record.
+type meterStats struct {
+	hi, low         float64
+	hiTime, lowTime int64
+	imported        float64
+	exported        float64
+	samples         int
+	total           float64
+}
+
+func (m *meterStats) add(dt int64, power float64) {
+	if m.samples == 0 || power > m.hi {
+		m.hi, m.hiTime = power, dt
+	}
+	if m.samples == 0 || power < m.low {
+		m.low, m.lowTime = power, dt
+	}
+	m.samples++
+	m.total += power
+}
+
+// merge adds another interval's stats for the same meter.
+func (m *meterStats) merge(o meterStats) {
+	if o.samples == 0 {
+		m.imported += o.imported
+		m.exported += o.exported
+		return
+	}
+	if m.samples == 0 || o.hi > m.hi {
+		m.hi, m.hiTime = o.hi, o.hiTime
+	}
+	if m.samples == 0 || o.low < m.low {
+		m.low, m.lowTime = o.low, o.lowTime
+	}
+	m.imported += o.imported
+	m.exported += o.exported
+	m.samples += o.samples
+	m.total += o.total
+}
+
+// statsRecord is the stats record for the bucket starting at dt.
+func statsRecord(location string, dt int64, m [4]meterStats) StatsDisplayRecord {
+	r := StatsDisplayRecord{Location: location, DateTime: dt}
+	r.HiSite, r.HiSiteTime, r.LowSite, r.LowSiteTime = m[meterSite].hi, m[meterSite].hiTime, m[meterSite].low, m[meterSite].lowTime
+	r.SiteImported, r.SiteExported, r.NumSiteSamples, r.TotalSiteSamples = m[meterSite].imported, m[meterSite].exported, m[meterSite].samples, m[meterSite].total
+	r.HiLoad, r.HiLoadTime, r.LowLoad, r.LowLoadTime = m[meterLoad].hi, m[meterLoad].hiTime, m[meterLoad].low, m[meterLoad].lowTime
+	r.LoadImported, r.LoadExported, r.NumLoadSamples, r.TotalLoadSamples = m[meterLoad].imported, m[meterLoad].exported, m[meterLoad].samples, m[meterLoad].total
+	r.HiBattery, r.HiBatteryTime, r.LowBattery, r.LowBatteryTime = m[meterBattery].hi, m[meterBattery].hiTime, m[meterBattery].low, m[meterBattery].lowTime
+	r.BatteryImported, r.BatteryExported, r.NumBatterySamples, r.TotalBatterySamples = m[meterBattery].imported, m[meterBattery].exported, m[meterBattery].samples, m[meterBattery].total
+	r.HiSolar, r.HiSolarTime, r.LowSolar, r.LowSolarTime = m[meterSolar].hi, m[meterSolar].hiTime, m[meterSolar].low, m[meterSolar].lowTime
+	r.SolarImported, r.SolarExported, r.NumSolarSamples, r.TotalSolarSamples = m[meterSolar].imported, m[meterSolar].exported, m[meterSolar].samples, m[meterSolar].total
+	return r
+}
+
+// recordMeters splits a stats record back into its meters.
+func recordMeters(r StatsDisplayRecord) [4]meterStats {
+	var m [4]meterStats
+	m[meterSite] = meterStats{r.HiSite, r.LowSite, r.HiSiteTime, r.LowSiteTime, r.SiteImported, r.SiteExported, r.NumSiteSamples, r.TotalSiteSamples}
+	m[meterLoad] = meterStats{r.HiLoad, r.LowLoad, r.HiLoadTime, r.LowLoadTime, r.LoadImported, r.LoadExported, r.NumLoadSamples, r.TotalLoadSamples}
+	m[meterBattery] = meterStats{r.HiBattery, r.LowBattery, r.HiBatteryTime, r.LowBatteryTime, r.BatteryImported, r.BatteryExported, r.NumBatterySamples, r.TotalBatterySamples}
+	m[meterSolar] = meterStats{r.HiSolar, r.LowSolar, r.HiSolarTime, r.LowSolarTime, r.SolarImported, r.SolarExported, r.NumSolarSamples, r.TotalSolarSamples}
+	return m
+}
+
+// mergeStats combines stats records, oldest first, into one record per coarser bucket, e.g.
+// five minute records into days.
+func mergeStats(location string, recs []StatsDisplayRecord, bucket func(int64) int64) []StatsDisplayRecord {
+	merged := make([]StatsDisplayRecord, 0)
+	var meters [4]meterStats
+	var current int64
+	for i, r := range recs {
+		b := bucket(r.DateTime)
+		if i > 0 && b != current {
+			merged = append(merged, statsRecord(location, current, meters))
+			meters = [4]meterStats{}
+		}
+		current = b
+		for m, s := range recordMeters(r) {
+			meters[m].merge(s)
+		}
+	}
+	if len(recs) > 0 {
+		merged = append(merged, statsRecord(location, current, meters))
+	}
+	return merged
+}
+
+// counterDelta is how far a lifetime counter moved, treating a reset as no movement.
+func counterDelta(from float64, to float64) float64 {
+	if to < from {
+		return 0
+	}
+	return to - from
+}
+
+// rollupStats summarizes samples into one record per bucket. Energy is the movement of the lifetime
+// counters since the sample before, so nothing is lost between buckets; prev is the sample before
+// the first one, if there is one.
+func rollupStats(location string, prev *PowerSample, samples []PowerSample, bucket func(int64) int64) []StatsDisplayRecord {
+	recs := make([]StatsDisplayRecord, 0)
+	var meters [4]meterStats
+	var current int64
+	started := false
+	flush := func() {
+		recs = append(recs, statsRecord(location, current, meters))
+	}
+	for i := range samples {
+		s := &samples[i]
+		b := bucket(s.DateTime)
+		if !started || b != current {
+			if started {
+				flush()
+			}
+			started = true
+			current = b
+			meters = [4]meterStats{}
+		}
+		for m := meterSite; m <= meterSolar; m++ {
+			meters[m].add(s.DateTime, s.Power[m])
+			if prev != nil {
+				meters[m].imported += counterDelta(prev.Imported[m], s.Imported[m])
+				meters[m].exported += counterDelta(prev.Exported[m], s.Exported[m])
+			}
+		}
+		prev = s
+	}
+	if started {
+		flush()
+	}
+	return recs
+}
+
+// rollupPercent summarizes battery samples into one record per bucket.
+func rollupPercent(location string, samples []PercentSample, bucket func(int64) int64) []BatteryPctDisplayRecord {
+	recs := make([]BatteryPctDisplayRecord, 0)
+	for _, s := range samples {
+		b := bucket(s.DateTime)
+		if len(recs) == 0 || recs[len(recs)-1].DateTime != b {
+			recs = append(recs, BatteryPctDisplayRecord{Location: location, DateTime: b, HiPct: math.Inf(-1), LowPct: math.Inf(1)})
+		}
+		r := &recs[len(recs)-1]
+		if s.Percent > r.HiPct {
+			r.HiPct, r.HiPctTime = s.Percent, s.DateTime
+		}
+		if s.Percent < r.LowPct {
+			r.LowPct, r.LowPctTime = s.Percent, s.DateTime
+		}
+		r.NumSamples++
+		r.TotalSamples += s.Percent
+	}
+	return recs
+}
+
+// saveStats replaces the rollup rows for the records' buckets in table, drops them from the
+// caches and records the change in data_versions.
+func saveStats(table string, recs []StatsDisplayRecord) error {
+	insert := "replace into " + table + " (" + statsColumns + ") values (?" + strings.Repeat(", ?", 33) + ")"
+	for _, r := range recs {
+		_, err := db.Exec(insert, r.Location, r.DateTime,
+			r.HiSite, r.HiSiteTime, r.LowSite, r.LowSiteTime, r.SiteImported, r.SiteExported, r.NumSiteSamples, r.TotalSiteSamples,
+			r.HiLoad, r.HiLoadTime, r.LowLoad, r.LowLoadTime, r.LoadImported, r.LoadExported, r.NumLoadSamples, r.TotalLoadSamples,
+			r.HiBattery, r.HiBatteryTime, r.LowBattery, r.LowBatteryTime, r.BatteryImported, r.BatteryExported, r.NumBatterySamples, r.TotalBatterySamples,
+			r.HiSolar, r.HiSolarTime, r.LowSolar, r.LowSolarTime, r.SolarImported, r.SolarExported, r.NumSolarSamples, r.TotalSolarSamples)
+		if err != nil {
+			log.Error().Err(err).Msgf("saveStats(%s, %s %d)", table, r.Location, r.DateTime)
+			return err
+		}
+		// after the write, so a reader can't cache the old row in between
+		rollupsCache.invalidate(table, r.Location, r.DateTime)
+		if table == "five_min_top_stats" {
+			carbonMonths.invalidate(r.Location, r.DateTime)
+		}
+	}
+	return touchLocations(recs, func(r StatsDisplayRecord) string { return r.Location })
+}
+
+// savePercent replaces the battery rollup rows for the records' buckets in table, drops them
+// from the cache and records the change in data_versions.
+func savePercent(table string, recs []BatteryPctDisplayRecord) error {
+	for _, r := range recs {
+		_, err := db.Exec("replace into "+table+" (location, datetime, hi_pct, hi_pct_dt, low_pct, low_pct_dt, num_samples, total_samples) "+
+			"values (?, ?, ?, ?, ?, ?, ?, ?)", r.Location, r.DateTime, r.HiPct, r.HiPctTime, r.LowPct, r.LowPctTime, r.NumSamples, r.TotalSamples)
+		if err != nil {
+			log.Error().Err(err).Msgf("savePercent(%s, %s %d)", table, r.Location, r.DateTime)
+			return err
+		}
+		rollupsCache.invalidate(table, r.Location, r.DateTime)
+	}
+	return touchLocations(recs, func(r BatteryPctDisplayRecord) string { return r.Location })
+}
+
+// touchLocations records a change to the data version of each of the records' locations.
+func touchLocations[T any](recs []T, location func(T) string) error {
+	touched := make(map[string]bool)
+	for _, r := range recs {
+		if l := location(r); !touched[l] {
+			touched[l] = true
+			if err := touchDataVersion(l); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RollupResult counts what a rollup wrote.
+type RollupResult struct {
+	Days    int
+	FiveMin int
+	Samples int
+}
+
+// rollupDay rebuilds the five minute and daily rollups for the local day starting at day.
+func rollupDay(location string, day time.Time) (RollupResult, error) {
+	var res RollupResult
+	begin := dayStart(day)
+	end := dayStart(begin.AddDate(0, 0, 1))
+	// the last sample before the day gives the counters its first interval starts from
+	samples, err := getPowerSamples(location, begin.Add(-time.Hour).Unix(), end.Unix())
+	if err != nil {
+		return res, err
+	}
+	var prev *PowerSample
+	for len(samples) > 0 && samples[0].DateTime < begin.Unix() {
+		prev = &samples[0]
+		samples = samples[1:]
+	}
+	fiveMin := rollupStats(location, prev, samples, fiveMinBucket)
+	daily := rollupStats(location, prev, samples, dayBucket(location))
+	if err := saveStats("five_min_top_stats", fiveMin); err != nil {
+		return res, err
+	}
+	if err := saveStats("day_top_stats", daily); err != nil {
+		return res, err
+	}
+
+	pct, err := getPercentSamples(location, begin.Unix(), end.Unix())
+	if err != nil {
+		return res, err
+	}
+	if err := savePercent("five_min_battery_pct", rollupPercent(location, pct, fiveMinBucket)); err != nil {
+		return res, err
+	}
+	if err := savePercent("day_battery_pct", rollupPercent(location, pct, dayBucket(location))); err != nil {
+		return res, err
+	}
+	res.FiveMin, res.Days, res.Samples = len(fiveMin), len(daily), len(samples)
+	return res, nil
+}
+
+// rollupRange rebuilds the rollups for each local day from begin up to but not including end.
+func rollupRange(location string, begin time.Time, end time.Time) (RollupResult, error) {
+	var total RollupResult
+	for day := dayStart(begin); day.Before(end); day = dayStart(day.AddDate(0, 0, 1)) {
+		res, err := rollupDay(location, day)
+		if err != nil {
+			return total, fmt.Errorf("%s %s: %w", location, day.Format("2006-01-02"), err)
+		}
+		total.Days += res.Days
+		total.FiveMin += res.FiveMin
+		total.Samples += res.Samples
+	}
+	return total, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRollupStats(t *testing.T) {
+	start := time.Date(2026, 6, 14, 12, 0, 0, 0, time.UTC).Unix()
+	sample := func(offset int64, site float64, imported float64) PowerSample {
+		s := PowerSample{DateTime: start + offset}
+		s.Power[meterSite] = site
+		s.Imported[meterSite] = imported
+		return s
+	}
+	prev := sample(-10, 0, 1000)
+	samples := []PowerSample{
+		sample(0, 500, 1010),
+		sample(150, 1500, 1050),
+		sample(300, -200, 1080), // next interval
+		sample(450, 100, 1000),  // counter reset
+	}
+	recs := rollupStats("VT", &prev, samples, fiveMinBucket)
+	if len(recs) != 2 {
+		t.Fatalf("got %d records, want 2: %+v", len(recs), recs)
+	}
+	r := recs[0]
+	if r.DateTime != start || r.NumSiteSamples != 2 || r.TotalSiteSamples != 2000 || r.HiSite != 1500 || r.HiSiteTime != start+150 || r.LowSite != 500 {
+		t.Errorf("unexpected first interval: %+v", r)
+	}
+	if r.SiteImported != 50 {
+		t.Errorf("first interval imported %f, want 50 including the carried in counter", r.SiteImported)
+	}
+	if recs[1].SiteImported != 30 || recs[1].LowSite != -200 {
+		t.Errorf("unexpected second interval: %+v", recs[1])
+	}
+}
+
+func TestLastClosedFiveMin(t *testing.T) {
+	at := time.Date(2026, 6, 14, 12, 0, 0, 0, time.UTC)
+	for now, want := range map[time.Time]time.Time{
+		at:                       at.Add(-5 * time.Minute),
+		at.Add(4 * time.Minute):  at.Add(-5 * time.Minute),
+		at.Add(5 * time.Minute):  at,
+		at.Add(-time.Nanosecond): at.Add(-10 * time.Minute),
+	} {
+		if got := lastClosedFiveMin(now); got != want.Unix() {
+			t.Errorf("lastClosedFiveMin(%s) = %s, want %s", now.Format("15:04:05.999"), time.Unix(got, 0).UTC().Format("15:04"), want.Format("15:04"))
+		}
+	}
+}
+
+func TestRollupDayBucketAcrossDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no tzdata")
+	}
+	registry.set([]LocationInfo{{ID: "VT", TimeLocation: ny}})
+	defer registry.set(nil)
+
+	// hourly samples across the fall back day, which is 25 hours long
+	begin := time.Date(2026, 11, 1, 0, 0, 0, 0, ny)
+	var samples []PowerSample
+	for dt := begin.Add(-time.Hour); dt.Before(begin.Add(26 * time.Hour)); dt = dt.Add(time.Hour) {
+		samples = append(samples, PowerSample{DateTime: dt.Unix()})
+	}
+	recs := rollupStats("VT", nil, samples, dayBucket("VT"))
+	if len(recs) != 3 {
+		t.Fatalf("got %d days, want 3", len(recs))
+	}
+	if recs[1].DateTime != begin.Unix() || recs[1].NumSiteSamples != 25 {
+		t.Errorf("fall back day starts %d with %d samples, want %d with 25", recs[1].DateTime, recs[1].NumSiteSamples, begin.Unix())
+	}
+}
+
+func TestRollupPercent(t *testing.T) {
+	recs := rollupPercent("VT", []PercentSample{{DateTime: 600, Percent: 80}, {DateTime: 660, Percent: 70}, {DateTime: 900, Percent: 90}}, fiveMinBucket)
+	if len(recs) != 2 {
+		t.Fatalf("got %d records, want 2", len(recs))
+	}
+	if r := recs[0]; r.HiPct != 80 || r.LowPct != 70 || r.LowPctTime != 660 || r.NumSamples != 2 || r.TotalSamples != 150 {
+		t.Errorf("unexpected record: %+v", r)
+	}
+}
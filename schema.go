@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/rs/zerolog/log"
+)
+
+// createEnergyTable holds the raw Powerwall aggregates payloads, one row per collector sample.
+const createEnergyTable = `create table if not exists energy (
+	id bigint not null auto_increment primary key,
+	location varchar(16) not null,
+	topic varchar(128) not null default '',
+	dt datetime(3) not null,
+	payload json not null,
+	site_instant_power double as (payload->>'$.site.instant_power') stored,
+	load_instant_power double as (payload->>'$.load.instant_power') stored,
+	battery_instant_power double as (payload->>'$.battery.instant_power') stored,
+	solar_instant_power double as (payload->>'$.solar.instant_power') stored,
+	key energy_location_dt (location, dt)
+)`
+
+// createBatteryTable holds the battery state of charge samples.
+const createBatteryTable = `create table if not exists battery (
+	id bigint not null auto_increment primary key,
+	location varchar(16) not null,
+	topic varchar(128) not null default '',
+	dt datetime(3) not null,
+	percent_charged double not null,
+	key battery_location_dt (location, dt)
+)`
+
+// statsTableColumns is the layout of day_top_stats and five_min_top_stats, see statsColumns.
+const statsTableColumns = `(
+	location varchar(16) not null,
+	datetime bigint not null,
+	hi_site double, hi_site_dt bigint, low_site double, low_site_dt bigint,
+	site_energy_imported double, site_energy_exported double, num_site_samples int, total_site_samples double,
+	hi_load double, hi_load_dt bigint, low_load double, low_load_dt bigint,
+	load_energy_imported double, load_energy_exported double, num_load_samples int, total_load_samples double,
+	hi_battery double, hi_battery_dt bigint, low_battery double, low_battery_dt bigint,
+	battery_energy_imported double, battery_energy_exported double, num_battery_samples int, total_battery_samples double,
+	hi_solar double, hi_solar_dt bigint, low_solar double, low_solar_dt bigint,
+	solar_energy_imported double, solar_energy_exported double, num_solar_samples int, total_solar_samples double,
+	primary key (location, datetime)
+)`
+
+// batteryPctTableColumns is the layout of day_battery_pct and five_min_battery_pct.
+const batteryPctTableColumns = `(
+	location varchar(16) not null,
+	datetime bigint not null,
+	hi_pct double, hi_pct_dt bigint, low_pct double, low_pct_dt bigint,
+	num_samples int, total_samples double,
+	primary key (location, datetime)
+)`
+
+// migrations creates every table the service uses, in dependency order. They are all
+// "if not exists" so running them against an existing database only adds what is missing.
+var migrations = []struct {
+	table string
+	ddl   string
+}{
+	{"energy", createEnergyTable},
+	{"battery", createBatteryTable},
+	{"five_min_top_stats", "create table if not exists five_min_top_stats " + statsTableColumns},
+	{"day_top_stats", "create table if not exists day_top_stats " + statsTableColumns},
+	{"five_min_battery_pct", "create table if not exists five_min_battery_pct " + batteryPctTableColumns},
+	{"day_battery_pct", "create table if not exists day_battery_pct " + batteryPctTableColumns},
+	{"locations", createLocationsTable},
+	{"weather", createWeatherTable},
+	{"load_anomalies", createLoadAnomaliesTable},
+	{"monthly_demand_peaks", createDemandPeaksTable},
+	{"data_versions", createDataVersionsTable},
+}
+
+// migrate creates any missing tables.
+func migrate() error {
+	dbConnect()
+	for _, m := range migrations {
+		if _, err := db.Exec(m.ddl); err != nil {
+			log.Error().Err(err).Msgf("creating %s", m.table)
+			return err
+		}
+		log.Info().Msgf("table %s ok", m.table)
+	}
+	return nil
+}
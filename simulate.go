@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog/log"
+)
+
+// VirtualHome describes the house the simulator models.
+type VirtualHome struct {
+	Location        string
+	TZ              *time.Location
+	Latitude        float64 // degrees
+	Longitude       float64 // degrees, 0 to derive it from the timezone
+	PVSize          float64 // kW
+	BatteryCapacity float64 // kWh
+	BatteryPower    float64 // max charge/discharge W
+	BackupReserve   float64 // percent kept for outages
+	BaseLoad        float64 // W
+}
+
+// virtualHome fills in the simulator's home from a location, using a typical single Powerwall
+// house for anything the location doesn't say.
+func virtualHome(loc LocationInfo) VirtualHome {
+	h := VirtualHome{
+		Location:        loc.ID,
+		TZ:              loc.TZ(),
+		Latitude:        loc.Latitude,
+		Longitude:       loc.Longitude,
+		PVSize:          loc.PVSize,
+		BatteryCapacity: loc.BatteryCapacity,
+		BatteryPower:    5000,
+		BackupReserve:   20,
+		BaseLoad:        300,
+	}
+	if h.Latitude == 0 && h.Longitude == 0 {
+		h.Latitude = 40
+	}
+	if h.PVSize == 0 {
+		h.PVSize = 7.5
+	}
+	if h.BatteryCapacity == 0 {
+		h.BatteryCapacity = 13.5
+	}
+	return h
+}
+
+// simLocation is the location to simulate: a registered or configured one if it exists, so the
+// simulator can be run without a database, otherwise a new location with default metadata.
+func simLocation(id string) (LocationInfo, error) {
+	if id == "" {
+		id = registry.defaultID()
+	}
+	if id == "" {
+		id = config().DefaultLocation
+	}
+	if l, ok := registry.lookup(id); ok {
+		return l, nil
+	}
+	for _, l := range config().Locations {
+		if strings.EqualFold(l.ID, id) {
+			return l, nil
+		}
+	}
+	return normalizeLocation(LocationInfo{ID: id})
+}
+
+// meterReading is one meter in a Powerwall /api/meters/aggregates payload.
+type meterReading struct {
+	LastCommunicationTime time.Time `json:"last_communication_time"`
+	InstantPower          float64   `json:"instant_power"`
+	EnergyExported        float64   `json:"energy_exported"`
+	EnergyImported        float64   `json:"energy_imported"`
+}
+
+// meterAggregates is the payload the collector publishes on energy/<loc>/energy. Power is in W
+// and energy in lifetime Wh; the battery is positive discharging and the site positive importing.
+type meterAggregates struct {
+	Site    meterReading `json:"site"`
+	Battery meterReading `json:"battery"`
+	Load    meterReading `json:"load"`
+	Solar   meterReading `json:"solar"`
+}
+
+// appliance is a large load that runs for a while, like a dryer or a kettle.
+type appliance struct {
+	power float64
+	until time.Time
+}
+
+// Simulator steps a virtual home through time.
+type Simulator struct {
+	Home       VirtualHome
+	rnd        *rand.Rand
+	chargeWh   float64
+	counters   meterAggregates
+	running    []appliance
+	day        time.Time
+	clearness  float64
+	lastStep   time.Time
+	cloudCover float64
+}
+
+func NewSimulator(h VirtualHome, seed int64) *Simulator {
+	return &Simulator{Home: h, rnd: rand.New(rand.NewSource(seed)), chargeWh: h.BatteryCapacity * 1000 / 2}
+}
+
+// longitude is the home's longitude, or the centre of its timezone if it has none.
+func (s *Simulator) longitude(t time.Time) float64 {
+	if s.Home.Longitude != 0 {
+		return s.Home.Longitude
+	}
+	_, offset := time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, s.Home.TZ).Zone()
+	return float64(offset) / 3600 * 15
+}
+
+// sunElevation is the sine of the sun's elevation at t, negative at night.
+func (s *Simulator) sunElevation(t time.Time) float64 {
+	lat := s.Home.Latitude * math.Pi / 180
+	day := float64(t.UTC().YearDay())
+	decl := 23.44 * math.Pi / 180 * math.Sin(2*math.Pi*(284+day)/365)
+	utc := t.UTC()
+	solarTime := float64(utc.Hour()) + float64(utc.Minute())/60 + float64(utc.Second())/3600 + s.longitude(t)/15
+	hourAngle := (solarTime - 12) * 15 * math.Pi / 180
+	return math.Sin(lat)*math.Sin(decl) + math.Cos(lat)*math.Cos(decl)*math.Cos(hourAngle)
+}
+
+// solar is the PV output at t: a clear sky curve scaled by the day's weather, with passing clouds.
+func (s *Simulator) solar(t time.Time) float64 {
+	local := t.In(s.Home.TZ)
+	if day := dayStart(local); !day.Equal(s.day) {
+		s.day = day
+		// mostly sunny, some overcast days
+		s.clearness = 1 - 0.7*math.Pow(s.rnd.Float64(), 2.5)
+		s.cloudCover = 1 - s.clearness
+	}
+	elevation := s.sunElevation(t)
+	if elevation <= 0 {
+		return 0
+	}
+	passing := 1.0
+	if s.rnd.Float64() < s.cloudCover {
+		passing = 0.3 + 0.5*s.rnd.Float64()
+	}
+	// panels and inverter lose about 15%
+	return s.Home.PVSize * 1000 * 0.85 * math.Pow(elevation, 1.2) * s.clearness * passing
+}
+
+// load is the house's consumption at t: base load, morning and evening routines and appliances.
+func (s *Simulator) load(t time.Time) float64 {
+	local := t.In(s.Home.TZ)
+	hour := float64(local.Hour()) + float64(local.Minute())/60
+	w := s.Home.BaseLoad
+	if hour >= 6.5 && hour < 8.5 {
+		w += 800
+	}
+	if hour >= 17 && hour < 21.5 {
+		w += 1200 * math.Sin(math.Pi*(hour-17)/4.5)
+	}
+
+	running := s.running[:0]
+	for _, a := range s.running {
+		if t.Before(a.until) {
+			running = append(running, a)
+			w += a.power
+		}
+	}
+	s.running = running
+	// about one appliance an hour while people are up
+	if hour >= 6 && hour < 23 && s.rnd.Float64() < s.stepSeconds(t)/3600 {
+		a := appliance{power: 1000 + 2000*s.rnd.Float64(), until: t.Add(time.Duration(5+s.rnd.Intn(40)) * time.Minute)}
+		s.running = append(s.running, a)
+		w += a.power
+	}
+	return w * (0.95 + 0.1*s.rnd.Float64())
+}
+
+func (s *Simulator) stepSeconds(t time.Time) float64 {
+	if s.lastStep.IsZero() || !t.After(s.lastStep) {
+		return 0
+	}
+	return t.Sub(s.lastStep).Seconds()
+}
+
+// Percent is the battery state of charge.
+func (s *Simulator) Percent() float64 {
+	return 100 * s.chargeWh / (s.Home.BatteryCapacity * 1000)
+}
+
+// Step advances the home to t and returns the aggregates payload. The battery runs in
+// self-powered mode: it soaks up surplus solar, covers the house down to the backup reserve,
+// and the grid takes or supplies whatever is left.
+func (s *Simulator) Step(t time.Time) meterAggregates {
+	hours := s.stepSeconds(t) / 3600
+	solar := s.solar(t)
+	load := s.load(t)
+
+	capacity := s.Home.BatteryCapacity * 1000
+	reserve := capacity * s.Home.BackupReserve / 100
+	battery := 0.0 // positive discharging
+	if surplus := solar - load; surplus > 0 {
+		charge := math.Min(surplus, s.Home.BatteryPower)
+		if hours > 0 {
+			charge = math.Min(charge, (capacity-s.chargeWh)/hours)
+		}
+		battery = -math.Max(charge, 0)
+	} else {
+		discharge := math.Min(-surplus, s.Home.BatteryPower)
+		if hours > 0 {
+			discharge = math.Min(discharge, (s.chargeWh-reserve)/hours)
+		}
+		battery = math.Max(discharge, 0)
+	}
+	site := load - solar - battery
+
+	s.chargeWh = math.Min(capacity, math.Max(0, s.chargeWh-battery*hours))
+	c := &s.counters
+	accumulate := func(m *meterReading, power float64) {
+		m.LastCommunicationTime = t
+		m.InstantPower = power
+		if power > 0 {
+			m.EnergyExported += power * hours
+		} else {
+			m.EnergyImported += -power * hours
+		}
+	}
+	accumulate(&c.Battery, battery)
+	accumulate(&c.Solar, solar)
+	// the site and load meters count the other way round: importing is positive
+	accumulate(&c.Site, -site)
+	c.Site.InstantPower = site
+	accumulate(&c.Load, -load)
+	c.Load.InstantPower = load
+	s.lastStep = t
+	return *c
+}
+
+// SimSink receives the simulator's samples.
+type SimSink interface {
+	Energy(location string, t time.Time, payload []byte) error
+	Battery(location string, t time.Time, percent float64) error
+}
+
+// dbSimSink writes to the energy and battery tables.
+type dbSimSink struct{}
+
+func (dbSimSink) Energy(location string, t time.Time, payload []byte) error {
+	return saveEnergySample(location, simTopic(location, "energy"), t, payload)
+}
+
+func (dbSimSink) Battery(location string, t time.Time, percent float64) error {
+	return saveBatterySample(location, simTopic(location, "battery"), t, percent)
+}
+
+// mqttSimSink publishes like the collector does.
+type mqttSimSink struct {
+	client mqtt.Client
+}
+
+func newMQTTSimSink(clientID string) (mqttSimSink, error) {
+	url := config().MQTT.URL()
+	client := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(url).SetClientID(clientID).SetAutoReconnect(true))
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return mqttSimSink{}, fmt.Errorf("connecting to %s: %w", url, token.Error())
+	}
+	return mqttSimSink{client: client}, nil
+}
+
+func (m mqttSimSink) publish(topic string, payload []byte) error {
+	token := m.client.Publish(topic, 1, false, payload)
+	token.Wait()
+	return token.Error()
+}
+
+func (m mqttSimSink) Energy(location string, t time.Time, payload []byte) error {
+	return m.publish(simTopic(location, "energy"), payload)
+}
+
+func (m mqttSimSink) Battery(location string, t time.Time, percent float64) error {
+	return m.publish(simTopic(location, "battery"), []byte(fmt.Sprintf(`{"percentage":%.2f}`, percent)))
+}
+
+// writerSimSink writes aggregates payloads one per line, the format ingest reads.
+type writerSimSink struct {
+	w io.Writer
+}
+
+func (s writerSimSink) Energy(location string, t time.Time, payload []byte) error {
+	_, err := fmt.Fprintf(s.w, "%s\n", payload)
+	return err
+}
+
+func (writerSimSink) Battery(location string, t time.Time, percent float64) error {
+	return nil
+}
+
+func simTopic(location string, kind string) string {
+	return "energy/" + strings.ToLower(location) + "/" + kind
+}
+
+// simulate steps the home from begin to end every interval, sending each sample to every sink.
+func simulate(sim *Simulator, begin time.Time, end time.Time, interval time.Duration, sinks []SimSink) (int, error) {
+	n := 0
+	for t := begin; t.Before(end); t = t.Add(interval) {
+		if err := simulateStep(sim, t, sinks); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func simulateStep(sim *Simulator, t time.Time, sinks []SimSink) error {
+	payload, err := json.Marshal(sim.Step(t))
+	if err != nil {
+		return err
+	}
+	for _, sink := range sinks {
+		if err := sink.Energy(sim.Home.Location, t, payload); err != nil {
+			return err
+		}
+		if err := sink.Battery(sim.Home.Location, t, sim.Percent()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// simulateLive steps the home in real time until stop is closed.
+func simulateLive(sim *Simulator, interval time.Duration, sinks []SimSink, stop <-chan struct{}) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := simulateStep(sim, time.Now(), sinks); err != nil {
+			return err
+		}
+		log.Debug().Msgf("simulate: %s battery %.1f%%", sim.Home.Location, sim.Percent())
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
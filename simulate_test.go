@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSimulatorStep(t *testing.T) {
+	tz, _ := time.LoadLocation("America/New_York")
+	home := virtualHome(LocationInfo{ID: "SIM", TimeLocation: tz, Latitude: 40.7, Longitude: -74})
+	sim := NewSimulator(home, 42)
+	begin := time.Date(2023, 6, 1, 0, 0, 0, 0, tz)
+	var prev meterAggregates
+	for ts := begin; ts.Before(begin.AddDate(0, 0, 7)); ts = ts.Add(time.Minute) {
+		agg := sim.Step(ts)
+		if pct := sim.Percent(); pct < home.BackupReserve-0.01 || pct > 100.01 {
+			t.Fatalf("%s: battery at %.2f%%", ts, pct)
+		}
+		if d := agg.Load.InstantPower - agg.Solar.InstantPower - agg.Battery.InstantPower - agg.Site.InstantPower; math.Abs(d) > 0.001 {
+			t.Fatalf("%s: energy doesn't balance by %.3fW", ts, d)
+		}
+		if h := ts.Hour(); (h < 4 || h >= 22) && agg.Solar.InstantPower != 0 {
+			t.Fatalf("%s: %.0fW of solar at night", ts, agg.Solar.InstantPower)
+		}
+		if math.Abs(agg.Battery.InstantPower) > home.BatteryPower {
+			t.Fatalf("%s: battery at %.0fW", ts, agg.Battery.InstantPower)
+		}
+		for _, c := range [][2]float64{
+			{prev.Site.EnergyImported, agg.Site.EnergyImported}, {prev.Site.EnergyExported, agg.Site.EnergyExported},
+			{prev.Battery.EnergyImported, agg.Battery.EnergyImported}, {prev.Battery.EnergyExported, agg.Battery.EnergyExported},
+			{prev.Load.EnergyImported, agg.Load.EnergyImported}, {prev.Solar.EnergyExported, agg.Solar.EnergyExported},
+		} {
+			if c[1] < c[0] {
+				t.Fatalf("%s: counter went from %f to %f", ts, c[0], c[1])
+			}
+		}
+		prev = agg
+	}
+	if prev.Solar.EnergyExported < 7*10000 || prev.Load.EnergyImported < 7*7000 {
+		t.Errorf("a week made %.0fWh solar for %.0fWh load", prev.Solar.EnergyExported, prev.Load.EnergyImported)
+	}
+	// load = solar + battery + site over the week too
+	balance := prev.Load.EnergyImported - prev.Solar.EnergyExported -
+		(prev.Battery.EnergyExported - prev.Battery.EnergyImported) - (prev.Site.EnergyImported - prev.Site.EnergyExported)
+	if math.Abs(balance) > 1 {
+		t.Errorf("counters don't balance by %.1fWh", balance)
+	}
+}
+
+func TestSimulateDeterministic(t *testing.T) {
+	run := func() []byte {
+		var buf bytes.Buffer
+		sim := NewSimulator(virtualHome(LocationInfo{ID: "SIM", TimeLocation: time.UTC}), 7)
+		begin := time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC)
+		n, err := simulate(sim, begin, begin.Add(time.Hour), 5*time.Minute, []SimSink{writerSimSink{&buf}})
+		if err != nil || n != 12 {
+			t.Fatalf("simulate() = %d, %v", n, err)
+		}
+		return buf.Bytes()
+	}
+	a, b := run(), run()
+	if !bytes.Equal(a, b) {
+		t.Errorf("the same seed gave different data")
+	}
+	line := bytes.SplitN(a, []byte("\n"), 2)[0]
+	if _, ok := aggregatesTime(line); !ok || !json.Valid(line) {
+		t.Errorf("ingest can't read %s", line)
+	}
+}
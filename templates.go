@@ -0,0 +1,20 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+)
+
+// templateFiles are the page templates, built into the binary so it runs from any directory.
+//
+//go:embed *.html
+var templateFiles embed.FS
+
+// templateFuncs are the functions the page templates can call.
+var templateFuncs = template.FuncMap{"asset": asset}
+
+// parseTemplate parses one of the page templates, which html/template escapes for the context
+// each value lands in: HTML text, attributes, URLs or JavaScript.
+func parseTemplate(name string) *template.Template {
+	return template.Must(template.New(name).Funcs(templateFuncs).ParseFS(templateFiles, name))
+}
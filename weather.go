@@ -0,0 +1,438 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var weatherTmpl *template.Template
+
+// WeatherRecord is one observation from a local weather file.
+type WeatherRecord struct {
+	Location    string
+	DateTime    int64
+	Temperature float64 // degrees C
+	CloudCover  float64 // percent
+	Irradiance  float64 // W/m2
+}
+
+// WeatherCorrelationRecord is an hour of five minute stats joined with the weather for that hour.
+type WeatherCorrelationRecord struct {
+	DateTime    int64   `json:"dateTime"`
+	LoadAvg     float64 `json:"loadAvg"`
+	SolarAvg    float64 `json:"solarAvg"`
+	Temperature float64 `json:"temperature"`
+	CloudCover  float64 `json:"cloudCover"`
+	Irradiance  float64 `json:"irradiance"`
+}
+
+// MarshalJSON writes missing weather as null.
+func (r WeatherCorrelationRecord) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		DateTime    int64       `json:"dateTime"`
+		LoadAvg     float64     `json:"loadAvg"`
+		SolarAvg    float64     `json:"solarAvg"`
+		Temperature interface{} `json:"temperature"`
+		CloudCover  interface{} `json:"cloudCover"`
+		Irradiance  interface{} `json:"irradiance"`
+	}{r.DateTime, r.LoadAvg, r.SolarAvg, nullFloat(r.Temperature), nullFloat(r.CloudCover), nullFloat(r.Irradiance)})
+}
+
+// WeatherCorrelation holds the load vs temperature and solar vs cloud cover views for a location.
+type WeatherCorrelation struct {
+	Location              string
+	Info                  LocationInfo
+	Days                  int
+	Records               []WeatherCorrelationRecord
+	LoadTempCorrelation   float64
+	SolarCloudCorrelation float64
+	LoadTempGraphData     []chartXY
+	SolarCloudGraphData   []chartXY
+	TemperatureGraphData  []chartPoint
+	CloudCoverGraphData   []chartPoint
+}
+
+// weatherColumns maps the accepted column/key names onto WeatherRecord fields.
+var weatherColumns = map[string]string{
+	"location":    "location",
+	"timestamp":   "timestamp",
+	"datetime":    "timestamp",
+	"dt":          "timestamp",
+	"time":        "timestamp",
+	"temperature": "temperature",
+	"temp":        "temperature",
+	"cloud_cover": "cloud_cover",
+	"cloudcover":  "cloud_cover",
+	"clouds":      "cloud_cover",
+	"irradiance":  "irradiance",
+	"ghi":         "irradiance",
+}
+
+const createWeatherTable = `create table if not exists weather (
+	location varchar(16) not null,
+	datetime bigint not null,
+	temperature double,
+	cloud_cover double,
+	irradiance double,
+	primary key (location, datetime)
+)`
+
+func ensureWeatherTable() error {
+	dbConnect()
+	_, err := db.Exec(createWeatherTable)
+	if err != nil {
+		log.Error().Err(err).Msg("ensureWeatherTable()")
+	}
+	return err
+}
+
+// parseTimestamp accepts unix seconds, RFC3339 or "2006-01-02 15:04[:05]" in tz.
+func parseTimestamp(s string, tz *time.Location) (int64, error) {
+	s = strings.TrimSpace(s)
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return secs, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.Unix(), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, s, tz); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, fmt.Errorf("unrecognized timestamp %q", s)
+}
+
+func weatherRecordFromFields(fields map[string]string, location string) (WeatherRecord, error) {
+	rec := WeatherRecord{Location: location}
+	if l := fields["location"]; l != "" {
+		rec.Location = strings.ToUpper(l)
+	}
+	if rec.Location == "" {
+		return rec, fmt.Errorf("no location")
+	}
+	ts, ok := fields["timestamp"]
+	if !ok {
+		return rec, fmt.Errorf("no timestamp")
+	}
+	var err error
+	if rec.DateTime, err = parseTimestamp(ts, locationTZ(rec.Location)); err != nil {
+		return rec, err
+	}
+	for key, dst := range map[string]*float64{"temperature": &rec.Temperature, "cloud_cover": &rec.CloudCover, "irradiance": &rec.Irradiance} {
+		v, ok := fields[key]
+		if !ok || strings.TrimSpace(v) == "" {
+			*dst = math.NaN()
+			continue
+		}
+		if *dst, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+			return rec, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return rec, nil
+}
+
+// parseWeatherCSV reads a CSV file with a header row. location is used when the file has no location column.
+func parseWeatherCSV(in io.Reader, location string) ([]WeatherRecord, error) {
+	r := csv.NewReader(in)
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	cols := make([]string, len(header))
+	for i, h := range header {
+		cols[i] = weatherColumns[strings.ToLower(strings.TrimSpace(h))]
+	}
+	recs := make([]WeatherRecord, 0)
+	for line := 2; ; line++ {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return recs, fmt.Errorf("line %d: %w", line, err)
+		}
+		fields := make(map[string]string)
+		for i, v := range row {
+			if i < len(cols) && cols[i] != "" {
+				fields[cols[i]] = v
+			}
+		}
+		rec, err := weatherRecordFromFields(fields, location)
+		if err != nil {
+			return recs, fmt.Errorf("line %d: %w", line, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// parseWeatherJSON reads a JSON array of observation objects using the same keys as the CSV header.
+func parseWeatherJSON(in io.Reader, location string) ([]WeatherRecord, error) {
+	var objs []map[string]interface{}
+	if err := json.NewDecoder(in).Decode(&objs); err != nil {
+		return nil, err
+	}
+	recs := make([]WeatherRecord, 0, len(objs))
+	for i, obj := range objs {
+		fields := make(map[string]string)
+		for k, v := range obj {
+			col := weatherColumns[strings.ToLower(k)]
+			if col == "" || v == nil {
+				continue
+			}
+			switch val := v.(type) {
+			case float64:
+				fields[col] = strconv.FormatFloat(val, 'f', -1, 64)
+			case string:
+				fields[col] = val
+			default:
+				return recs, fmt.Errorf("record %d: unsupported value for %s", i, k)
+			}
+		}
+		rec, err := weatherRecordFromFields(fields, location)
+		if err != nil {
+			return recs, fmt.Errorf("record %d: %w", i, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+func nullFloat(f float64) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil
+	}
+	return f
+}
+
+// saveWeather upserts the records into the weather table and records the change in data_versions.
+func saveWeather(recs []WeatherRecord) (int, error) {
+	log.Debug().Msgf("saveWeather(%d records)", len(recs))
+	if err := ensureWeatherTable(); err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare(`insert into weather (location, datetime, temperature, cloud_cover, irradiance) values (?, ?, ?, ?, ?)
+		on duplicate key update temperature = values(temperature), cloud_cover = values(cloud_cover), irradiance = values(irradiance)`)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	defer stmt.Close()
+	n := 0
+	for _, rec := range recs {
+		if _, err := stmt.Exec(rec.Location, rec.DateTime, nullFloat(rec.Temperature), nullFloat(rec.CloudCover), nullFloat(rec.Irradiance)); err != nil {
+			log.Error().Err(err).Msgf("saveWeather(): %+v", rec)
+			_ = tx.Rollback()
+			return 0, err
+		}
+		n++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return n, touchLocations(recs, func(r WeatherRecord) string { return r.Location })
+}
+
+// importWeatherFile loads a .csv or .json weather file into the weather table.
+func importWeatherFile(path string, location string) (int, error) {
+	log.Info().Msgf("importing weather from %s", path)
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var recs []WeatherRecord
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		recs, err = parseWeatherJSON(f, strings.ToUpper(location))
+	case ".csv":
+		recs, err = parseWeatherCSV(f, strings.ToUpper(location))
+	default:
+		return 0, fmt.Errorf("unsupported weather file type: %s", path)
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, rec := range recs {
+		if _, ok := registry.lookup(rec.Location); !ok {
+			return 0, fmt.Errorf("unknown location %q", rec.Location)
+		}
+	}
+	return saveWeather(recs)
+}
+
+// nanIfNull is the value, or NaN for NULL, which is how weather records mark missing readings.
+func nanIfNull(f sql.NullFloat64) float64 {
+	if !f.Valid {
+		return math.NaN()
+	}
+	return f.Float64
+}
+
+// getWeatherCorrelation returns hourly load/solar averages joined with the weather for each hour.
+// Weather the hour has no readings for is NaN.
+func getWeatherCorrelation(location string, beginDate int64, endDate int64) ([]WeatherCorrelationRecord, error) {
+	log.Debug().Msgf("getWeatherCorrelation(%s, %d, %d)", location, beginDate, endDate)
+	dbConnect()
+	rows, err := db.Query(`select f.datetime div 3600 * 3600 hr,
+			coalesce(sum(f.total_load_samples) / sum(f.num_load_samples), 0), coalesce(sum(f.total_solar_samples) / sum(f.num_solar_samples), 0),
+			avg(w.temperature), avg(w.cloud_cover), avg(w.irradiance)
+			from five_min_top_stats f join weather w on w.location = f.location and w.datetime div 3600 = f.datetime div 3600
+			where f.location = ? and f.datetime >= ? and f.datetime <= ? group by hr order by hr`, location, beginDate, endDate)
+	if err != nil {
+		log.Error().Err(err).Msgf("getWeatherCorrelation(): %+v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	recs := make([]WeatherCorrelationRecord, 0)
+	for rows.Next() {
+		var rec WeatherCorrelationRecord
+		var temperature, cloudCover, irradiance sql.NullFloat64
+		if err := rows.Scan(&rec.DateTime, &rec.LoadAvg, &rec.SolarAvg, &temperature, &cloudCover, &irradiance); err != nil {
+			log.Error().Err(err).Msgf("getWeatherCorrelation(): %+v", err)
+			return nil, err
+		}
+		rec.Temperature, rec.CloudCover, rec.Irradiance = nanIfNull(temperature), nanIfNull(cloudCover), nanIfNull(irradiance)
+		recs = append(recs, rec)
+	}
+	return recs, rows.Err()
+}
+
+// pearson returns the correlation coefficient of xs and ys, or NaN if it is undefined.
+func pearson(xs, ys []float64) float64 {
+	n := float64(len(xs))
+	if len(xs) != len(ys) || len(xs) < 2 {
+		return math.NaN()
+	}
+	var sx, sy, sxx, syy, sxy float64
+	for i := range xs {
+		sx += xs[i]
+		sy += ys[i]
+		sxx += xs[i] * xs[i]
+		syy += ys[i] * ys[i]
+		sxy += xs[i] * ys[i]
+	}
+	den := math.Sqrt(n*sxx-sx*sx) * math.Sqrt(n*syy-sy*sy)
+	if den == 0 {
+		return math.NaN()
+	}
+	return (n*sxy - sx*sy) / den
+}
+
+// weatherChartData is the charts' series. Hours missing a reading are left out of the scatter
+// plots and are gaps in the time series.
+func weatherChartData(in []WeatherCorrelationRecord) (loadTemp []chartXY, solarCloud []chartXY, temperature []chartPoint, cloudCover []chartPoint) {
+	lt, sc := make([]chartXY, 0, len(in)), make([]chartXY, 0, len(in))
+	temp, cloud := make([]chartPoint, 0, len(in)), make([]chartPoint, 0, len(in))
+	for _, v := range in {
+		dt := v.DateTime * 1000
+		if !math.IsNaN(v.Temperature) {
+			lt = append(lt, chartXY{X: v.Temperature, Y: v.LoadAvg})
+		}
+		if !math.IsNaN(v.CloudCover) {
+			sc = append(sc, chartXY{X: v.CloudCover, Y: v.SolarAvg})
+		}
+		temp = append(temp, chartPoint{X: dt, Y: v.Temperature, Null: math.IsNaN(v.Temperature)})
+		cloud = append(cloud, chartPoint{X: dt, Y: v.CloudCover, Null: math.IsNaN(v.CloudCover)})
+	}
+	return lt, sc, temp, cloud
+}
+
+func weatherCorrelation(location string, days int) (WeatherCorrelation, error) {
+	c := WeatherCorrelation{Location: location, Days: days}
+	now := time.Now().In(locationTZ(location))
+	beginDate := now.AddDate(0, 0, -1*days).Unix()
+	endDate := now.Unix()
+	recs, err := getWeatherCorrelation(location, beginDate, endDate)
+	if err != nil {
+		return c, err
+	}
+	c.Records = recs
+
+	var temps, loads, clouds, solars []float64
+	for _, r := range recs {
+		if !math.IsNaN(r.Temperature) {
+			temps = append(temps, r.Temperature)
+			loads = append(loads, r.LoadAvg)
+		}
+		if !math.IsNaN(r.CloudCover) {
+			clouds = append(clouds, r.CloudCover)
+			solars = append(solars, r.SolarAvg)
+		}
+	}
+	c.LoadTempCorrelation = pearson(temps, loads)
+	c.SolarCloudCorrelation = pearson(clouds, solars)
+	c.LoadTempGraphData, c.SolarCloudGraphData, c.TemperatureGraphData, c.CloudCoverGraphData = weatherChartData(recs)
+	return c, nil
+}
+
+func weatherHandler(w http.ResponseWriter, r *http.Request) {
+	loc, ok := requestLocation(w, r)
+	if !ok {
+		return
+	}
+	location := loc.ID
+	days, err := daysParam(r, "days", config().GraphDays)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := weatherCorrelation(location, days)
+	if err != nil {
+		s := fmt.Sprintf("%+v", err)
+		http.Error(w, s, http.StatusInternalServerError)
+		return
+	}
+	c.Info = loc
+	if err := weatherTmpl.Execute(w, c); err != nil {
+		msg := http.StatusText(http.StatusInternalServerError)
+		log.Error().Err(err).Msg(msg)
+	}
+}
+
+// weatherAPIHandler serves the hourly load/solar vs weather series as JSON.
+func weatherAPIHandler(w http.ResponseWriter, r *http.Request) {
+	loc, ok := requestLocation(w, r)
+	if !ok {
+		return
+	}
+	location := loc.ID
+	days, err := daysParam(r, "days", config().GraphDays)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := weatherCorrelation(location, days)
+	if err != nil {
+		s := fmt.Sprintf("%+v", err)
+		http.Error(w, s, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, struct {
+		Location              string                     `json:"location"`
+		Days                  int                        `json:"days"`
+		LoadTempCorrelation   interface{}                `json:"loadTempCorrelation"`
+		SolarCloudCorrelation interface{}                `json:"solarCloudCorrelation"`
+		Hours                 []WeatherCorrelationRecord `json:"hours"`
+	}{c.Location, c.Days, nullFloat(c.LoadTempCorrelation), nullFloat(c.SolarCloudCorrelation), c.Records})
+}
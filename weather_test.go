@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParseWeather(t *testing.T) {
+	testInit()
+	weatherTmpl = parseTemplate("weather.html")
+}
+
+func TestParseWeatherCSV(t *testing.T) {
+	testInit()
+	in := `timestamp,temperature,cloud_cover,irradiance
+1672531200,-3.5,80,12.5
+2023-01-01T01:00:00Z,-4,,0
+`
+	recs, err := parseWeatherCSV(strings.NewReader(in), "VT")
+	if err != nil {
+		t.Fatalf("parseWeatherCSV: %v", err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("got %d records, want 2", len(recs))
+	}
+	if recs[0].Location != "VT" || recs[0].DateTime != 1672531200 || recs[0].Temperature != -3.5 || recs[0].CloudCover != 80 {
+		t.Errorf("unexpected first record: %+v", recs[0])
+	}
+	if recs[1].DateTime != 1672534800 || !math.IsNaN(recs[1].CloudCover) {
+		t.Errorf("unexpected second record: %+v", recs[1])
+	}
+
+	if _, err := parseWeatherCSV(strings.NewReader("timestamp,temperature\nyesterday,1\n"), "VT"); err == nil {
+		t.Error("expected an error for a bad timestamp")
+	}
+}
+
+func TestParseWeatherJSON(t *testing.T) {
+	testInit()
+	in := `[{"location": "nh", "timestamp": 1672531200, "temp": 1.5, "clouds": 20}]`
+	recs, err := parseWeatherJSON(strings.NewReader(in), "VT")
+	if err != nil {
+		t.Fatalf("parseWeatherJSON: %v", err)
+	}
+	if len(recs) != 1 || recs[0].Location != "NH" || recs[0].Temperature != 1.5 || recs[0].CloudCover != 20 || !math.IsNaN(recs[0].Irradiance) {
+		t.Errorf("unexpected records: %+v", recs)
+	}
+}
+
+func TestPearson(t *testing.T) {
+	if r := pearson([]float64{1, 2, 3}, []float64{2, 4, 6}); math.Abs(r-1) > 1e-9 {
+		t.Errorf("perfect correlation: got %f", r)
+	}
+	if r := pearson([]float64{1, 2, 3}, []float64{6, 4, 2}); math.Abs(r+1) > 1e-9 {
+		t.Errorf("perfect anti-correlation: got %f", r)
+	}
+	if r := pearson([]float64{1}, []float64{1}); !math.IsNaN(r) {
+		t.Errorf("single point: got %f, want NaN", r)
+	}
+}
+
+func TestWeatherChartDataSkipsMissing(t *testing.T) {
+	recs := []WeatherCorrelationRecord{
+		{DateTime: 3600, LoadAvg: 500, SolarAvg: 100, Temperature: 10, CloudCover: math.NaN(), Irradiance: math.NaN()},
+		{DateTime: 7200, LoadAvg: 600, SolarAvg: 200, Temperature: math.NaN(), CloudCover: 50, Irradiance: 300},
+	}
+	lt, sc, temp, cloud := weatherChartData(recs)
+	if len(lt) != 1 || lt[0].X != 10 || len(sc) != 1 || sc[0].X != 50 {
+		t.Errorf("scatter points %+v %+v", lt, sc)
+	}
+	if len(temp) != 2 || temp[0].Null || !temp[1].Null || len(cloud) != 2 || !cloud[0].Null || cloud[1].Null {
+		t.Errorf("time series %+v %+v", temp, cloud)
+	}
+	b, err := json.Marshal(recs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"dateTime":3600,"loadAvg":500,"solarAvg":100,"temperature":10,"cloudCover":null,"irradiance":null}`; string(b) != want {
+		t.Errorf("got %s, want %s", b, want)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hostile breaks out of HTML text, attributes and JS strings if it isn't escaped.
+const hostile = `</script><script>alert(1)</script>"'><img src=x onerror=alert(2)>`
+
+// checkEscaped fails if the page has any of hostile's markup unescaped.
+func checkEscaped(t *testing.T, name string, page string) {
+	t.Helper()
+	for _, raw := range []string{"<script>alert", "<img src=x", `"'>`} {
+		if strings.Contains(page, raw) {
+			t.Errorf("%s has %q unescaped", name, raw)
+		}
+	}
+}
+
+// samplePages is data for each page template with value in every string it shows.
+func samplePages(value string) map[string]interface{} {
+	loc := LocationInfo{ID: value, Name: value, MQTTTopic: value, TimeLocation: time.UTC}
+	issue := QualityIssue{Kind: "gap", Table: value, Detail: value, When: value}
+	return map[string]interface{}{
+		"dashboard.html": TopStats{Location: value, Info: loc, Range: DateRange{From: value, To: value, Prev: template.URL("from=" + url.QueryEscape(value))},
+			Anomalies: []LoadAnomaly{{Location: value}}, Gaps: chartGaps{Fill: value}},
+		"live.html": templateData{Location: value, Info: loc, MQTTSubTopic: value,
+			MQTT: MQTTConfig{Broker: value, Path: value}, Gaps: chartGaps{Fill: "linear"}},
+		"weather.html":  WeatherCorrelation{Location: value, Info: loc},
+		"baseload.html": BaseloadReport{Location: value, Info: loc},
+		"compare.html": Comparison{Location: value, Info: loc, QueryA: value, QueryB: value,
+			A: PeriodTotals{Label: value, Begin: value}, B: PeriodTotals{Label: value},
+			Rows: []CompareRow{{Name: value}}},
+		"overview.html": Overview{Locations: []LocationOverview{{Location: value, Name: value, Error: value}},
+			Fleet: FleetTotals{Period: value, Locations: []string{value}}, Selected: map[string]bool{value: true}},
+		"index.html":   HomePage{Service: value, Locations: []LocationOverview{{Location: value, Name: value}}},
+		"login.html":   LoginPage{Next: value, Error: value},
+		"quality.html": QualityReport{Location: value, Info: loc, Issues: []QualityIssue{issue}},
+	}
+}
+
+func TestTemplatesEscapeHostileValues(t *testing.T) {
+	pages := samplePages(hostile)
+	for name, data := range pages {
+		var b bytes.Buffer
+		if err := parseTemplate(name).Execute(&b, data); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		checkEscaped(t, name, b.String())
+	}
+}
+
+func TestHostileLocationParam(t *testing.T) {
+	registry.set([]LocationInfo{{ID: "VT", Name: "Vermont"}})
+	defer registry.set(nil)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/live?location="+url.QueryEscape(hostile), nil)
+	if _, ok := requestLocation(w, r); ok {
+		t.Fatal("hostile location found")
+	}
+	if w.Code != 404 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("got %d %v", w.Code, w.Header())
+	}
+}